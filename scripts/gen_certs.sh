@@ -0,0 +1,36 @@
+#!/bin/bash
+# Generate the cluster CA, a certificate for every host in scripts/servers,
+# a certificate for dcli and the secret shared by membership packets.
+# usage: ./scripts/gen_certs.sh [output dir, default ./certs]
+set -e
+out=${1:-certs}
+mkdir -p $out
+
+if [ ! -f $out/ca.key ]; then
+    openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -subj "/CN=maplejuice-ca" \
+        -keyout $out/ca.key -out $out/ca.pem
+fi
+
+sign() {
+    name=$1
+    san=$2
+    openssl req -newkey rsa:2048 -nodes -subj "/CN=$name" -keyout $out/$name.key -out $out/$name.csr
+    printf "subjectAltName=$san\nextendedKeyUsage=serverAuth,clientAuth\n" > $out/$name.ext
+    openssl x509 -req -in $out/$name.csr -CA $out/ca.pem -CAkey $out/ca.key -CAcreateserial \
+        -days 825 -extfile $out/$name.ext -out $out/$name.pem
+    rm $out/$name.csr $out/$name.ext
+}
+
+for h in `cat scripts/servers`; do
+    san="DNS:$h"
+    for ip in `getent hosts $h | awk '{print $1}'`; do
+        san="$san,IP:$ip"
+    done
+    sign $h $san
+done
+sign dcli "DNS:localhost,IP:127.0.0.1"
+
+if [ ! -f $out/cluster.secret ]; then
+    openssl rand -hex 32 > $out/cluster.secret
+fi
+chmod 600 $out/*.key $out/cluster.secret
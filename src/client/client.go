@@ -19,25 +19,46 @@ import (
 	"github.com/fatih/color"
 )
 
-const usage_prompt = `Client commands:
+const usage_prompt = `Usage: dcli [-ca ca.pem -cert dcli.pem -key dcli.key] <command>
+
+Client commands:
 
 - exec "<command>" - execute command on all servers
 - dump - dump local host membership list
-- ls <sdfsfilename> - list all machine addresses where this file is currently being stored
-- lsdir <sdfsDir> - list all sdfsfiles in sdfs directory
+- ring - print the share of the hash ring owned by each node
+- ls [-regex | -literal] <sdfsfilename> - list all machine addresses where this file is currently being stored
+- lsdir [-literal] <sdfsDir> - list all sdfsfiles in sdfs directory
+- lsdir [-regex] <selector> - list all sdfsfiles matching a glob or a regex
+- lsdir -R <sdfsDir> - list a sdfs directory with all its subdirectories
+- mkdir <sdfsDir> - create a sdfs directory and its parents
+- mv <src> <dst> - rename or move a sdfs file or directory
+- cp [-regex | -literal] <src> <dst> - copy a sdfs file or directory, with the versions and replication of each file, selected files are copied into the directory dst, under their sdfs names
+- stat <sdfsname> - print the size, timestamp and replicas of a file, or the entries of a directory
 - store - list all files currently being stored at this machine
-- put <localfilepath> <sdfsfilepath> - Insert or update a local file to the distributed file system
-- put <localdirpath> <sdfsfilepath> - Insert or update all local files in a directory
-- append <localfilepath> <sdfsfilepath> append a local file to the distributed file system
-- get <sdfsfilename> <localfilename> - Get the file from the distributed file system, and store it to <localfilename>
-- delete <sdfsfilename> - Delete a file from the distributed file system
-- deleteDir <sdfsdir> - Delete a directory from the distributed file system
+- metrics [-reset] - print the read repairs done by this machine, -reset zeroes the counters
+- put [-rep n [-r r] [-w w]] <localfilepath> <sdfsfilepath> - Insert or update a local file to the distributed file system, with n replicas and read/write quorums r/w
+- put [-rep n [-r r] [-w w]] <localdirpath> <sdfsfilepath> - Insert or update all local files in a directory
+- setrep <sdfsname> <n> - Change the number of replicas of a file, or of all files in a directory
+- append <localfilepath> <sdfsfilepath> - Append a local file to a file in the distributed file system, every replica gets the appends in the same order
+- get [-version ts] [-literal] <sdfsfilename> <localfilename> - Get the file, or one of its versions, from the distributed file system, and store it to <localfilename>
+- get [-regex] <selector> <localdir> - Get the selected files into <localdir>, under their sdfs names
+- get-versions <sdfsfilename> <num_versions> <localfilename> - Get the latest versions of the file into one local file, newest first
+- delete [-regex | -literal] <sdfsfilename> - Delete a file from the distributed file system
+- deleteDir [-literal] <sdfsdir> - Delete a directory from the distributed file system
+- deleteDir [-regex] <selector> - Delete the files matching a glob or a regex
 - maple <maple_exe> <num_maples> <sdfs_intermediate_filename_prefix> <sdfs_src_directory> - Send Maple Task
 - juice <juice_exe> <num_juices> <sdfs_intermediate_filename_prefix> <sdfs_dest_filename> delete_input={0,1} - Send Juice Task
+
+A sdfs name with *, ? or [ given to ls, lsdir, get, delete, deleteDir or cp, or as the juice prefix, is a glob selecting every file it matches,
+like logs/2019-*/vm0?.log, * and ? do not match /. With -regex the name is a regex that must match whole file names. With -literal
+the name is taken as it is, a glob can also escape these characters with a \. The storage nodes evaluate the selector.
 `
 
 var port = flag.Int("port", 8000, "The port to connect to; defaults to 8000.")
 var dump = flag.Bool("dump", false, "Dump membership list")
+var caFile = flag.String("ca", "", "CA certificate of the cluster, enables mutual TLS")
+var certFile = flag.String("cert", "", "Client certificate signed by the cluster CA")
+var keyFile = flag.String("key", "", "Private key of the client certificate")
 var servers_file = "/usr/app/log_querier/servers"
 var wg sync.WaitGroup
 
@@ -46,66 +67,190 @@ const DcliReceiverPort = node.DcliReceiverPort
 
 func main() {
 	flag.Parse()
-	if len(os.Args) == 1 {
+	if flag.NArg() == 0 {
 		fmt.Println(usage_prompt)
 		os.Exit(1)
 	}
-	parseCommand()
+	if *caFile != "" {
+		err := node.LoadTLS(*caFile, *certFile, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	parseCommand(flag.Args())
 }
 
-func parseCommand() {
-	switch os.Args[1] {
+func parseCommand(args []string) {
+	switch args[0] {
 	case "exec":
-		cmd := os.Args[2]
+		cmd := args[1]
 		execCommand(cmd)
 	case "dump":
 		dumpMembershipList()
+	case "ring":
+		printRingOwnership()
 	case "ls":
-		sdfsName := os.Args[2]
-		listHostsForFile(sdfsName)
+		lsFlags := flag.NewFlagSet("ls", flag.ExitOnError)
+		regex := lsFlags.Bool("regex", false, "The name is a regex selecting files")
+		literal := lsFlags.Bool("literal", false, "The name is a sdfs name even with *, ? or [")
+		lsFlags.Parse(args[1:])
+		if sel, ok := selectorArg(lsFlags.Arg(0), *regex, *literal); ok {
+			for _, sdfsName := range selectFromSystem(sel) {
+				fmt.Printf("%s:\n", sdfsName)
+				listHostsForFile(sdfsName)
+			}
+		} else {
+			listHostsForFile(lsFlags.Arg(0))
+		}
 	case "lsdir":
-		sdfsDir := os.Args[2]
-		listDirFromSystem(sdfsDir)
+		lsFlags := flag.NewFlagSet("lsdir", flag.ExitOnError)
+		recursive := lsFlags.Bool("R", false, "List subdirectories recursively")
+		regex := lsFlags.Bool("regex", false, "The name is a regex selecting files")
+		literal := lsFlags.Bool("literal", false, "The name is a sdfs name even with *, ? or [")
+		lsFlags.Parse(args[1:])
+		if sel, ok := selectorArg(lsFlags.Arg(0), *regex, *literal); *recursive && !ok {
+			listDirRecursive(lsFlags.Arg(0))
+		} else {
+			listDirFromSystem(sel)
+		}
+	case "mkdir":
+		if len(args) != 2 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		makeDir(args[1])
+	case "mv":
+		if len(args) != 3 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		renameInSystem(args[1], args[2])
+	case "cp":
+		cpFlags := flag.NewFlagSet("cp", flag.ExitOnError)
+		regex := cpFlags.Bool("regex", false, "The source is a regex selecting files")
+		literal := cpFlags.Bool("literal", false, "The name is a sdfs name even with *, ? or [")
+		cpFlags.Parse(args[1:])
+		if cpFlags.NArg() != 2 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		if sel, ok := selectorArg(cpFlags.Arg(0), *regex, *literal); ok {
+			// like get, the selected files keep their path under the destination
+			for _, sdfsName := range selectFromSystem(sel) {
+				copyInSystem(sdfsName, filepath.Join(cpFlags.Arg(1), sdfsName))
+			}
+		} else {
+			copyInSystem(cpFlags.Arg(0), cpFlags.Arg(1))
+		}
+	case "stat":
+		if len(args) != 2 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		statFromSystem(args[1])
 	case "store":
 		listLocalFiles()
+	case "metrics":
+		metricsFlags := flag.NewFlagSet("metrics", flag.ExitOnError)
+		reset := metricsFlags.Bool("reset", false, "Zero the counters after printing them")
+		metricsFlags.Parse(args[1:])
+		printRepairMetrics(*reset)
 	case "put":
-		if len(os.Args) != 4 {
+		putFlags := flag.NewFlagSet("put", flag.ExitOnError)
+		replicas := putFlags.Int("rep", 0, "Number of replicas, keeps the current one by default")
+		readQuorum := putFlags.Int("r", 0, "Read quorum, defaults to replicas - write quorum + 1")
+		writeQuorum := putFlags.Int("w", 0, "Write quorum, defaults to a majority of replicas")
+		putFlags.Parse(args[1:])
+		if putFlags.NArg() != 2 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		source := putFlags.Arg(0)
+		destination := putFlags.Arg(1)
+		putFileToSystem(source, destination, node.Replication{Replicas: *replicas, ReadQuorum: *readQuorum, WriteQuorum: *writeQuorum})
+	case "append":
+		if len(args) != 3 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		appendFileToSystem(args[1], args[2])
+	case "setrep":
+		if len(args) != 3 {
 			log.Fatal("Need More Arguments!")
 			fmt.Println(usage_prompt)
 		}
-		source := os.Args[2]
-		destination := os.Args[3]
-		putFileToSystem(source, destination)
+		replicas, err := strconv.Atoi(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		setReplication(args[1], replicas)
 	case "get":
-		source := os.Args[2]
-		destination := os.Args[3]
-		getFileFromSystem(source, destination)
+		getFlags := flag.NewFlagSet("get", flag.ExitOnError)
+		version := getFlags.Int("version", 0, "Timestamp of the version to get, the latest by default")
+		regex := getFlags.Bool("regex", false, "The name is a regex selecting files")
+		literal := getFlags.Bool("literal", false, "The name is a sdfs name even with *, ? or [")
+		getFlags.Parse(args[1:])
+		if getFlags.NArg() != 2 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		if sel, ok := selectorArg(getFlags.Arg(0), *regex, *literal); ok {
+			if *version != 0 {
+				log.Fatal("-version needs a single file")
+			}
+			getSelectedFiles(sel, getFlags.Arg(1))
+		} else {
+			getFileFromSystem(getFlags.Arg(0), getFlags.Arg(1), *version)
+		}
+	case "get-versions":
+		if len(args) != 4 {
+			log.Fatal("Need More Arguments!")
+			fmt.Println(usage_prompt)
+		}
+		numVersions, err := strconv.Atoi(args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		getVersionsFromSystem(args[1], numVersions, args[3])
 	case "delete":
-		sdfsName := os.Args[2]
-		deleteFileFromSystem(sdfsName)
+		deleteFlags := flag.NewFlagSet("delete", flag.ExitOnError)
+		regex := deleteFlags.Bool("regex", false, "The name is a regex selecting files")
+		literal := deleteFlags.Bool("literal", false, "The name is a sdfs name even with *, ? or [")
+		deleteFlags.Parse(args[1:])
+		if sel, ok := selectorArg(deleteFlags.Arg(0), *regex, *literal); ok {
+			for _, sdfsName := range selectFromSystem(sel) {
+				deleteFileFromSystem(sdfsName)
+			}
+		} else {
+			deleteFileFromSystem(deleteFlags.Arg(0))
+		}
 	case "deleteDir":
-		sdfsDir := os.Args[2]
-		deleteDirFromSystem(sdfsDir)
+		deleteFlags := flag.NewFlagSet("deleteDir", flag.ExitOnError)
+		regex := deleteFlags.Bool("regex", false, "The name is a regex selecting files")
+		literal := deleteFlags.Bool("literal", false, "The name is a sdfs name even with *, ? or [")
+		deleteFlags.Parse(args[1:])
+		sel, _ := selectorArg(deleteFlags.Arg(0), *regex, *literal)
+		deleteDirFromSystem(sel)
 	case "maple":
-		if len(os.Args) != 6 {
+		if len(args) != 5 {
 			log.Fatal("Need More Arguments!")
 			fmt.Println(usage_prompt)
 		}
-		maple_exe := os.Args[2]
-		num_maples, _ := strconv.Atoi(os.Args[3])
-		prefix := os.Args[4]
-		src_dir := os.Args[5]
+		maple_exe := args[1]
+		num_maples, _ := strconv.Atoi(args[2])
+		prefix := args[3]
+		src_dir := args[4]
 		CallMapleTask(maple_exe, num_maples, prefix, src_dir)
 	case "juice":
-		if len(os.Args) != 7 {
+		if len(args) != 6 {
 			log.Fatal("Need More Arguments!")
 			fmt.Println(usage_prompt)
 		}
-		juice_exe := os.Args[2]
-		num_juices, _ := strconv.Atoi(os.Args[3])
-		prefix := os.Args[4]
-		destFilename := os.Args[5]
-		deleteInput := (os.Args[6] == "1") // TODO: Should check if input is valid
+		juice_exe := args[1]
+		num_juices, _ := strconv.Atoi(args[2])
+		prefix := args[3]
+		destFilename := args[4]
+		deleteInput := (args[5] == "1") // TODO: Should check if input is valid
 		CallJuiceTask(juice_exe, num_juices, prefix, destFilename, deleteInput)
 	default:
 		fmt.Println(usage_prompt)
@@ -121,7 +266,7 @@ func dialLocalNode() (*rpc.Client, string) {
 	}
 	ip := fmt.Sprintf("%s", addr_raw[0])
 	address := ip + ":" + node.RPC_DEFAULT_PORT
-	client, err := rpc.Dial("tcp", address)
+	client, err := node.DialRPC(address)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -154,6 +299,19 @@ func listLocalFiles() {
 	fmt.Printf("\n%d files.\n", cnt)
 }
 
+func printRepairMetrics(reset bool) {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var metrics node.RepairMetrics
+	err := client.Call(node.FileServiceName+address+".GetRepairMetrics", reset, &metrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("read repairs started: %d\n", metrics.Reads)
+	fmt.Printf("replicas repaired: %d\n", metrics.Repaired)
+	fmt.Printf("replicas failed to repair: %d\n", metrics.Failed)
+}
+
 func prompRoutine(c chan string) {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Print("Last update was in 1 minute, type \"yes\" to confirm update: ")
@@ -164,9 +322,9 @@ func prompRoutine(c chan string) {
 	c <- text
 }
 
-func putFileToSystem(localName, sdfsName string) {
+func putFileToSystem(localName, sdfsName string, replication node.Replication) {
 	localAbsPath, _ := filepath.Abs(localName)
-	reply := CallPutFileRequest(localAbsPath, sdfsName, false)
+	reply := CallPutFileRequest(localAbsPath, sdfsName, false, replication)
 	if reply == node.RPC_PROMPT {
 		c := make(chan string)
 		go prompRoutine(c)
@@ -174,7 +332,7 @@ func putFileToSystem(localName, sdfsName string) {
 		case text := <-c:
 			text = strings.TrimSuffix(text, "\n")
 			if text == "yes" {
-				CallPutFileRequest(localAbsPath, sdfsName, true)
+				CallPutFileRequest(localAbsPath, sdfsName, true, replication)
 			} else {
 				fmt.Println("Abort")
 			}
@@ -184,20 +342,62 @@ func putFileToSystem(localName, sdfsName string) {
 	}
 }
 
-func getFileFromSystem(sdfsName, localName string) {
+func appendFileToSystem(localName, sdfsName string) {
+	localAbsPath, _ := filepath.Abs(localName)
+	if _, err := os.Stat(localAbsPath); os.IsNotExist(err) {
+		fmt.Printf("%s doesn't exist\n", localAbsPath)
+		os.Exit(1)
+	}
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result node.RPCResultType
+	args := node.PutFileArgs{LocalName: localAbsPath, SdfsName: sdfsName, ForceUpdate: true, Appending: true}
+	err := client.Call(node.FileServiceName+address+".PutFileRequest", args, &result)
+	if result != node.RPC_SUCCESS {
+		fmt.Printf("Failed to append to %s\n", sdfsName)
+		fmt.Println(err)
+	}
+}
+
+func getFileFromSystem(sdfsName, localName string, version int) {
 	localAbsPath, _ := filepath.Abs(localName)
-	err := CallGetFileRequest(sdfsName, localAbsPath)
+	err := CallGetFileRequest(sdfsName, localAbsPath, version)
 	if err != nil {
 		fmt.Printf("Failed to get file %s\n", sdfsName)
 	}
 }
 
+// getSelectedFiles gets every selected file to localDir/<sdfs name>
+func getSelectedFiles(sel node.Selector, localDir string) {
+	localAbsDir, _ := filepath.Abs(localDir)
+	for _, sdfsName := range selectFromSystem(sel) {
+		localPath := filepath.Join(localAbsDir, sdfsName)
+		if err := os.MkdirAll(filepath.Dir(localPath), 0777); err != nil {
+			log.Fatal(err)
+		}
+		getFileFromSystem(sdfsName, localPath, 0)
+	}
+}
+
+func getVersionsFromSystem(sdfsName string, numVersions int, localName string) {
+	localAbsPath, _ := filepath.Abs(localName)
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result node.RPCResultType
+	args := &node.GetVersionsArgs{SdfsName: sdfsName, NumVersions: numVersions, LocalName: localAbsPath}
+	err := client.Call(node.FileServiceName+address+".GetVersionsRequest", args, &result)
+	if result != node.RPC_SUCCESS {
+		fmt.Printf("Failed to get versions of %s\n", sdfsName)
+		fmt.Println(err)
+	}
+}
+
 func deleteFileFromSystem(sdfsName string) {
 	CallDeleteFileRequest(sdfsName)
 }
 
-func deleteDirFromSystem(dirName string) {
-	CallDeleteDirRequest(dirName)
+func deleteDirFromSystem(sel node.Selector) {
+	CallDeleteDirRequest(sel)
 }
 
 func dumpMembershipList() {
@@ -205,6 +405,11 @@ func dumpMembershipList() {
 	mbList.NicePrint()
 }
 
+func printRingOwnership() {
+	mbList := node.ConstructFromTmpFile()
+	mbList.PrintOwnership()
+}
+
 func execCommand(cmd string) {
 	file, err := os.Open(servers_file)
 	if err != nil {
@@ -251,7 +456,7 @@ func request_cmd(host string, port int, cmd string) {
 	}
 }
 
-func CallPutFileRequest(src, dest string, forceUpdate bool) node.RPCResultType {
+func CallPutFileRequest(src, dest string, forceUpdate bool, replication node.Replication) node.RPCResultType {
 	// src is absolute path.
 	// dest is sdfs filename
 	if !filepath.IsAbs(src) {
@@ -265,20 +470,36 @@ func CallPutFileRequest(src, dest string, forceUpdate bool) node.RPCResultType {
 	client, address := dialLocalNode()
 	defer client.Close()
 	var reply node.RPCResultType
-	err := client.Call(node.FileServiceName+address+".PutFileRequest", node.PutFileArgs{src, dest, forceUpdate, false, false}, &reply)
+	args := node.PutFileArgs{LocalName: src, SdfsName: dest, ForceUpdate: forceUpdate, Replication: replication}
+	err := client.Call(node.FileServiceName+address+".PutFileRequest", args, &reply)
 	if err != nil {
 		log.Printf("call PutFileRequest return err")
 		log.Fatal(err)
 	}
+	if reply == node.RPC_CONFLICT {
+		fmt.Printf("%s was written concurrently by another put, both versions are kept, see get-versions\n", dest)
+	}
 	return reply
 }
 
-func CallGetFileRequest(sdfsName, localPath string) error {
+func setReplication(sdfsName string, replicas int) {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result node.RPCResultType
+	args := node.SetReplicationArgs{SdfsName: sdfsName, Replication: node.Replication{Replicas: replicas}}
+	err := client.Call(node.FileServiceName+address+".SetReplicationRequest", args, &result)
+	if result != node.RPC_SUCCESS {
+		fmt.Println("Fail to set replication, check SLOG output")
+		fmt.Println(err)
+	}
+}
+
+func CallGetFileRequest(sdfsName, localPath string, version int) error {
 	// localPath should be absolute path
 	client, address := dialLocalNode()
 	defer client.Close()
 	var result node.RPCResultType
-	err := client.Call(node.FileServiceName+address+".GetFileRequest", []string{sdfsName, localPath}, &result)
+	err := client.Call(node.FileServiceName+address+".GetFileRequest", []string{sdfsName, localPath, strconv.Itoa(version)}, &result)
 	return err
 }
 
@@ -294,11 +515,11 @@ func CallDeleteFileRequest(sdfsName string) error {
 	return err
 }
 
-func CallDeleteDirRequest(sdfsDir string) error {
+func CallDeleteDirRequest(sel node.Selector) error {
 	client, address := dialLocalNode()
 	defer client.Close()
 	var result node.RPCResultType
-	err := client.Call(node.FileServiceName+address+".DeleteSDFSDirRequest", sdfsDir, &result)
+	err := client.Call(node.FileServiceName+address+".DeleteSDFSDirRequest", &sel, &result)
 	if result != node.RPC_SUCCESS {
 		fmt.Println("Fail to delete file, check SLOG output")
 		fmt.Println(err)
@@ -367,13 +588,100 @@ func waitResponse() {
 	fmt.Print(message)
 }
 
-func listDirFromSystem(sdfsDir string) {
+func listDirFromSystem(sel node.Selector) {
 	client, address := dialLocalNode()
 	defer client.Close()
 	var result []string
-	client.Call(node.FileServiceName+address+".ListFileInDirRequest", sdfsDir, &result)
+	if err := client.Call(node.FileServiceName+address+".ListFileInDirRequest", &sel, &result); err != nil {
+		fmt.Println(err)
+		return
+	}
 	for _, filePath := range result {
 		fmt.Println(filePath)
 	}
 	fmt.Printf("\n%d files in total\n", len(result))
 }
+
+func listDirRecursive(sdfsDir string) {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result []string
+	err := client.Call(node.FileServiceName+address+".ListDirRequest", &node.ListDirArgs{Dir: sdfsDir, Recursive: true}, &result)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, path := range result {
+		fmt.Println(path)
+	}
+	fmt.Printf("\n%d entries in total\n", len(result))
+}
+
+// selectorArg tells if a name given to a command selects files
+func selectorArg(name string, regex, literal bool) (node.Selector, bool) {
+	sel := node.Selector{Pattern: name, Regex: regex, Literal: literal}
+	return sel, sel.Selects()
+}
+
+func selectFromSystem(sel node.Selector) []string {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result []string
+	err := client.Call(node.FileServiceName+address+".SelectFilesRequest", &sel, &result)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return result
+}
+
+func makeDir(sdfsDir string) {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result node.RPCResultType
+	err := client.Call(node.FileServiceName+address+".MkdirRequest", sdfsDir, &result)
+	if result != node.RPC_SUCCESS {
+		fmt.Printf("Failed to create %s\n", sdfsDir)
+		fmt.Println(err)
+	}
+}
+
+func renameInSystem(src, dst string) {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result node.RPCResultType
+	err := client.Call(node.FileServiceName+address+".RenameRequest", &node.RenameArgs{Src: src, Dst: dst}, &result)
+	if result != node.RPC_SUCCESS {
+		fmt.Printf("Failed to move %s to %s\n", src, dst)
+		fmt.Println(err)
+	}
+}
+
+func copyInSystem(src, dst string) {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var result node.RPCResultType
+	err := client.Call(node.FileServiceName+address+".CopyRequest", &node.RenameArgs{Src: src, Dst: dst}, &result)
+	if result != node.RPC_SUCCESS {
+		fmt.Printf("Failed to copy %s to %s\n", src, dst)
+		fmt.Println(err)
+	}
+}
+
+func statFromSystem(sdfsName string) {
+	client, address := dialLocalNode()
+	defer client.Close()
+	var stat node.FileStat
+	err := client.Call(node.FileServiceName+address+".StatRequest", sdfsName, &stat)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if stat.IsDir {
+		fmt.Printf("%s/ directory, %d entries, timestamp %d\n", stat.Name, stat.Entries, stat.Timestamp)
+		return
+	}
+	fmt.Printf("%s %d bytes, timestamp %d, on %d of %d replicas\n", stat.Name, stat.Size, stat.Timestamp, stat.Holders, stat.Replicas)
+	if stat.Conflicts > 0 {
+		fmt.Printf("%d concurrent writes not resolved, see get-versions\n", stat.Conflicts)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+This file defines the ordered appends.
+
+An append is sent to the master replica of the file, the primary, or to the
+next replica if the master can not be reached. The primary appends it to its
+copy, then forwards the content to the other replicas with the offset it was
+written at and its timestamp. A replica only appends at that offset, so all
+the replicas of a file hold the same bytes in the same order however many
+clients append at once. A replica whose copy does not end at the offset
+refuses the append, and the primary scrubs the file to bring it back in line.
+*/
+
+package node
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	. "slogger"
+	"sync"
+	"time"
+)
+
+const ORDER_APPEND = -1 // offset of an append the receiver orders
+
+var ErrAppendOffset = errors.New("append does not start at the end of the copy")
+var ErrNoWriteQuorum = errors.New("not enough replicas stored the write")
+
+// appendSection sends an append to the primary of toHash and waits for it to
+// be ordered and stored on the write quorum
+func (node *Node) appendSection(toHash string, args *StoreFileArgs, section fileSection, result *RPCResultType) error {
+	args.MasterNodeId = node.GetMasterID(toHash)
+	args.Offset = ORDER_APPEND
+	var err error
+	for _, address := range node.GetResponsibleAddressesWithReplicas(toHash, args.Replication.Replicas) {
+		if err = storeSection(address, args, section); err == nil {
+			*result = RPC_SUCCESS
+			return nil
+		}
+		if _, unreachable := err.(dialError); !unreachable {
+			break
+		}
+		SLOG.Printf("[appendSection] primary %s of %s is unreachable, trying the next replica", address, args.SdfsName)
+	}
+	*result = RPC_FAIL
+	return err
+}
+
+// appendLock returns the lock ordering the appends of a file on its primary
+func (node *Node) appendLock(sdfsName string) *sync.Mutex {
+	node.appendLocksLock.Lock()
+	defer node.appendLocksLock.Unlock()
+	lock, ok := node.appendLocks[sdfsName]
+	if !ok {
+		lock = &sync.Mutex{}
+		node.appendLocks[sdfsName] = lock
+	}
+	return lock
+}
+
+// orderAppend appends the content of r at the end of the local copy, then
+// forwards it to the other replicas at the same offset
+func (node *Node) orderAppend(args *StoreFileArgs, r io.Reader) error {
+	tmpFile, err := ioutil.TempFile("", "append")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = io.CopyBuffer(tmpFile, r, make([]byte, TCPBufferSize))
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	lock := node.appendLock(args.SdfsName)
+	lock.Lock()
+	defer lock.Unlock()
+	ordered := *args
+	ordered.Offset = node.FileList.LocalSize(args.SdfsName)
+	ordered.Ts = node.Clock.Now(node.Id)
+	f, err := os.Open(tmpFile.Name())
+	if err != nil {
+		return err
+	}
+	err = node.StoreFileFromReader(&ordered, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	self := node.IP + ":" + node.RPC_Port
+	replication := ordered.Replication.Normalize()
+	targets := []string{}
+	for _, address := range node.GetResponsibleAddressesWithReplicas(args.SdfsName, replication.Replicas) {
+		if address != self {
+			targets = append(targets, address)
+		}
+	}
+	c := make(chan error, len(targets))
+	for _, address := range targets {
+		go func(address string) {
+			c <- node.storeOrHint(address, args.SdfsName, &ordered, fileSection{tmpFile.Name(), 0, -1})
+		}(address)
+	}
+	// wait for every replica so the next append does not overtake this one
+	acks := 1
+	misplaced := false
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < len(targets); i++ {
+		select {
+		case err := <-c:
+			if err == nil {
+				acks++
+			} else if _, unreachable := err.(dialError); !unreachable {
+				SLOG.Printf("[orderAppend] %s at %d: %v", args.SdfsName, ordered.Offset, err)
+				misplaced = misplaced || err == ErrAppendOffset
+			}
+		case <-timeout:
+			SLOG.Printf("[orderAppend] timeout when forwarding %s", args.SdfsName)
+			i = len(targets)
+		}
+	}
+	if misplaced {
+		go node.ScrubFile(args.SdfsName)
+	}
+	if !replication.reachedWriteQuorum(acks, len(targets)+1) {
+		return ErrNoWriteQuorum
+	}
+	return nil
+}
+
+// checkAppendOffset refuses an append that does not start at the end of the
+// local copy
+func (node *Node) checkAppendOffset(args *StoreFileArgs) error {
+	if size := node.FileList.LocalSize(args.SdfsName); size != args.Offset {
+		SLOG.Printf("[checkAppendOffset] %s: offset %d, size %d", args.SdfsName, args.Offset, size)
+		return ErrAppendOffset
+	}
+	return nil
+}
+
+// LocalSize returns the size of the local copy of a file, 0 if there is none
+func (fl *FileList) LocalSize(sdfsName string) int64 {
+	fileInfo := fl.GetFileInfo(sdfsName)
+	if fileInfo == nil {
+		return 0
+	}
+	fi, err := os.Stat(fileInfo.Localpath)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
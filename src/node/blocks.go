@@ -0,0 +1,266 @@
+/*
+This file defines the block storage of large files.
+
+A put of a file larger than Node.BlockSize splits it into blocks of about
+BlockSize bytes. A block ends at the end of a line, unless the line is longer
+than another BlockSize. Each block is stored as an ordinary sdfs file named
+<name>#block<i>, so it is placed on the ring and replicated on its own, and
+the file itself holds a json manifest listing the blocks. A get reassembles
+the blocks, and maple gets every block as a separate input.
+*/
+
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "slogger"
+	"strings"
+)
+
+const DEFAULT_BLOCK_SIZE = 64 * 1024 * 1024
+const BLOCK_SEP = "#block"
+
+var ErrAppendToBlocks = errors.New("cannot append to a file stored in blocks")
+
+type BlockInfo struct {
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+type Manifest struct {
+	Size   int64
+	Blocks []BlockInfo
+}
+
+func BlockName(sdfsName string, i int) string {
+	return fmt.Sprintf("%s%s%d", sdfsName, BLOCK_SEP, i)
+}
+
+func IsBlockName(sdfsName string) bool {
+	return strings.Contains(filepath.Base(sdfsName), BLOCK_SEP)
+}
+
+// blockParent returns the file a block belongs to
+func blockParent(blockName string) string {
+	return blockName[:strings.LastIndex(blockName, BLOCK_SEP)]
+}
+
+// splitLines cuts a local file into sections of at least blockSize bytes
+// ending at a line end, a section stops at 2 * blockSize in a long line
+func splitLines(localPath string, blockSize int64) ([]fileSection, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReaderSize(f, TCPBufferSize)
+	res := []fileSection{}
+	offset := int64(0)
+	for {
+		n, err := io.CopyN(ioutil.Discard, reader, blockSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		eof := err == io.EOF
+		for extra := int64(0); !eof && extra < blockSize; extra++ {
+			c, err := reader.ReadByte()
+			if err == io.EOF {
+				eof = true
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			n++
+			if c == '\n' {
+				break
+			}
+		}
+		if n > 0 {
+			res = append(res, fileSection{localPath, offset, n})
+			offset += n
+		}
+		if eof {
+			return res, nil
+		}
+	}
+}
+
+// putBlockedFile stores the blocks of a large file then its manifest, blocks
+// of the old version past the new last one are deleted
+func (node *Node) putBlockedFile(args *StoreFileArgs, localName string, oldBlocks []BlockInfo, result *RPCResultType) error {
+	sections, err := splitLines(localName, node.BlockSize)
+	if err != nil {
+		*result = RPC_FAIL
+		return err
+	}
+	manifest := Manifest{}
+	for i, section := range sections {
+		blockArgs := *args
+		blockArgs.SdfsName = BlockName(args.SdfsName, i)
+		blockArgs.PrevTs = 0 // conflicts are detected on the manifest
+		err := node.replicateSection(blockArgs.SdfsName, &blockArgs, section, result)
+		if err != nil || *result != RPC_SUCCESS {
+			return err
+		}
+		manifest.Blocks = append(manifest.Blocks, BlockInfo{blockArgs.SdfsName, section.Offset, section.Size})
+		manifest.Size += section.Size
+	}
+	tmpFile, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		*result = RPC_FAIL
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	err = json.NewEncoder(tmpFile).Encode(manifest)
+	tmpFile.Close()
+	if err != nil {
+		*result = RPC_FAIL
+		return err
+	}
+	args.Manifest = true
+	err = node.replicateSection(args.SdfsName, args, fileSection{tmpFile.Name(), 0, -1}, result)
+	if err == nil && *result == RPC_SUCCESS && len(oldBlocks) > len(sections) {
+		node.deleteBlocks(oldBlocks[len(sections):])
+	}
+	SLOG.Printf("[putBlockedFile] %s stored in %d blocks", args.SdfsName, len(sections))
+	return err
+}
+
+func (node *Node) deleteBlocks(blocks []BlockInfo) {
+	for _, block := range blocks {
+		var result RPCResultType
+		node.deleteFile(block.Name, &result)
+	}
+}
+
+// manifestBlocks returns the blocks of a file, nil if it is not stored in
+// blocks
+func (node *Node) manifestBlocks(sdfsName string) ([]BlockInfo, error) {
+	meta, ok := node.GetFileMeta(sdfsName)
+	if !ok || !meta.Manifest {
+		return nil, nil
+	}
+	manifest, err := node.ReadManifest(sdfsName)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Blocks, nil
+}
+
+// ReadManifest fetches and parses the latest manifest of a file
+func (node *Node) ReadManifest(sdfsName string) (*Manifest, error) {
+	tmpFile, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	if _, err := node.GetLatestToLocal(sdfsName, tmpFile.Name()); err != nil {
+		return nil, err
+	}
+	return readManifestFile(tmpFile.Name())
+}
+
+func readManifestFile(localPath string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// FetchFile saves the latest version of a sdfs file to localPath, a file
+// stored in blocks is reassembled
+func (node *Node) FetchFile(sdfsName, localPath string) error {
+	address, err := node.GetLatestToLocal(sdfsName, localPath)
+	if err != nil {
+		return err
+	}
+	meta, err := CallGetFileMeta(address, sdfsName)
+	if err != nil {
+		return err
+	}
+	if !meta.Manifest {
+		return nil
+	}
+	return node.joinBlocks(localPath)
+}
+
+// joinBlocks replaces the manifest at localPath with the content of its blocks
+func (node *Node) joinBlocks(localPath string) error {
+	manifest, err := readManifestFile(localPath)
+	if err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(localPath), filepath.Base(localPath)+".blocks")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	for _, block := range manifest.Blocks {
+		if err := node.appendBlock(out, block); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), localPath)
+}
+
+func (node *Node) appendBlock(out *os.File, block BlockInfo) error {
+	tmpFile, err := ioutil.TempFile("", "block")
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	if _, err := node.GetLatestToLocal(block.Name, tmpFile.Name()); err != nil {
+		return err
+	}
+	in, err := os.Open(tmpFile.Name())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	n, err := io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	if n != block.Size {
+		return fmt.Errorf("block %s has %d bytes, expected %d", block.Name, n, block.Size)
+	}
+	return nil
+}
+
+// ListMapleInputs lists the files in a sdfs dir for maple, a file stored in
+// blocks is replaced by its blocks so they go to different workers
+func (node *Node) ListMapleInputs(sdfsDir string) []string {
+	files := node.listSDFSDir(sdfsDir)
+	blocked := make(map[string]bool)
+	for _, sdfsName := range files {
+		if IsBlockName(sdfsName) {
+			blocked[blockParent(sdfsName)] = true
+		}
+	}
+	res := []string{}
+	for _, sdfsName := range files {
+		if !blocked[sdfsName] {
+			res = append(res, sdfsName)
+		}
+	}
+	return res
+}
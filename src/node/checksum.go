@@ -0,0 +1,290 @@
+/*
+This file defines the checksums of stored files and the scrubber.
+
+Every replica records the crc32c of its local copy in FileInfo when the file
+is written, appends extend it. The sender of a put passes the checksum of the
+content along, and a replica verifies its copy on every read, so a corrupted
+or truncated replica is never served silently.
+
+Each node runs ScrubRoutine, every ScrubInterval it verifies the files it is
+the master of on all their replicas. The latest good copy is pushed to the
+replicas that are corrupted, missing the file or holding another version.
+*/
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	. "slogger"
+	"time"
+)
+
+const SCRUB_INTERVAL = 10 * time.Minute
+
+var ErrChecksum = errors.New("checksum mismatch")
+var ErrStaleWrite = errors.New("a newer version is stored")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crcWriter computes the crc32c of the bytes written, starting from Sum
+type crcWriter struct {
+	Sum uint32
+}
+
+func (w *crcWriter) Write(p []byte) (int, error) {
+	w.Sum = crc32.Update(w.Sum, crcTable, p)
+	return len(p), nil
+}
+
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+func checksumOfFile(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := &crcWriter{}
+	_, err = io.CopyBuffer(w, f, make([]byte, TCPBufferSize))
+	return w.Sum, err
+}
+
+// VerifyFile compares the local copy of a file with its checksum
+func (fl *FileList) VerifyFile(sdfsName string) (FileMeta, error) {
+	fileInfo := fl.GetFileInfo(sdfsName)
+	if fileInfo == nil {
+		return FileMeta{}, errors.New("file not exist: " + sdfsName)
+	}
+	fileInfo.FileLock.Lock()
+	defer fileInfo.FileLock.Unlock()
+	meta := fileInfo.meta()
+	sum, err := checksumOfFile(fileInfo.Localpath)
+	if err != nil {
+		return meta, err
+	}
+	if sum != fileInfo.Checksum {
+		SLOG.Printf("[VerifyFile] %s is corrupted, checksum %08x, expected %08x", sdfsName, sum, fileInfo.Checksum)
+		return meta, ErrChecksum
+	}
+	return meta, nil
+}
+
+// GetLatestToLocal saves the latest version of a file to localPath, if the
+// chosen copy is corrupted another replica with the same version is tried.
+// The stale replicas of the read quorum are repaired in the background. It
+// returns the address of the copy
+func (node *Node) GetLatestToLocal(sdfsName, localPath string) (string, error) {
+	address, ts, stale := node.getLatestReplicas(sdfsName)
+	err := GetFileToLocal(address, sdfsName, localPath)
+	if err == nil {
+		node.startReadRepair(sdfsName, address, ts, stale)
+	}
+	if err != ErrChecksum {
+		return address, err
+	}
+	SLOG.Printf("[GetLatestToLocal] %s on %s is corrupted, trying other replicas", sdfsName, address)
+	replication := node.GetReplication(sdfsName)
+	for _, other := range node.GetResponsibleAddressesWithReplicas(sdfsName, replication.Replicas) {
+		if other == address {
+			continue
+		}
+		c := make(chan Pair, 1)
+		go CallGetTimeStamp(other, sdfsName, c)
+		select {
+		case p := <-c:
+			if p.Ts != ts {
+				continue
+			}
+		case <-time.After(2 * time.Second):
+			continue
+		}
+		if err = GetFileToLocal(other, sdfsName, localPath); err == nil {
+			return other, nil
+		}
+	}
+	return address, err
+}
+
+// checkStaleWrite refuses to replace a copy by an older version
+func (node *Node) checkStaleWrite(args *StoreFileArgs) error {
+	if args.Tmp || args.Appending {
+		return nil
+	}
+	if fileInfo := node.FileList.GetFileInfo(args.SdfsName); fileInfo != nil && fileInfo.Timestamp > args.Ts {
+		return ErrStaleWrite
+	}
+	return nil
+}
+
+// ScrubRoutine verifies the replicas of the files this node is the master of
+// every ScrubInterval, after dropping old versions and abandoned copies
+func (node *Node) ScrubRoutine() {
+	for {
+		time.Sleep(node.Timing.ScrubInterval)
+		if !node.active {
+			break
+		}
+		if node.MbList == nil || node.IsDegraded() {
+			continue
+		}
+		node.FileList.CollectVersions()
+		node.DropExpiredStages(STAGE_TTL)
+		node.ScrubFiles()
+	}
+}
+
+// ScrubFiles scrubs the files this node is the master of, it returns the
+// number of repaired replicas
+func (node *Node) ScrubFiles() int {
+	repaired := 0
+	for _, info := range node.FileList.GetOwnedFileInfos(node.Id) {
+		if info.Tmp {
+			continue
+		}
+		n, err := node.ScrubFile(info.Sdfsfilename)
+		if err != nil {
+			SLOG.Printf("[Scrub] %s: %v", info.Sdfsfilename, err)
+		}
+		repaired += n
+	}
+	return repaired
+}
+
+type replicaState struct {
+	Address string
+	Meta    FileMeta
+	Err     error
+}
+
+// ScrubFile verifies every replica of a file and repairs the bad ones from
+// the latest good copy, it returns the number of repaired replicas
+func (node *Node) ScrubFile(sdfsName string) (int, error) {
+	replication := node.GetReplication(sdfsName)
+	addresses := node.GetResponsibleAddressesWithReplicas(sdfsName, replication.Replicas)
+	c := make(chan replicaState, len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			meta, err := CallVerifyFile(address, sdfsName)
+			c <- replicaState{address, meta, err}
+		}(address)
+	}
+	states := []replicaState{}
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < len(addresses); i++ {
+		select {
+		case state := <-c:
+			states = append(states, state)
+		case <-timeout:
+			SLOG.Printf("[Scrub] timeout when verifying %s", sdfsName)
+			i = len(addresses)
+		}
+	}
+	source := latestGoodCopy(states)
+	if source == nil {
+		return 0, errors.New("no good copy of " + sdfsName)
+	}
+	bad := []string{}
+	for _, state := range states {
+		if _, unreachable := state.Err.(dialError); unreachable {
+			continue
+		}
+		if state.Err != nil || state.Meta.Timestamp != source.Meta.Timestamp || state.Meta.Checksum != source.Meta.Checksum {
+			bad = append(bad, state.Address)
+		}
+	}
+	if len(bad) == 0 {
+		return 0, nil
+	}
+	tmpFile, err := ioutil.TempFile("", "scrub")
+	if err != nil {
+		return 0, err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	if err := GetFileToLocal(source.Address, sdfsName, tmpFile.Name()); err != nil {
+		return 0, err
+	}
+	args := &StoreFileArgs{
+		MasterNodeId: node.GetMasterID(sdfsName),
+		SdfsName:     sdfsName,
+		Ts:           source.Meta.Timestamp,
+		Manifest:     source.Meta.Manifest,
+		Replication:  source.Meta.Replication,
+	}
+	done := make(chan int, len(bad))
+	for _, address := range bad {
+		go PutLocalFile(address, args, tmpFile.Name(), done)
+	}
+	repaired := 0
+	timeout = time.After(10 * time.Second)
+	for i := 0; i < len(bad); i++ {
+		select {
+		case ack := <-done:
+			if RPCResultType(ack) == RPC_SUCCESS {
+				repaired++
+			}
+		case <-timeout:
+			return repaired, errors.New("timeout when repairing " + sdfsName)
+		}
+	}
+	SLOG.Printf("[Scrub] repaired %s on %d of %v from %s", sdfsName, repaired, bad, source.Address)
+	return repaired, nil
+}
+
+// latestGoodCopy returns a verified copy with the largest timestamp, among
+// copies of that timestamp the most common checksum wins
+func latestGoodCopy(states []replicaState) *replicaState {
+	votes := make(map[string]int)
+	var best *replicaState
+	for i, state := range states {
+		if state.Err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%d/%08x", state.Meta.Timestamp, state.Meta.Checksum)
+		votes[key]++
+		if best == nil || state.Meta.Timestamp > best.Meta.Timestamp {
+			best = &states[i]
+		} else if state.Meta.Timestamp == best.Meta.Timestamp &&
+			votes[key] > votes[fmt.Sprintf("%d/%08x", best.Meta.Timestamp, best.Meta.Checksum)] {
+			best = &states[i]
+		}
+	}
+	return best
+}
+
+/* Callee begin */
+func (fileService *FileService) VerifyLocalFile(sdfsName string, result *FileMeta) error {
+	meta, err := fileService.node.FileList.VerifyFile(sdfsName)
+	*result = meta
+	return err
+}
+
+/* Callee end */
+
+/* Caller begin */
+
+// dialError is returned when the replica can not be reached, it says nothing
+// about its copy
+type dialError struct {
+	error
+}
+
+func CallVerifyFile(address, sdfsName string) (FileMeta, error) {
+	var meta FileMeta
+	client, err := DialRPC(address)
+	if err != nil {
+		return meta, dialError{err}
+	}
+	defer client.Close()
+	err = client.Call(FileServiceName+address+".VerifyLocalFile", sdfsName, &meta)
+	return meta, err
+}
+
+/* Caller end */
@@ -0,0 +1,400 @@
+/*
+This file defines the server side copy of sdfs files.
+
+The content of a copy goes between storage nodes, not through the node asked
+for it. That node picks a replica holding the latest version of src and asks
+it to push its copy, with the old versions, the timestamps and the
+replication, to the replicas of dst. A replica stages what it receives under
+STAGE_DIR, out of its file list. Once the write quorum has staged the whole
+file, the node commits the copy: each replica moves the staged file and its
+versions in place and adds them to its file list at once, so a reader either
+does not find dst or finds it with all its versions. A file stored in blocks
+copies its blocks first, then stages a manifest listing the new blocks. A
+rename is a copy followed by the delete of src. The id of a copy is the
+timestamp it started at, a replica drops a copy still staged STAGE_TTL later
+since its coordinator died before committing it.
+*/
+
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "slogger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const STAGE_DIR = ".staging" // in the storage root
+const STAGE_TTL = 10 * time.Minute
+
+var ErrNoStage = errors.New("nothing staged for the copy")
+var ErrCopyQuorum = errors.New("not enough replicas staged the copy")
+
+type PushCopyArgs struct {
+	Src          string
+	Dst          string
+	Stage        int      // id of the copy
+	MasterNodeId int      // master of dst
+	Targets      []string // replicas of dst
+}
+
+// copyFile copies the latest version of a file and its old versions to dst,
+// then adds dst to its directory
+func (node *Node) copyFile(src, dst string) error {
+	address, _ := node.GetAddressOfLatestTS(src)
+	meta, err := CallGetFileMeta(address, src)
+	if err != nil {
+		return err
+	}
+	if meta.Manifest {
+		err = node.copyBlockedFile(src, dst, meta)
+	} else {
+		err = node.copyObject(address, src, dst, meta.Replication)
+	}
+	if err != nil {
+		return err
+	}
+	node.addToNamespace(dst)
+	SLOG.Printf("[copyFile] %s copied to %s", src, dst)
+	return nil
+}
+
+// copyObject has the replica at address push its copy of src to the replicas
+// of dst, then commits it
+func (node *Node) copyObject(address, src, dst string, replication Replication) error {
+	args := &PushCopyArgs{
+		Src:          src,
+		Dst:          dst,
+		Stage:        node.Clock.Now(node.Id),
+		MasterNodeId: node.GetMasterID(dst),
+		Targets:      node.GetResponsibleAddressesWithReplicas(dst, replication.Normalize().Replicas),
+	}
+	staged, err := CallPushCopy(address, args)
+	if err != nil {
+		abortStage(args.Targets, args.Stage)
+		return err
+	}
+	return commitCopy(args.Targets, staged, args.Stage, replication)
+}
+
+// copyBlockedFile copies the blocks of src to the blocks of dst, then stages a
+// manifest listing them with the timestamp of the manifest of src
+func (node *Node) copyBlockedFile(src, dst string, meta FileMeta) error {
+	manifest, err := node.ReadManifest(src)
+	if err != nil {
+		return err
+	}
+	copied := []BlockInfo{}
+	for i, block := range manifest.Blocks {
+		address, _ := node.GetAddressOfLatestTS(block.Name)
+		blockMeta, err := CallGetFileMeta(address, block.Name)
+		if err == nil {
+			manifest.Blocks[i].Name = BlockName(dst, i)
+			err = node.copyObject(address, block.Name, manifest.Blocks[i].Name, blockMeta.Replication)
+		}
+		if err != nil {
+			node.deleteBlocks(copied)
+			return err
+		}
+		copied = append(copied, manifest.Blocks[i])
+	}
+	tmpFile, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		node.deleteBlocks(copied)
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	err = json.NewEncoder(tmpFile).Encode(manifest)
+	tmpFile.Close()
+	if err != nil {
+		node.deleteBlocks(copied)
+		return err
+	}
+	stage := node.Clock.Now(node.Id)
+	targets := node.GetResponsibleAddressesWithReplicas(dst, meta.Replication.Normalize().Replicas)
+	args := StoreFileArgs{
+		MasterNodeId: node.GetMasterID(dst),
+		SdfsName:     dst,
+		Ts:           meta.Timestamp,
+		Manifest:     true,
+		Replication:  meta.Replication,
+		Stage:        stage,
+	}
+	staged := stageFile(targets, args, FileInfo{Localpath: tmpFile.Name()})
+	if err := commitCopy(targets, staged, stage, meta.Replication); err != nil {
+		node.deleteBlocks(copied)
+		return err
+	}
+	return nil
+}
+
+// commitCopy commits a copy on the replicas that staged it if they are a
+// write quorum, and drops it everywhere else. A replica that missed the copy
+// gets it back from duplication
+func commitCopy(targets, staged []string, stage int, replication Replication) error {
+	if !replication.reachedWriteQuorum(len(staged), len(targets)) {
+		abortStage(targets, stage)
+		return ErrCopyQuorum
+	}
+	committed := 0
+	for _, address := range staged {
+		if err := CallCommitStage(address, stage); err != nil {
+			SLOG.Printf("[commitCopy] commit %d on %s: %v", stage, address, err)
+		} else {
+			committed++
+		}
+	}
+	abortStage(targets, stage)
+	if !replication.reachedWriteQuorum(committed, len(targets)) {
+		SLOG.Printf("[commitCopy] %d committed on %d of %d replicas", stage, committed, len(targets))
+		return ErrCopyQuorum
+	}
+	return nil
+}
+
+// stageFile stages a local file and its old versions on every target, it
+// returns the targets that staged all of them
+func stageFile(targets []string, args StoreFileArgs, info FileInfo) []string {
+	c := make(chan string, len(targets))
+	for _, address := range targets {
+		go func(address string, args StoreFileArgs) {
+			err := storeSection(address, &args, fileSection{info.Localpath, 0, -1})
+			// oldest first, like pushVersions
+			for i := len(info.Versions) - 1; i >= 0 && err == nil; i-- {
+				args.Ts = info.Versions[i].Timestamp
+				args.OldVersion = true
+				err = storeSection(address, &args, fileSection{info.Versions[i].Localpath, 0, -1})
+			}
+			if err != nil {
+				SLOG.Printf("[stageFile] %s on %s: %v", args.SdfsName, address, err)
+				address = ""
+			}
+			c <- address
+		}(address, args)
+	}
+	staged := []string{}
+	for range targets {
+		if address := <-c; address != "" {
+			staged = append(staged, address)
+		}
+	}
+	return staged
+}
+
+// pushCopy stages the local copy of src and its old versions on the replicas
+// of dst, the file can not be changed meanwhile
+func (node *Node) pushCopy(args *PushCopyArgs) ([]string, error) {
+	fileInfo := node.FileList.GetFileInfo(args.Src)
+	if fileInfo == nil {
+		return nil, errors.New("file not exist: " + args.Src)
+	}
+	fileInfo.FileLock.Lock()
+	defer fileInfo.FileLock.Unlock()
+	storeArgs := StoreFileArgs{
+		MasterNodeId: args.MasterNodeId,
+		SdfsName:     args.Dst,
+		Ts:           fileInfo.Timestamp,
+		Manifest:     fileInfo.Manifest,
+		Replication:  fileInfo.Replication,
+		Stage:        args.Stage,
+	}
+	return stageFile(args.Targets, storeArgs, *fileInfo), nil
+}
+
+func (node *Node) stagePath(stage int) string {
+	return filepath.Join(node.Root_dir, STAGE_DIR, strconv.Itoa(stage))
+}
+
+// stageFromReader writes the content of a copy aside, the old versions come
+// after the current one
+func (node *Node) stageFromReader(args *StoreFileArgs, r io.Reader) error {
+	node.stagesLock.Lock()
+	staged, ok := node.stages[args.Stage]
+	node.stagesLock.Unlock()
+	if args.OldVersion && (!ok || staged.Sdfsfilename != args.SdfsName) {
+		return ErrNoStage
+	}
+	path := filepath.Join(node.stagePath(args.Stage), filepath.Base(args.SdfsName))
+	if args.OldVersion {
+		path = versionPath(path, args.Ts)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	sum, err := writeFromReader(path, r)
+	if err != nil {
+		return err
+	}
+	node.stagesLock.Lock()
+	defer node.stagesLock.Unlock()
+	if args.OldVersion {
+		staged.Versions = append([]FileVersion{{args.Ts, path, sum}}, staged.Versions...)
+		return nil
+	}
+	node.stages[args.Stage] = &FileInfo{
+		HashID:       getHashID(args.SdfsName),
+		Sdfsfilename: args.SdfsName,
+		Localpath:    path,
+		Timestamp:    args.Ts,
+		MasterNodeID: args.MasterNodeId,
+		FileLock:     &sync.Mutex{},
+		Replication:  args.Replication,
+		Manifest:     args.Manifest,
+		Checksum:     sum,
+	}
+	return nil
+}
+
+// commitStage moves a staged copy in place
+func (node *Node) commitStage(stage int) error {
+	node.stagesLock.Lock()
+	staged, ok := node.stages[stage]
+	delete(node.stages, stage)
+	node.stagesLock.Unlock()
+	if !ok {
+		return ErrNoStage
+	}
+	defer os.RemoveAll(node.stagePath(stage))
+	return node.FileList.installFile(staged, filepath.Join(node.Root_dir, staged.Sdfsfilename))
+}
+
+// dropStage removes what a copy has staged, if anything
+func (node *Node) dropStage(stage int) {
+	node.stagesLock.Lock()
+	delete(node.stages, stage)
+	node.stagesLock.Unlock()
+	os.RemoveAll(node.stagePath(stage))
+}
+
+// DropExpiredStages drops the copies staged more than ttl ago, also the ones
+// left on disk by a previous run. It returns the number of copies dropped
+func (node *Node) DropExpiredStages(ttl time.Duration) int {
+	stages := make(map[int]bool)
+	node.stagesLock.Lock()
+	for stage := range node.stages {
+		stages[stage] = true
+	}
+	node.stagesLock.Unlock()
+	files, _ := ioutil.ReadDir(filepath.Join(node.Root_dir, STAGE_DIR))
+	for _, file := range files {
+		if stage, err := strconv.Atoi(file.Name()); err == nil {
+			stages[stage] = true
+		}
+	}
+	expired := GetMillisecond() - int(ttl/time.Millisecond)
+	dropped := 0
+	for stage := range stages {
+		if HLCWall(stage) < expired {
+			SLOG.Printf("[DropExpiredStages] copy %d was never committed", stage)
+			node.dropStage(stage)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// installFile moves a file and its versions to abs_path and adds it to the
+// file list, it fails if the file exists already
+func (fl *FileList) installFile(info *FileInfo, abs_path string) error {
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	if _, exist := fl.FileMap[info.Sdfsfilename]; exist {
+		return ErrExists
+	}
+	if err := os.MkdirAll(filepath.Dir(abs_path), 0777); err != nil {
+		return err
+	}
+	for i, v := range info.Versions {
+		path := versionPath(abs_path, v.Timestamp)
+		if err := os.Rename(v.Localpath, path); err != nil {
+			return err
+		}
+		info.Versions[i].Localpath = path
+	}
+	if err := os.Rename(info.Localpath, abs_path); err != nil {
+		return err
+	}
+	info.Localpath = abs_path
+	fl.FileMap[info.Sdfsfilename] = info
+	fl.logPut(info)
+	return nil
+}
+
+/* Callee begin */
+func (fileService *FileService) CopyRequest(args *RenameArgs, result *RPCResultType) error {
+	*result = RPC_FAIL
+	if fileService.node.IsDegraded() {
+		return ErrNoQuorum
+	}
+	if err := fileService.node.Copy(args.Src, args.Dst); err != nil {
+		return err
+	}
+	*result = RPC_SUCCESS
+	return nil
+}
+
+func (fileService *FileService) PushCopy(args *PushCopyArgs, staged *[]string) error {
+	targets, err := fileService.node.pushCopy(args)
+	*staged = targets
+	return err
+}
+
+func (fileService *FileService) CommitStage(stage int, result *RPCResultType) error {
+	*result = RPC_FAIL
+	if err := fileService.node.commitStage(stage); err != nil {
+		return err
+	}
+	*result = RPC_SUCCESS
+	return nil
+}
+
+func (fileService *FileService) DropStage(stage int, result *RPCResultType) error {
+	fileService.node.dropStage(stage)
+	*result = RPC_SUCCESS
+	return nil
+}
+
+/* Callee end */
+
+/* Caller begin */
+func CallPushCopy(address string, args *PushCopyArgs) ([]string, error) {
+	client, err := DialRPC(address)
+	if err != nil {
+		return nil, dialError{err}
+	}
+	defer client.Close()
+	var staged []string
+	err = client.Call(FileServiceName+address+".PushCopy", args, &staged)
+	return staged, err
+}
+
+func CallCommitStage(address string, stage int) error {
+	client, err := DialRPC(address)
+	if err != nil {
+		return dialError{err}
+	}
+	defer client.Close()
+	var result RPCResultType
+	return client.Call(FileServiceName+address+".CommitStage", stage, &result)
+}
+
+// abortStage drops a copy on the targets, committed ones are left in place
+func abortStage(targets []string, stage int) {
+	for _, address := range targets {
+		client, err := DialRPC(address)
+		if err != nil {
+			continue
+		}
+		var result RPCResultType
+		client.Call(FileServiceName+address+".DropStage", stage, &result)
+		client.Close()
+	}
+}
+
+/* Caller end */
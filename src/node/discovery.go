@@ -0,0 +1,44 @@
+/*
+This file defines UDP multicast discovery of introducers.
+
+A node that listens on the multicast group answers introducer pings sent to
+the group the same way it answers pings sent to its own port, so a starting
+node can pass the group address to ScanIntroducer like any seed address.
+*/
+
+package node
+
+import (
+	"net"
+	. "slogger"
+)
+
+const DEFAULT_MULTICAST_GROUP = "239.255.42.99:8190"
+
+func (node *Node) MonitorMulticast(group string) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		SLOG.Printf("[Node %d] Invalid multicast group: %s", node.Id, group)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp", nil, addr)
+	if err != nil {
+		SLOG.Printf("[Node %d] Failed to join multicast group %s: %v", node.Id, group, err)
+		return
+	}
+	defer conn.Close()
+	SLOG.Printf("[Node %d] Listening on multicast group %s", node.Id, group)
+	for {
+		buf := make([]byte, UDP_BUFFER_SIZE)
+		length, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			SLOG.Println("Error in MonitorMulticast:", err)
+			continue
+		}
+		rec_packet, ok := node.decodePacket(buf[:length])
+		if !ok || rec_packet.Action != ACTION_PING || rec_packet.Seq != 0 {
+			continue // only introducer pings are expected on the group
+		}
+		go node.handlePacket(rec_packet)
+	}
+}
@@ -1,16 +1,20 @@
 package node
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	. "slogger"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 )
 
-const FILE_LIST_FILE = "/tmp/file.list"
+const FILE_LIST_FILE = ".file.list" // in the storage root
 
 type FileInfo struct {
 	HashID       int
@@ -18,25 +22,52 @@ type FileInfo struct {
 	Localpath    string
 	Timestamp    int
 	MasterNodeID int
-	FileLock     *sync.Mutex
+	FileLock     *sync.Mutex `json:"-"`
 	Tmp          bool
+	Replication  Replication   // zero means the default
+	Manifest     bool          // the content is the block manifest of a large file
+	Checksum     uint32        // crc32c of the local content
+	Versions     []FileVersion // older versions, newest first
+	Conflicts    []int         // timestamps of concurrent writes not resolved yet
 }
 
 type FileList struct {
-	ID       int
-	FileMap  map[string]*FileInfo // Key: sdfsfilename, value: fileinfo
-	ListLock *sync.Mutex
+	ID         int
+	FileMap    map[string]*FileInfo // Key: sdfsfilename, value: fileinfo
+	ListLock   *sync.Mutex
+	Retention  Retention
+	log        *os.File // nil until OpenLog
+	logPath    string
+	logRecords int
+	creating   map[string]*FileInfo // new files not stored yet, guarded by ListLock
 }
 
 func CreateFileList(selfID int) *FileList {
-	return &FileList{ID: selfID, FileMap: make(map[string]*FileInfo), ListLock: &sync.Mutex{}}
+	return &FileList{ID: selfID, FileMap: make(map[string]*FileInfo), ListLock: &sync.Mutex{}, Retention: DefaultRetention(),
+		creating: make(map[string]*FileInfo)}
 }
 
 func (fl *FileList) ServeFile(sdfsfilename string) ([]byte, error) {
+	return fl.ServeVersion(sdfsfilename, 0)
+}
+
+// ServeVersion returns a version of a file, 0 is the current one
+func (fl *FileList) ServeVersion(sdfsfilename string, version int) ([]byte, error) {
 	fileinfo := fl.GetFileInfo(sdfsfilename)
+	if fileinfo == nil {
+		return nil, errors.New("file not exist: " + sdfsfilename)
+	}
 	fileinfo.FileLock.Lock()
 	defer fileinfo.FileLock.Unlock()
-	data, err := ioutil.ReadFile(fileinfo.Localpath)
+	path, sum, err := fileinfo.localVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil && Checksum(data) != sum {
+		SLOG.Printf("[ServeFile] %s is corrupted", path)
+		return nil, ErrChecksum
+	}
 	return data, err
 }
 
@@ -46,6 +77,7 @@ func (fl *FileList) PutFileInfoObject(sdfsfilename string, fi *FileInfo) {
 		SLOG.Printf("%s already exist, updating all metainfo", sdfsfilename)
 	}
 	fl.FileMap[sdfsfilename] = fi
+	fl.logPut(fi)
 }
 
 func (fl *FileList) PutFileInfo( // TODO: looks like it's not used??
@@ -130,6 +162,21 @@ func (fl *FileList) StoreFileBase(
 	data []byte,
 	appending bool,
 	tmp bool) error {
+	return fl.StoreFileFromReader(hashId, sdfsName, root_dir, timestamp, masterNodeID, bytes.NewReader(data), appending, tmp)
+}
+
+// StoreFileFromReader copies the content from r with a bounded buffer. A new
+// content is written aside and renamed, so a broken transfer keeps the old
+// file and its timestamp, and a new file is listed only once it is stored
+func (fl *FileList) StoreFileFromReader(
+	hashId int,
+	sdfsName string,
+	root_dir string,
+	timestamp int,
+	masterNodeID int,
+	r io.Reader,
+	appending bool,
+	tmp bool) error {
 
 	if tmp {
 		root_dir = root_dir + "/tmp"
@@ -141,42 +188,158 @@ func (fl *FileList) StoreFileBase(
 		SLOG.Printf("Fail to create dir: %s", dir)
 		return err
 	}
-	if _, exist := fl.FileMap[sdfsName]; !exist {
-		fl.ListLock.Lock()
-		fl.PutFileInfoBase(hashId, sdfsName, abs_path, timestamp, masterNodeID, tmp)
-		fl.ListLock.Unlock()
-	}
-	fl.FileMap[sdfsName].FileLock.Lock()
-	defer fl.FileMap[sdfsName].FileLock.Unlock()
-	fl.PutFileInfoBase(hashId, sdfsName, abs_path, timestamp, masterNodeID, tmp)
-	if appending {
-		f, err := os.OpenFile(abs_path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
-		if err != nil {
-			SLOG.Printf("Fail to open file: %s", abs_path)
-			return err
-		}
-		_, err = f.Write(data)
-		if err != nil {
-			SLOG.Printf("Fail to append file: %s", abs_path)
-			return err
+	fl.ListLock.Lock()
+	fileInfo, exist := fl.FileMap[sdfsName]
+	if !exist {
+		// concurrent writes of a new file share its lock
+		if fileInfo, exist = fl.creating[sdfsName]; !exist {
+			fileInfo = &FileInfo{HashID: hashId, Sdfsfilename: sdfsName, FileLock: &sync.Mutex{}}
+			fl.creating[sdfsName] = fileInfo
 		}
-		f.Close()
+	}
+	fl.ListLock.Unlock()
+	fileInfo.FileLock.Lock()
+	defer fileInfo.FileLock.Unlock()
+	fl.ListLock.Lock()
+	_, exist = fl.FileMap[sdfsName]
+	fl.ListLock.Unlock()
+	old := FileVersion{fileInfo.Timestamp, "", fileInfo.Checksum}
+	if exist && !appending && !tmp && !fileInfo.Manifest && timestamp != old.Timestamp && fl.Retention.MaxVersions > 1 {
+		old.Localpath = archiveCopy(abs_path, old.Timestamp)
+	}
+	var sum uint32
+	if appending && exist {
+		sum, err = appendFromReader(abs_path, r, fileInfo.Checksum)
 	} else {
-		err = ioutil.WriteFile(abs_path, data, 0777)
-		if err != nil {
-			SLOG.Printf("Fail to write file: %s", abs_path)
-			return err
+		sum, err = writeFromReader(abs_path, r)
+	}
+	if err != nil {
+		if old.Localpath != "" {
+			os.Remove(old.Localpath)
 		}
+		SLOG.Printf("Fail to write file: %s, %v", abs_path, err)
+		return err
+	}
+	fl.ListLock.Lock()
+	if !exist {
+		fl.FileMap[sdfsName] = fileInfo
+		delete(fl.creating, sdfsName)
+	}
+	fl.PutFileInfoBase(hashId, sdfsName, abs_path, timestamp, masterNodeID, tmp)
+	fl.FileMap[sdfsName].Checksum = sum
+	removed := []string{}
+	if old.Localpath != "" {
+		removed = fl.keepVersion(fileInfo, old)
+	}
+	fl.logPut(fl.FileMap[sdfsName])
+	fl.ListLock.Unlock()
+	for _, path := range removed {
+		os.Remove(path)
 	}
 	return nil
 }
 
+// writeFromReader returns the checksum of the new content
+func writeFromReader(abs_path string, r io.Reader) (uint32, error) {
+	part := abs_path + ".part"
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return 0, err
+	}
+	crc := &crcWriter{}
+	_, err = io.CopyBuffer(io.MultiWriter(f, crc), r, make([]byte, TCPBufferSize))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(part)
+		return 0, err
+	}
+	return crc.Sum, os.Rename(part, abs_path)
+}
+
+// appendFromReader returns the checksum of the whole file, sum is the one
+// before appending. Like writeFromReader, it appends to a copy renamed once r
+// is read entirely
+func appendFromReader(abs_path string, r io.Reader, sum uint32) (uint32, error) {
+	part := abs_path + ".part"
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return 0, err
+	}
+	crc := &crcWriter{sum}
+	buf := make([]byte, TCPBufferSize)
+	err = copyLocalFile(f, abs_path, buf)
+	if err == nil {
+		_, err = io.CopyBuffer(io.MultiWriter(f, crc), r, buf)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(part)
+		return 0, err
+	}
+	return crc.Sum, os.Rename(part, abs_path)
+}
+
+// copyLocalFile writes the content of path to w, a missing file is empty
+func copyLocalFile(w io.Writer, path string, buf []byte) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyBuffer(w, f, buf)
+	return err
+}
+
+// ServeFileStream calls serve with the content and the size of a version of
+// a file (0 for the current one), the file can not be changed meanwhile. It
+// returns the checksum of the version, or ErrChecksum if the content served
+// does not match it
+func (fl *FileList) ServeFileStream(sdfsfilename string, version int, serve func(r io.Reader, size int64) error) (uint32, error) {
+	fileinfo := fl.GetFileInfo(sdfsfilename)
+	if fileinfo == nil {
+		return 0, errors.New("file not exist: " + sdfsfilename)
+	}
+	fileinfo.FileLock.Lock()
+	defer fileinfo.FileLock.Unlock()
+	path, checksum, err := fileinfo.localVersion(version)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	crc := &crcWriter{}
+	if err := serve(io.TeeReader(io.LimitReader(f, stat.Size()), crc), stat.Size()); err != nil {
+		return 0, err
+	}
+	if crc.Sum != checksum {
+		SLOG.Printf("[ServeFileStream] %s is corrupted", path)
+		return checksum, ErrChecksum
+	}
+	return checksum, nil
+}
+
 func (fl *FileList) DeleteFileInfo(sdfsfilename string) bool {
 	if fl.GetFileInfo(sdfsfilename) == nil {
 		SLOG.Printf("File not found %s", sdfsfilename)
 		return false
 	}
 	fl.ListLock.Lock()
+	if info, exist := fl.FileMap[sdfsfilename]; exist && !info.Tmp {
+		fl.logDelete(sdfsfilename)
+	}
 	delete(fl.FileMap, sdfsfilename)
 	fl.ListLock.Unlock()
 	return true
@@ -193,6 +356,9 @@ func (fl *FileList) DeleteFileAndInfo(sdfsName string) bool {
 		SLOG.Printf("Fail to delete local file: %s", info.Localpath)
 		return false
 	}
+	for _, v := range info.Versions {
+		os.Remove(v.Localpath)
+	}
 	fl.DeleteFileInfo(sdfsName)
 	return true
 }
@@ -231,12 +397,22 @@ func (fl *FileList) GetFilesInRange(startID, endID int) []string {
 }
 
 func (fl *FileList) DeleteFileInfosOutOfRange(start, end int) []string {
+	return fl.DeleteFileInfosIf(func(fi *FileInfo) bool {
+		return !IsInCircleRange(fi.HashID, start+1, end)
+	})
+}
+
+// DeleteFileInfosIf deletes the matching file infos and returns their local paths
+func (fl *FileList) DeleteFileInfosIf(needDelete func(fileInfo *FileInfo) bool) []string {
 	res := []string{}
 	toDelete := []string{}
 	fl.ListLock.Lock()
 	for _, fi := range fl.FileMap {
-		if !IsInCircleRange(fi.HashID, start+1, end) {
+		if needDelete(fi) {
 			res = append(res, fi.Localpath)
+			for _, v := range fi.Versions {
+				res = append(res, v.Localpath)
+			}
 			toDelete = append(toDelete, fi.Sdfsfilename)
 		}
 	}
@@ -251,12 +427,35 @@ func (fl *FileList) UpdateMasterID(new_master_id int, needUpdate func(fileInfo *
 	fl.ListLock.Lock()
 	defer fl.ListLock.Unlock()
 	for _, fileInfo := range fl.FileMap {
-		if !fileInfo.Tmp && needUpdate(fileInfo) {
+		if !fileInfo.Tmp && needUpdate(fileInfo) && fileInfo.MasterNodeID != new_master_id {
 			fileInfo.MasterNodeID = new_master_id
+			fl.logPut(fileInfo)
+		}
+	}
+}
+
+// UpdateMasterIDBy sets the master of every non tmp file to masterOf(file)
+func (fl *FileList) UpdateMasterIDBy(masterOf func(fileInfo *FileInfo) int) {
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	for _, fileInfo := range fl.FileMap {
+		if masterId := masterOf(fileInfo); !fileInfo.Tmp && fileInfo.MasterNodeID != masterId {
+			fileInfo.MasterNodeID = masterId
+			fl.logPut(fileInfo)
 		}
 	}
 }
 
+func (fl *FileList) GetFileInfos() []FileInfo {
+	res := make([]FileInfo, 0)
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	for _, fileInfo := range fl.FileMap {
+		res = append(res, *fileInfo)
+	}
+	return res
+}
+
 func (fl *FileList) GetOwnedFileInfos(masterId int) []FileInfo {
 	res := make([]FileInfo, 0)
 	fl.ListLock.Lock()
@@ -314,11 +513,20 @@ func (fl *FileList) DeleteSDFSDir(dirName string) {
 	_ = os.RemoveAll(abs_dir_path)
 }
 
+// MergeTmpFiles appends the tmp files to their targets in the order of their
+// names, so every replica of a target gets the same content
 func (fl *FileList) MergeTmpFiles(tmpDir, desDir string, ts int) {
-	for sdfsName, info := range fl.FileMap {
-		if !info.Tmp {
-			continue
+	tmpInfos := []FileInfo{}
+	fl.ListLock.Lock()
+	for _, info := range fl.FileMap {
+		if info.Tmp {
+			tmpInfos = append(tmpInfos, *info)
 		}
+	}
+	fl.ListLock.Unlock()
+	sort.Slice(tmpInfos, func(i, j int) bool { return tmpInfos[i].Sdfsfilename < tmpInfos[j].Sdfsfilename })
+	for _, info := range tmpInfos {
+		sdfsName := info.Sdfsfilename
 		targetName := strings.Split(sdfsName, "___")[0]
 		data, _ := fl.ServeFile(sdfsName)
 		fl.AppendFile(targetName, desDir, ts, info.MasterNodeID, data)
@@ -339,6 +547,9 @@ func (fl *FileList) MergeDirectoryWithSurfix(surffix string) {
 		}
 	}
 	fl.ListLock.Unlock()
+	sort.Slice(targetFileInfos, func(i, j int) bool {
+		return targetFileInfos[i].Sdfsfilename < targetFileInfos[j].Sdfsfilename
+	})
 	for _, fInfo := range targetFileInfos {
 		sdfsName := fInfo.Sdfsfilename
 		// Read from file, append to new dir
@@ -0,0 +1,279 @@
+/*
+This file defines the persistence of the file list.
+
+Once OpenLog is called, every change of a FileInfo is appended to a log of
+json records in the storage root, a put record holds the whole FileInfo and a
+delete record its name, tmp files of MapleJuice are not recorded. On startup
+RestoreFileList replays the log, drops the files whose local copy is gone and
+the local files nobody refers to out of RESERVED_DIRS, then compacts the log
+into one record per file and loads the pending hints. After the node joins again,
+ResyncRestoredFiles only fetches the files changed while it was down and
+drops the ones deleted meanwhile.
+*/
+
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "slogger"
+	"sync"
+)
+
+const MIN_COMPACT_RECORDS = 1024
+
+// the dirs of the storage root kept by RestoreFileList
+var RESERVED_DIRS = []string{STAGE_DIR, HINT_DIR}
+
+type logRecord struct {
+	Delete bool
+	Info   FileInfo
+}
+
+// OpenLog replays the log at path into the file list, then compacts it and
+// keeps it open to record the changes
+func (fl *FileList) OpenLog(path string) error {
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	f, err := os.Open(path)
+	if err == nil {
+		fl.replayLog(f)
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for name, info := range fl.FileMap {
+		if _, err := os.Stat(info.Localpath); err != nil {
+			SLOG.Printf("[OpenLog] %s lost its local copy %s", name, info.Localpath)
+			delete(fl.FileMap, name)
+			continue
+		}
+		versions := []FileVersion{}
+		for _, v := range info.Versions {
+			if _, err := os.Stat(v.Localpath); err == nil {
+				versions = append(versions, v)
+			}
+		}
+		info.Versions = versions
+	}
+	fl.logPath = path
+	return fl.compactLog()
+}
+
+// replayLog applies the records of r, a torn record at the end is ignored
+func (fl *FileList) replayLog(r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var record logRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			SLOG.Printf("[OpenLog] bad record: %v", err)
+			return
+		}
+		if record.Delete {
+			delete(fl.FileMap, record.Info.Sdfsfilename)
+			continue
+		}
+		info := record.Info
+		info.FileLock = &sync.Mutex{}
+		fl.FileMap[info.Sdfsfilename] = &info
+	}
+}
+
+// compactLog rewrites the log with one record per file, the caller holds
+// ListLock
+func (fl *FileList) compactLog() error {
+	if fl.log != nil {
+		fl.log.Close()
+		fl.log = nil
+	}
+	tmp := fl.logPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	for _, info := range fl.FileMap {
+		if !info.Tmp {
+			writeRecord(writer, logRecord{Info: *info})
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, fl.logPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fl.log, err = os.OpenFile(fl.logPath, os.O_WRONLY|os.O_APPEND, 0666)
+	fl.logRecords = len(fl.FileMap)
+	return err
+}
+
+func writeRecord(w io.Writer, record logRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// logPut records the current state of a file, the caller holds ListLock. Tmp
+// files only live during a MapleJuice job, so they are not recorded
+func (fl *FileList) logPut(info *FileInfo) {
+	if info.Tmp {
+		return
+	}
+	fl.appendRecord(logRecord{Info: *info})
+}
+
+// logDelete records the removal of a file, the caller holds ListLock
+func (fl *FileList) logDelete(sdfsName string) {
+	fl.appendRecord(logRecord{Delete: true, Info: FileInfo{Sdfsfilename: sdfsName}})
+}
+
+func (fl *FileList) appendRecord(record logRecord) {
+	if fl.log == nil {
+		return
+	}
+	if err := writeRecord(fl.log, record); err != nil {
+		SLOG.Println("[FileList] fail to write log:", err)
+		return
+	}
+	fl.logRecords++
+	if fl.logRecords > MIN_COMPACT_RECORDS && fl.logRecords > 2*len(fl.FileMap) {
+		if err := fl.compactLog(); err != nil {
+			SLOG.Println("[FileList] fail to compact log:", err)
+		}
+	}
+}
+
+// RestoreFileList loads the file list and the hints of a previous run from
+// the storage root and removes the local files it does not know, out of the
+// reserved dirs. It returns the number of files restored
+func (node *Node) RestoreFileList() (int, error) {
+	if err := os.MkdirAll(node.Root_dir, 0777); err != nil {
+		return 0, err
+	}
+	logPath := filepath.Join(node.Root_dir, FILE_LIST_FILE)
+	if err := node.FileList.OpenLog(logPath); err != nil {
+		return 0, err
+	}
+	known := map[string]bool{logPath: true}
+	for _, info := range node.FileList.GetFileInfos() {
+		known[info.Localpath] = true
+		for _, v := range info.Versions {
+			known[v.Localpath] = true
+		}
+	}
+	filepath.Walk(node.Root_dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && isReservedDir(node.Root_dir, path) {
+			return filepath.SkipDir
+		}
+		if err == nil && !fi.IsDir() && !known[path] {
+			os.Remove(path)
+		}
+		return nil
+	})
+	node.loadHints()
+	restored := len(node.FileList.FileMap)
+	node.resyncPending = restored > 0
+	SLOG.Printf("[RestoreFileList] restored %d files from %s", restored, logPath)
+	return restored, nil
+}
+
+// isReservedDir tells if path is a dir of the storage root that holds no sdfs
+// files
+func isReservedDir(root, path string) bool {
+	for _, dir := range RESERVED_DIRS {
+		if path == filepath.Join(root, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResyncRestoredFiles brings the restored files up to date once the node is
+// back in the cluster
+func (node *Node) ResyncRestoredFiles() {
+	node.updateMasters()
+	node.DeleteRedundantFile()
+	for _, info := range node.FileList.GetFileInfos() {
+		if !info.Tmp {
+			node.resyncFile(info)
+		}
+	}
+}
+
+// resyncFile fetches a newer version of a file from the other replicas, or
+// deletes it if enough of them answer and none has it
+func (node *Node) resyncFile(info FileInfo) {
+	replication := info.Replication.Normalize()
+	self := node.IP + ":" + node.RPC_Port
+	answered, holders := 0, 0
+	latest := FileMeta{Timestamp: info.Timestamp}
+	latestAddress := ""
+	for _, address := range node.GetResponsibleAddressesWithReplicas(info.Sdfsfilename, replication.Replicas) {
+		if address == self {
+			continue
+		}
+		meta, err := CallGetFileMeta(address, info.Sdfsfilename)
+		if _, unreachable := err.(dialError); unreachable {
+			continue
+		}
+		answered++
+		if err != nil {
+			continue
+		}
+		holders++
+		if meta.Timestamp > latest.Timestamp {
+			latest, latestAddress = meta, address
+		}
+	}
+	if holders == 0 && answered > 0 && answered >= replication.ReadQuorum {
+		SLOG.Printf("[Resync] %s was deleted while the node was down", info.Sdfsfilename)
+		node.FileList.DeleteFileAndInfo(info.Sdfsfilename)
+		return
+	}
+	if latestAddress == "" {
+		return
+	}
+	tmpFile, err := ioutil.TempFile("", "resync")
+	if err != nil {
+		SLOG.Println("[Resync]", err)
+		return
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	if err := GetFileToLocal(latestAddress, info.Sdfsfilename, tmpFile.Name()); err != nil {
+		SLOG.Printf("[Resync] fail to fetch %s: %v", info.Sdfsfilename, err)
+		return
+	}
+	f, err := os.Open(tmpFile.Name())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	args := &StoreFileArgs{
+		MasterNodeId: node.masterIdForHash(info.HashID),
+		SdfsName:     info.Sdfsfilename,
+		Ts:           latest.Timestamp,
+		Manifest:     latest.Manifest,
+		Replication:  latest.Replication,
+	}
+	if err := node.StoreFileFromReader(args, f); err == nil {
+		SLOG.Printf("[Resync] %s updated to %d", info.Sdfsfilename, latest.Timestamp)
+	}
+}
@@ -0,0 +1,492 @@
+/*
+This file defines the gossip layer for membership dissemination.
+
+Membership deltas (new node, deleted node, suspect, alive) are queued with a
+bounded retransmission count and piggybacked on outgoing heartbeats, pings
+and acks. A delta is also pushed to GOSSIP_FANOUT random members when it is
+first learned, so it spreads infection style instead of relying on a single
+UDP broadcast. Periodic anti-entropy exchanges membership digests with a
+random member, so views that diverged through lost packets converge. A
+degraded node tries to heal the partition instead (see quorum.go).
+*/
+
+package node
+
+import (
+	"math"
+	. "slogger"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	GOSSIP_FANOUT          = 3
+	GOSSIP_RETRANSMIT_MULT = 3
+	MAX_PIGGYBACK          = 8
+	MAX_SYNC_UPDATES       = 16
+	ANTI_ENTROPY_INTERVAL  = 10 * time.Second
+	TOMBSTONE_TTL          = 60 * time.Second
+)
+
+type MemberUpdate struct {
+	Action      ActionType // ACTION_NEW_NODE, ACTION_DELETE_NODE, ACTION_SUSPECT or ACTION_ALIVE
+	Id          int
+	IP          string
+	Port        string
+	RPC_Port    string
+	Hostname    string
+	Incarnation int
+	Left        bool // only set on ACTION_DELETE_NODE
+	Labels      map[string]string
+}
+
+type DigestEntry struct {
+	Id          int
+	Incarnation int
+	Dead        bool
+}
+
+type gossipItem struct {
+	update    MemberUpdate
+	remaining int
+}
+
+type tombstone struct {
+	incarnation int
+	deleted_t   time.Time
+}
+
+type lostMember struct {
+	update MemberUpdate
+	lost_t time.Time
+}
+
+type Gossiper struct {
+	lock       *sync.Mutex
+	queue      map[int]*gossipItem // Key: node id, only the latest update of a node is kept
+	tombstones map[int]tombstone   // recently deleted nodes
+	lost       map[int]lostMember  // failed nodes, contacted to heal a partition
+}
+
+func CreateGossiper() *Gossiper {
+	return &Gossiper{lock: &sync.Mutex{}, queue: make(map[int]*gossipItem), tombstones: make(map[int]tombstone),
+		lost: make(map[int]lostMember)}
+}
+
+func (g *Gossiper) Enqueue(update MemberUpdate, clusterSize int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	limit := GOSSIP_RETRANSMIT_MULT * int(math.Ceil(math.Log2(float64(clusterSize+1))))
+	if limit < 1 {
+		limit = 1
+	}
+	g.queue[update.Id] = &gossipItem{update: update, remaining: limit}
+}
+
+// TakePiggyback returns at most MAX_PIGGYBACK updates, preferring the ones
+// that have been sent the fewest times
+func (g *Gossiper) TakePiggyback() []MemberUpdate {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if len(g.queue) == 0 {
+		return nil
+	}
+	items := make([]*gossipItem, 0, len(g.queue))
+	for _, item := range g.queue {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].remaining > items[j].remaining
+	})
+	res := []MemberUpdate{}
+	for i := 0; i < len(items) && i < MAX_PIGGYBACK; i++ {
+		res = append(res, items[i].update)
+		items[i].remaining--
+		if items[i].remaining <= 0 {
+			delete(g.queue, items[i].update.Id)
+		}
+	}
+	return res
+}
+
+func (g *Gossiper) Pending() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.queue)
+}
+
+// Clear drops the queued updates
+func (g *Gossiper) Clear() {
+	g.lock.Lock()
+	g.queue = make(map[int]*gossipItem)
+	g.lock.Unlock()
+}
+
+// Reset forgets everything, a joining node adopts the state of its introducer
+func (g *Gossiper) Reset() {
+	g.lock.Lock()
+	g.queue = make(map[int]*gossipItem)
+	g.tombstones = make(map[int]tombstone)
+	g.lost = make(map[int]lostMember)
+	g.lock.Unlock()
+}
+
+func (g *Gossiper) AddTombstone(id, incarnation int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if t, ok := g.tombstones[id]; ok && t.incarnation > incarnation {
+		return
+	}
+	g.tombstones[id] = tombstone{incarnation: incarnation, deleted_t: time.Now()}
+}
+
+func (g *Gossiper) RemoveTombstone(id int) {
+	g.lock.Lock()
+	delete(g.tombstones, id)
+	g.lock.Unlock()
+}
+
+// GetTombstone returns the incarnation a node was deleted with, or -1
+func (g *Gossiper) GetTombstone(id int) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	t, ok := g.tombstones[id]
+	if !ok {
+		return -1
+	}
+	if time.Since(t.deleted_t) > TOMBSTONE_TTL {
+		delete(g.tombstones, id)
+		return -1
+	}
+	return t.incarnation
+}
+
+func (g *Gossiper) GetTombstones() map[int]int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	res := make(map[int]int)
+	for id, t := range g.tombstones {
+		if time.Since(t.deleted_t) > TOMBSTONE_TTL {
+			delete(g.tombstones, id)
+			continue
+		}
+		res[id] = t.incarnation
+	}
+	return res
+}
+
+func (g *Gossiper) AddLost(update MemberUpdate) {
+	g.lock.Lock()
+	g.lost[update.Id] = lostMember{update: update, lost_t: time.Now()}
+	g.lock.Unlock()
+}
+
+func (g *Gossiper) RemoveLost(id int) {
+	g.lock.Lock()
+	delete(g.lost, id)
+	g.lock.Unlock()
+}
+
+// GetLost returns the nodes lost within LOST_MEMBER_TTL
+func (g *Gossiper) GetLost() []MemberUpdate {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	res := []MemberUpdate{}
+	for id, m := range g.lost {
+		if time.Since(m.lost_t) > LOST_MEMBER_TTL {
+			delete(g.lost, id)
+			continue
+		}
+		res = append(res, m.update)
+	}
+	return res
+}
+
+func updateFromPacket(packet *Packet) MemberUpdate {
+	return MemberUpdate{
+		Action:      packet.Action,
+		Id:          packet.Id,
+		IP:          packet.IP,
+		Port:        packet.Port,
+		RPC_Port:    packet.RPC_Port,
+		Hostname:    packet.Hostname,
+		Incarnation: packet.Incarnation,
+		Left:        packet.Left,
+		Labels:      packet.Labels,
+	}
+}
+
+func packetFromUpdate(update MemberUpdate) Packet {
+	return Packet{
+		Action:      update.Action,
+		Id:          update.Id,
+		IP:          update.IP,
+		Port:        update.Port,
+		RPC_Port:    update.RPC_Port,
+		Hostname:    update.Hostname,
+		Incarnation: update.Incarnation,
+		Left:        update.Left,
+		Labels:      update.Labels,
+	}
+}
+
+func updateFromMember(action ActionType, member *MemberNode) MemberUpdate {
+	return MemberUpdate{
+		Action:      action,
+		Id:          member.Id,
+		IP:          member.Ip,
+		Port:        member.Port,
+		RPC_Port:    member.RPC_Port,
+		Hostname:    member.Hostname,
+		Incarnation: member.Incarnation,
+		Labels:      member.Labels,
+	}
+}
+
+// Gossip queues a membership delta and pushes it to the ring successor and a
+// few random members. Since every node forwards news to its successor the
+// first time it learns them, a delta reaches the whole ring even when the
+// random targets overlap.
+func (node *Node) Gossip(update MemberUpdate) {
+	if node.IsDegraded() {
+		return // the view of the minority side must not spread after heal
+	}
+	node.gossiper.Enqueue(update, node.MbList.GetSize())
+	gossipPacket := &Packet{
+		Action: ACTION_GOSSIP,
+		Id:     node.Id,
+		IP:     node.IP,
+		Port:   node.Port,
+	}
+	for _, address := range node.getGossipTargets(update.Id) {
+		node.sendPacket(address, gossipPacket)
+	}
+}
+
+func (node *Node) getGossipTargets(subjectId int) []string {
+	res := []string{}
+	successorId := -1
+	successors, _ := node.MbList.nextKNodes(node.Id, 2) // self is gone after leaving
+	for _, next := range successors {
+		if next.Id != subjectId {
+			successorId = next.Id
+			res = append(res, next.Ip+":"+next.Port)
+			break
+		}
+	}
+	for _, member := range node.getRandomMembers(GOSSIP_FANOUT, successorId) {
+		if len(res) == GOSSIP_FANOUT {
+			break
+		}
+		res = append(res, member.Ip+":"+member.Port)
+	}
+	return res
+}
+
+func (node *Node) applyUpdates(updates []MemberUpdate) {
+	if node.MbList == nil || node.MbList.GetNode(node.Id) == nil {
+		return // not joined yet
+	}
+	for _, update := range updates {
+		if node.applyUpdate(update) {
+			node.Gossip(update)
+		}
+	}
+}
+
+// applyUpdate returns true if the update brings new information
+func (node *Node) applyUpdate(update MemberUpdate) bool {
+	member := node.MbList.GetNode(update.Id)
+	switch update.Action {
+	case ACTION_NEW_NODE, ACTION_ALIVE:
+		if update.Id == node.Id {
+			return false
+		}
+		if member != nil {
+			if update.Action == ACTION_NEW_NODE && update.Incarnation > member.Incarnation {
+				SLOG.Printf("[Node %d] Learned node %d rejoined by gossip", node.Id, update.Id)
+				node.rejoinNode(packetFromUpdate(update), update.Incarnation)
+				return true
+			}
+			return node.aliveNode(update.Id, update.Incarnation)
+		}
+		if update.Action == ACTION_ALIVE && update.IP == "" {
+			return false
+		}
+		if node.IsDegraded() {
+			return false // only the other side can tell, rejoin through it to heal
+		}
+		if node.gossiper.GetTombstone(update.Id) >= update.Incarnation {
+			return false
+		}
+		SLOG.Printf("[Node %d] Learned new node (%d, %s:%s) by gossip", node.Id, update.Id, update.IP, update.Port)
+		node.gossiper.RemoveTombstone(update.Id)
+		node.JoinNode(packetFromUpdate(update))
+		node.MbList.MarkAlive(update.Id, update.Incarnation)
+		return true
+	case ACTION_DELETE_NODE:
+		if update.Id == node.Id && node.IsDegraded() {
+			return false // expected from the majority, rejoin on heal
+		}
+		if update.Id == node.Id {
+			SLOG.Println("Going to delete self")
+			node.active = false
+			return false
+		}
+		if member == nil {
+			node.gossiper.AddTombstone(update.Id, update.Incarnation)
+			return false
+		}
+		if update.Incarnation < member.Incarnation {
+			return false // the node has refuted since
+		}
+		lose_heartbeat := node.isPrevKNodes(update.Id)
+		if update.Left {
+			node.leftNode(update.Id, lose_heartbeat)
+		} else {
+			node.LostNode(update.Id, lose_heartbeat)
+		}
+		return true
+	case ACTION_SUSPECT:
+		if update.Id == node.Id {
+			node.refuteSuspicion(update.Incarnation)
+			return false
+		}
+		return node.suspectNode(update.Id, update.Incarnation)
+	}
+	return false
+}
+
+func (node *Node) AntiEntropyRoutine() {
+	for {
+		time.Sleep(node.Timing.AntiEntropyInterval)
+		if !node.active {
+			break
+		}
+		node.AntiEntropyRound()
+	}
+}
+
+// AntiEntropyRound syncs the view with one random member, or looks for the
+// other side of a partition if the node is degraded
+func (node *Node) AntiEntropyRound() {
+	if node.MbList == nil {
+		return
+	}
+	if node.IsDegraded() {
+		node.tryHeal()
+		return
+	}
+	for _, member := range node.getRandomMembers(1, -1) {
+		node.SyncMembership(member.Ip + ":" + member.Port)
+	}
+}
+
+// SyncMembership starts one anti-entropy exchange with the given address
+func (node *Node) SyncMembership(address string) {
+	syncPacket := &Packet{
+		Action: ACTION_SYNC,
+		Id:     node.Id,
+		IP:     node.IP,
+		Port:   node.Port,
+		Digest: node.membershipDigest(),
+	}
+	node.sendPacket(address, syncPacket)
+}
+
+func (node *Node) membershipDigest() []DigestEntry {
+	return digestFromUpdates(node.membershipState())
+}
+
+// membershipState returns every known member and tombstone as an update
+func (node *Node) membershipState() []MemberUpdate {
+	state := []MemberUpdate{}
+	node.MbList.lock.Lock()
+	for _, member := range node.MbList.Member_map {
+		state = append(state, updateFromMember(ACTION_NEW_NODE, member))
+	}
+	node.MbList.lock.Unlock()
+	for id, incarnation := range node.gossiper.GetTombstones() {
+		state = append(state, MemberUpdate{Action: ACTION_DELETE_NODE, Id: id, Incarnation: incarnation})
+	}
+	return state
+}
+
+func digestFromUpdates(updates []MemberUpdate) []DigestEntry {
+	digest := []DigestEntry{}
+	for _, update := range updates {
+		digest = append(digest, DigestEntry{
+			Id:          update.Id,
+			Incarnation: update.Incarnation,
+			Dead:        update.Action == ACTION_DELETE_NODE,
+		})
+	}
+	return digest
+}
+
+// updatesMissingFrom returns the updates the owner of digest doesn't know yet
+func (node *Node) updatesMissingFrom(digest []DigestEntry) []MemberUpdate {
+	remote := make(map[int]DigestEntry)
+	for _, entry := range digest {
+		remote[entry.Id] = entry
+	}
+	res := []MemberUpdate{}
+	node.MbList.lock.Lock()
+	for id, member := range node.MbList.Member_map {
+		entry, ok := remote[id]
+		if !ok {
+			res = append(res, updateFromMember(ACTION_NEW_NODE, member))
+		} else if entry.Incarnation < member.Incarnation {
+			res = append(res, updateFromMember(ACTION_ALIVE, member))
+		}
+	}
+	node.MbList.lock.Unlock()
+	for id, incarnation := range node.gossiper.GetTombstones() {
+		entry, ok := remote[id]
+		if ok && !entry.Dead && entry.Incarnation <= incarnation {
+			res = append(res, MemberUpdate{Action: ACTION_DELETE_NODE, Id: id, Incarnation: incarnation})
+		}
+	}
+	return res
+}
+
+func (node *Node) handleSync(packet Packet) {
+	if node.MbList == nil || node.IsDegraded() {
+		return
+	}
+	address := packet.IP + ":" + packet.Port
+	updates := node.updatesMissingFrom(packet.Digest)
+	if packet.Action == ACTION_SYNC {
+		replyPacket := &Packet{
+			Action:  ACTION_SYNC_REPLY,
+			Id:      node.Id,
+			IP:      node.IP,
+			Port:    node.Port,
+			Digest:  node.membershipDigest(),
+			Updates: []MemberUpdate{},
+		}
+		if len(updates) > MAX_SYNC_UPDATES {
+			replyPacket.Updates = updates[:MAX_SYNC_UPDATES]
+			updates = updates[MAX_SYNC_UPDATES:]
+		} else {
+			replyPacket.Updates = updates
+			updates = nil
+		}
+		node.sendPacket(address, replyPacket)
+	}
+	for i := 0; i < len(updates); i += MAX_SYNC_UPDATES {
+		end := i + MAX_SYNC_UPDATES
+		if end > len(updates) {
+			end = len(updates)
+		}
+		gossipPacket := &Packet{
+			Action:  ACTION_GOSSIP,
+			Id:      node.Id,
+			IP:      node.IP,
+			Port:    node.Port,
+			Updates: updates[i:end],
+		}
+		node.sendPacket(address, gossipPacket)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+This file defines the hinted handoff.
+
+A write only counts the replicas that stored it toward the write quorum. When
+a replica can not be reached, the node sending the write keeps it as a hint:
+the content and the arguments of the store, written under HINT_DIR in its
+storage root so they survive a restart. Every HintInterval the node replays
+its hints to the replicas that are reachable again, the hints of a replica in
+the order they were taken so appends land at their offsets. A hint is
+dropped once stored, when the replica refuses it, like a version older than
+its copy, when the replica is no longer responsible for the file, or after
+HINT_TTL. Duplication and the scrubber repair what a dropped hint would have.
+MapleJuice tmp files are never hinted. Deleting a file drops its hints on
+every member first, a late replay would bring the file back.
+*/
+
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "slogger"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HINT_DIR = ".hints" // in the storage root
+const HINT_INTERVAL = 10 * time.Second
+const HINT_TTL = 3 * time.Hour
+
+type Hint struct {
+	Seq     int
+	Target  string // rpc address of the replica
+	ToHash  string // name the replica is responsible for
+	Args    StoreFileArgs
+	Created int // ms
+}
+
+type hintStore struct {
+	lock  *sync.Mutex
+	hints []*Hint // oldest first
+	seq   int
+}
+
+func createHintStore() *hintStore {
+	return &hintStore{lock: &sync.Mutex{}}
+}
+
+func (node *Node) hintPath(seq int) string {
+	return filepath.Join(node.Root_dir, HINT_DIR, strconv.Itoa(seq))
+}
+
+// storeOrHint stores a section on a replica, and keeps it as a hint if the
+// replica can not be reached. MapleJuice tmp files are not kept, a late one
+// would be merged by the next job
+func (node *Node) storeOrHint(address, toHash string, args *StoreFileArgs, section fileSection) error {
+	err := storeSection(address, args, section)
+	if _, unreachable := err.(dialError); unreachable && !args.Tmp {
+		if hintErr := node.addHint(address, toHash, args, section); hintErr != nil {
+			SLOG.Printf("[storeOrHint] fail to keep a hint of %s for %s: %v", args.SdfsName, address, hintErr)
+		}
+	}
+	return err
+}
+
+func (node *Node) addHint(address, toHash string, args *StoreFileArgs, section fileSection) error {
+	f, content, _, err := section.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.MkdirAll(filepath.Join(node.Root_dir, HINT_DIR), 0777); err != nil {
+		return err
+	}
+	hs := node.hints
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hint := &Hint{Seq: hs.seq + 1, Target: address, ToHash: toHash, Args: *args, Created: GetMillisecond()}
+	hint.Args.Content = nil
+	hint.Args.PrevTs = 0 // a late replay is not a concurrent write, only a stale one
+	path := node.hintPath(hint.Seq)
+	if _, err := writeFromReader(path, content); err != nil {
+		return err
+	}
+	data, err := json.Marshal(hint)
+	if err == nil {
+		err = ioutil.WriteFile(path+".json", data, 0666)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	hs.seq = hint.Seq
+	hs.hints = append(hs.hints, hint)
+	SLOG.Printf("[addHint] %s for %s kept as hint %d", args.SdfsName, address, hint.Seq)
+	return nil
+}
+
+// loadHints reads the hints kept before a restart, they replace the hints in
+// memory so loading twice keeps each once
+func (node *Node) loadHints() {
+	files, err := ioutil.ReadDir(filepath.Join(node.Root_dir, HINT_DIR))
+	if err != nil {
+		return
+	}
+	hs := node.hints
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.hints = nil
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(node.Root_dir, HINT_DIR, file.Name()))
+		hint := &Hint{}
+		if err == nil {
+			err = json.Unmarshal(data, hint)
+		}
+		if err != nil {
+			SLOG.Printf("[loadHints] %s: %v", file.Name(), err)
+			continue
+		}
+		hs.hints = append(hs.hints, hint)
+		if hint.Seq > hs.seq {
+			hs.seq = hint.Seq
+		}
+	}
+	sort.Slice(hs.hints, func(i, j int) bool { return hs.hints[i].Seq < hs.hints[j].Seq })
+}
+
+// PendingHints returns the number of hints not replayed yet
+func (node *Node) PendingHints() int {
+	node.hints.lock.Lock()
+	defer node.hints.lock.Unlock()
+	return len(node.hints.hints)
+}
+
+// ReplayHints sends the hints to their replicas, it returns the number of
+// hints stored
+func (node *Node) ReplayHints() int {
+	hs := node.hints
+	hs.lock.Lock()
+	hints := append([]*Hint{}, hs.hints...)
+	hs.lock.Unlock()
+	unreachable := make(map[string]bool)
+	done := make(map[int]bool)
+	replayed := 0
+	for _, hint := range hints {
+		if unreachable[hint.Target] {
+			continue
+		}
+		if GetMillisecond()-hint.Created > int(HINT_TTL/time.Millisecond) {
+			SLOG.Printf("[ReplayHints] hint %d of %s for %s expired", hint.Seq, hint.Args.SdfsName, hint.Target)
+			done[hint.Seq] = true
+			continue
+		}
+		if !node.isResponsibleAddress(hint.Target, hint.ToHash, hint.Args.Replication.Normalize().Replicas) {
+			done[hint.Seq] = true
+			continue
+		}
+		args := hint.Args
+		err := storeSection(hint.Target, &args, fileSection{node.hintPath(hint.Seq), 0, -1})
+		if _, ok := err.(dialError); ok {
+			unreachable[hint.Target] = true
+			continue
+		}
+		if err != nil && err != ErrConflict {
+			SLOG.Printf("[ReplayHints] %s refused hint %d of %s: %v", hint.Target, hint.Seq, hint.Args.SdfsName, err)
+		} else {
+			replayed++
+		}
+		done[hint.Seq] = true
+	}
+	hs.lock.Lock()
+	pending := []*Hint{}
+	for _, hint := range hs.hints {
+		if done[hint.Seq] {
+			os.Remove(node.hintPath(hint.Seq))
+			os.Remove(node.hintPath(hint.Seq) + ".json")
+		} else {
+			pending = append(pending, hint)
+		}
+	}
+	hs.hints = pending
+	hs.lock.Unlock()
+	if replayed > 0 {
+		SLOG.Printf("[ReplayHints] %d hints replayed, %d pending", replayed, len(pending))
+	}
+	return replayed
+}
+
+func (node *Node) isResponsibleAddress(address, toHash string, replicas int) bool {
+	for _, responsible := range node.GetResponsibleAddressesWithReplicas(toHash, replicas) {
+		if responsible == address {
+			return true
+		}
+	}
+	return false
+}
+
+// dropHints removes the hints of a file, it returns the number dropped
+func (node *Node) dropHints(sdfsName string) int {
+	hs := node.hints
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	pending := []*Hint{}
+	for _, hint := range hs.hints {
+		if hint.Args.SdfsName == sdfsName {
+			os.Remove(node.hintPath(hint.Seq))
+			os.Remove(node.hintPath(hint.Seq) + ".json")
+		} else {
+			pending = append(pending, hint)
+		}
+	}
+	dropped := len(hs.hints) - len(pending)
+	hs.hints = pending
+	if dropped > 0 {
+		SLOG.Printf("[dropHints] %d hints of %s dropped", dropped, sdfsName)
+	}
+	return dropped
+}
+
+// cancelHints drops the hints of a file on every member
+func (node *Node) cancelHints(sdfsName string) {
+	addresses := node.MbList.GetAllRPCAddresses()
+	c := make(chan error, len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			_, err := CallDropHints(address, sdfsName)
+			if err != nil {
+				SLOG.Printf("[cancelHints] %s on %s: %v", sdfsName, address, err)
+			}
+			c <- err
+		}(address)
+	}
+	timeout := time.After(5 * time.Second)
+	for range addresses {
+		select {
+		case <-c:
+		case <-timeout:
+			SLOG.Printf("[cancelHints] waiting too long when dropping the hints of %s", sdfsName)
+			return
+		}
+	}
+}
+
+// HintRoutine replays the hints every HintInterval
+func (node *Node) HintRoutine() {
+	for {
+		time.Sleep(node.Timing.HintInterval)
+		if !node.active {
+			break
+		}
+		if node.MbList == nil || node.IsDegraded() {
+			continue
+		}
+		node.ReplayHints()
+	}
+}
+
+/* Callee begin */
+func (fileService *FileService) DropHints(sdfsName string, dropped *int) error {
+	*dropped = fileService.node.dropHints(sdfsName)
+	return nil
+}
+
+/* Callee end */
+
+/* Caller begin */
+func CallDropHints(address, sdfsName string) (int, error) {
+	client, err := DialRPC(address)
+	if err != nil {
+		return 0, dialError{err}
+	}
+	defer client.Close()
+	var dropped int
+	err = client.Call(FileServiceName+address+".DropHints", sdfsName, &dropped)
+	return dropped, err
+}
+
+/* Caller end */
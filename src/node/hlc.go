@@ -0,0 +1,141 @@
+/*
+This file defines the hybrid logical clock used to order sdfs writes.
+
+A timestamp is the wall clock in milliseconds followed by a logical counter
+and the id of the node that made it, so it still fits the Ts of a put and two
+nodes never make the same one. A node never makes a timestamp smaller than one
+it has seen: the coordinator of a put reads the latest version of the file
+before writing, and a replica merges the timestamp of every put it stores.
+A put that follows another one therefore wins even if the clock of its
+coordinator is behind.
+
+A put also carries the version it was based on. A replica that already holds
+a newer version than that one got a concurrent write, it keeps both writes,
+the one with the larger timestamp as the current version and the other as an
+old version, records the conflict on the file and reports it to the
+coordinator. A later put based on the current version clears the conflicts.
+*/
+
+package node
+
+import (
+	"errors"
+	"io"
+	. "slogger"
+	"sync"
+)
+
+const HLC_NODE_BITS = 10 // node ids are below MAX_CAPACITY
+const HLC_LOGICAL_BITS = 10
+const HLC_SHIFT = HLC_NODE_BITS + HLC_LOGICAL_BITS
+
+var ErrConflict = errors.New("concurrent write")
+
+type HLC struct {
+	lock *sync.Mutex
+	last int // latest timestamp made or seen, without the node id
+}
+
+func CreateHLC() *HLC {
+	return &HLC{lock: &sync.Mutex{}}
+}
+
+// HLCWall returns the wall clock part of a timestamp in milliseconds
+func HLCWall(ts int) int {
+	return ts >> HLC_SHIFT
+}
+
+// Now makes a timestamp larger than any made or seen by the clock
+func (clock *HLC) Now(nodeId int) int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	wall := GetMillisecond() << HLC_SHIFT
+	if wall > clock.last {
+		clock.last = wall
+	} else {
+		clock.last += 1 << HLC_NODE_BITS
+	}
+	return clock.last | nodeId&(1<<HLC_NODE_BITS-1)
+}
+
+// Update merges a timestamp seen in a message
+func (clock *HLC) Update(ts int) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	if ts &^= 1<<HLC_NODE_BITS - 1; ts > clock.last {
+		clock.last = ts
+	}
+}
+
+// isCheckedWrite tells if a put replaces a file on behalf of a client, other
+// puts copy a version that is already ordered
+func isCheckedWrite(args *StoreFileArgs) bool {
+	return args.PrevTs != 0 && !args.Tmp && !args.Appending && !args.OldVersion
+}
+
+// concurrentWrite returns the timestamp of the stored version a put raced
+// with, 0 if the put follows it
+func (node *Node) concurrentWrite(args *StoreFileArgs) int {
+	if !isCheckedWrite(args) {
+		return 0
+	}
+	fileInfo := node.FileList.GetFileInfo(args.SdfsName)
+	if fileInfo == nil || fileInfo.Timestamp <= args.PrevTs || fileInfo.Timestamp == args.Ts {
+		return 0
+	}
+	return fileInfo.Timestamp
+}
+
+// storeLosingWrite keeps a put that raced with a newer stored version as an
+// old version of the file
+func (node *Node) storeLosingWrite(args *StoreFileArgs, r io.Reader) error {
+	if err := node.FileList.StoreVersionFromReader(args.SdfsName, args.Ts, r); err != nil {
+		return err
+	}
+	node.FileList.RecordConflict(args.SdfsName, args.Ts)
+	SLOG.Printf("[Conflict] %s: write %d kept as an old version of %d", args.SdfsName, args.Ts, node.FileList.GetTimeStamp(args.SdfsName))
+	return ErrConflict
+}
+
+// settleWrite records the conflict of a stored put, or clears the conflicts
+// of the file if the put followed its current version
+func (node *Node) settleWrite(args *StoreFileArgs, other int) error {
+	if !isCheckedWrite(args) {
+		return nil
+	}
+	if other == 0 {
+		node.FileList.ClearConflicts(args.SdfsName)
+		return nil
+	}
+	node.FileList.RecordConflict(args.SdfsName, other)
+	SLOG.Printf("[Conflict] %s: write %d replaced the concurrent write %d", args.SdfsName, args.Ts, other)
+	return ErrConflict
+}
+
+// RecordConflict adds the timestamp of a concurrent write to a file
+func (fl *FileList) RecordConflict(sdfsName string, ts int) {
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	fileInfo, ok := fl.FileMap[sdfsName]
+	if !ok {
+		return
+	}
+	for _, conflict := range fileInfo.Conflicts {
+		if conflict == ts {
+			return
+		}
+	}
+	fileInfo.Conflicts = append(fileInfo.Conflicts, ts)
+	fl.logPut(fileInfo)
+}
+
+// ClearConflicts drops the conflicts of a file once a put based on its
+// current version is stored
+func (fl *FileList) ClearConflicts(sdfsName string) {
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	if fileInfo, ok := fl.FileMap[sdfsName]; ok && len(fileInfo.Conflicts) > 0 {
+		fileInfo.Conflicts = nil
+		fl.logPut(fileInfo)
+	}
+}
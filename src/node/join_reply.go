@@ -0,0 +1,184 @@
+/*
+This file defines the transfer of the member list on join.
+
+The whole member list doesn't fit in one UDP datagram once the cluster grows,
+so the introducer splits ACTION_REPLY_JOIN into fragments of at most
+JOIN_FRAGMENT_SIZE members. The joiner reassembles them, and asks for the
+missing ones with ACTION_RESEND_JOIN. If no fragment arrives at all, the
+joiner sends ACTION_JOIN again with the same join attempt in Seq. The
+introducer keeps the fragments for JOIN_REPLY_TTL so a resend serves the same
+snapshot, and answers a repeated attempt without joining the node again. An
+introducer that can not give the joiner an id answers ACTION_REJECT_JOIN.
+*/
+
+package node
+
+import (
+	. "slogger"
+	"time"
+)
+
+const (
+	JOIN_FRAGMENT_SIZE    = 8
+	JOIN_FRAGMENT_TIMEOUT = 200 * time.Millisecond
+	JOIN_RESEND_RETRIES   = 5
+	JOIN_RETRIES          = 2 // ACTION_JOIN sent again when no fragment arrives
+	JOIN_REPLY_TTL        = 10 * time.Second
+	// fragments of the largest member list, received without blocking
+	JOIN_QUEUE_SIZE = MAX_CAPACITY / JOIN_FRAGMENT_SIZE
+)
+
+type joinReplyCache struct {
+	seq       int // join attempt of the joiner
+	fragments []*Packet
+}
+
+type joinReply struct {
+	Id          int
+	Incarnation int
+	Members     []MemberUpdate
+}
+
+// sendJoinReply sends the member list to a joiner, assigned is the id the
+// joiner should adopt
+func (node *Node) sendJoinReply(address string, seq, assigned, incarnation int) {
+	members := []MemberUpdate{}
+	node.MbList.lock.Lock()
+	for _, member := range node.MbList.Member_map {
+		members = append(members, updateFromMember(ACTION_NEW_NODE, member))
+	}
+	node.MbList.lock.Unlock()
+
+	fragmentCnt := (len(members) + JOIN_FRAGMENT_SIZE - 1) / JOIN_FRAGMENT_SIZE
+	fragments := make([]*Packet, fragmentCnt)
+	for i := range fragments {
+		end := (i + 1) * JOIN_FRAGMENT_SIZE
+		if end > len(members) {
+			end = len(members)
+		}
+		fragments[i] = &Packet{
+			Action:      ACTION_REPLY_JOIN,
+			Id:          assigned,
+			IP:          node.IP,
+			Port:        node.Port,
+			Incarnation: incarnation,
+			Members:     members[i*JOIN_FRAGMENT_SIZE : end],
+			Fragment:    i,
+			FragmentCnt: fragmentCnt,
+		}
+	}
+	cache := &joinReplyCache{seq: seq, fragments: fragments}
+	node.joinLock.Lock()
+	node.joinReplies[address] = cache
+	node.joinLock.Unlock()
+	time.AfterFunc(JOIN_REPLY_TTL, func() {
+		node.joinLock.Lock()
+		if node.joinReplies[address] == cache {
+			delete(node.joinReplies, address)
+		}
+		node.joinLock.Unlock()
+	})
+
+	for _, fragment := range fragments {
+		err := node.sendPacket(address, fragment)
+		if err != nil {
+			SLOG.Println("Error in sending memberlist packet", err)
+		}
+	}
+}
+
+// isRepeatedJoin resends the whole reply if the join attempt was answered
+func (node *Node) isRepeatedJoin(packet Packet) bool {
+	address := packet.IP + ":" + packet.Port
+	node.joinLock.Lock()
+	cache, ok := node.joinReplies[address]
+	node.joinLock.Unlock()
+	if !ok || cache.seq != packet.Seq {
+		return false
+	}
+	SLOG.Printf("[Node %d] Repeated ACTION_JOIN from %s", node.Id, address)
+	for _, fragment := range cache.fragments {
+		node.sendPacket(address, fragment)
+	}
+	return true
+}
+
+func (node *Node) resendJoinReply(packet Packet) {
+	address := packet.IP + ":" + packet.Port
+	node.joinLock.Lock()
+	cache, ok := node.joinReplies[address]
+	node.joinLock.Unlock()
+	if !ok {
+		SLOG.Printf("[Node %d] No join reply to resend for %s", node.Id, address)
+		return
+	}
+	SLOG.Printf("[Node %d] Resend %d join reply fragments to %s", node.Id, len(packet.Missing), address)
+	for _, i := range packet.Missing {
+		if i >= 0 && i < len(cache.fragments) {
+			node.sendPacket(address, cache.fragments[i])
+		}
+	}
+}
+
+// receiveJoinReply reassembles the fragments of ACTION_REPLY_JOIN sent by
+// the introducer at address in answer to joinPacket
+func (node *Node) receiveJoinReply(address string, joinPacket *Packet) (*joinReply, bool) {
+	var reply *joinReply
+	var received []bool
+	remaining := 0
+	retries := 0
+	joinRetries := 0
+	timeout := time.Second // wait longer for the first fragment
+	for {
+		select {
+		case packet := <-node.chan_packet:
+			if packet.Action == ACTION_REJECT_JOIN {
+				SLOG.Printf("[Node %d] Join rejected by %s", node.Id, address)
+				return nil, false
+			}
+			if reply == nil {
+				reply = &joinReply{Id: packet.Id, Incarnation: packet.Incarnation}
+				received = make([]bool, packet.FragmentCnt)
+				remaining = packet.FragmentCnt
+				timeout = JOIN_FRAGMENT_TIMEOUT
+			}
+			if packet.Fragment < 0 || packet.Fragment >= len(received) || received[packet.Fragment] {
+				break
+			}
+			received[packet.Fragment] = true
+			reply.Members = append(reply.Members, packet.Members...)
+			remaining--
+		case <-time.After(timeout):
+			if reply == nil {
+				if joinRetries == JOIN_RETRIES {
+					return nil, false
+				}
+				joinRetries++
+				SLOG.Printf("[Node %d] No join reply from %s, join again", node.Id, address)
+				node.sendPacket(address, joinPacket)
+				break
+			}
+			if retries == JOIN_RESEND_RETRIES {
+				return nil, false
+			}
+			retries++
+			missing := []int{}
+			for i, ok := range received {
+				if !ok {
+					missing = append(missing, i)
+				}
+			}
+			resendPacket := &Packet{
+				Action:  ACTION_RESEND_JOIN,
+				Id:      reply.Id,
+				IP:      node.IP,
+				Port:    node.Port,
+				Missing: missing,
+			}
+			node.sendPacket(address, resendPacket)
+		}
+		if reply != nil && remaining == 0 {
+			return reply, true
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+This file defines node labels.
+
+A node advertises arbitrary key=value labels (zone, rack, disk, cpu, role,
+vnodes)
+when it joins, they travel with ACTION_NEW_NODE and the member list like the
+other member fields. The role label restricts what a node is used for: a
+"storage-only" node gets no MapleJuice work, and a "compute-only" node stores
+no replica.
+*/
+
+package node
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	LABEL_ZONE   = "zone"
+	LABEL_RACK   = "rack"
+	LABEL_DISK   = "disk"
+	LABEL_CPU    = "cpu"
+	LABEL_ROLE   = "role"
+	LABEL_VNODES = "vnodes"
+
+	ROLE_STORAGE_ONLY = "storage-only"
+	ROLE_COMPUTE_ONLY = "compute-only"
+)
+
+// ParseLabels parses comma separated key=value pairs
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, errors.New("invalid label: " + pair)
+		}
+		labels[key] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// FormatLabels is the reverse of ParseLabels, keys are sorted
+func FormatLabels(labels map[string]string) string {
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+func (mNode *MemberNode) CanCompute() bool {
+	return mNode.Labels[LABEL_ROLE] != ROLE_STORAGE_ONLY
+}
+
+func (mNode *MemberNode) CanStore() bool {
+	return mNode.Labels[LABEL_ROLE] != ROLE_COMPUTE_ONLY
+}
@@ -64,10 +64,14 @@ func (node *Node) RegisterRPCMapleJuiceService() {
 
 // handle maple/juice request from Dcli send request to Master
 func (mj *MapleJuiceService) ForwardMapleJuiceRequest(args *MapleJuiceTaskArgs, result *RPCResultType) error {
+	if mj.SelfNode.IsDegraded() {
+		*result = RPC_FAIL
+		return ErrNoQuorum // the master of the minority side must not run jobs
+	}
 	mbList := mj.SelfNode.MbList
 	masterNode := mbList.GetNode(mbList.smallestId)
 	address := masterNode.Ip + ":" + masterNode.RPC_Port
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		SLOG.Printf("[ForwardMJ] Dial failed, address: %s", address)
 		return err
@@ -91,6 +95,10 @@ func (mj *MapleJuiceService) ForwardMapleJuiceRequest(args *MapleJuiceTaskArgs,
 
 // add maple juice task to queue
 func (mj *MapleJuiceService) AddMapleJuiceTask(args *MapleJuiceTaskArgs, result *RPCResultType) error {
+	if mj.SelfNode.IsDegraded() {
+		*result = RPC_FAIL
+		return ErrNoQuorum
+	}
 	SLOG.Print("task added to TaskQueue")
 	mj.TaskQueue <- args
 	*result = RPC_SUCCESS
@@ -123,10 +131,15 @@ func (mj *MapleJuiceService) dispatchMapleJuiceTask(args *MapleJuiceTaskArgs) {
 	// 2.
 	var files []string
 	if args.TaskType == MapleTask {
-		files = mj.SelfNode.ListFileInDirRequest(args.InputPath)
+		files = mj.SelfNode.ListMapleInputs(args.InputPath)
 		SLOG.Printf("[MAPLE] starting maple task with exe: %s, src_dir: %s", args.Exe, args.InputPath)
 	} else {
-		files = mj.SelfNode.ListFilesWithPrefixRequest(args.InputPath)
+		var err error
+		files, err = mj.SelfNode.ListFilesWithPrefixRequest(Selector{Pattern: args.InputPath})
+		if err != nil {
+			ReplyTaskResultToDcli("[Juice Task] Failed: "+err.Error(), args.ClientAddr)
+			return
+		}
 		SLOG.Printf("[JUICE] starting juice task with exe: %s, src_prefix: %s", args.Exe, args.InputPath)
 	}
 
@@ -139,7 +152,8 @@ func (mj *MapleJuiceService) dispatchMapleJuiceTask(args *MapleJuiceTaskArgs) {
 	SLOG.Printf("[dispatchMapleJuiceTask] worker and files: %+v", worker_and_files)
 
 	// 4.
-	waitChan := make(chan int, args.NumWorkers)
+	numWorkers := len(worker_and_files) // fewer than asked if few nodes compute
+	waitChan := make(chan int, numWorkers)
 	for workerID, filesList := range worker_and_files {
 		if len(filesList) > 0 {
 			workerNode := mj.SelfNode.MbList.GetNode(workerID)
@@ -152,12 +166,12 @@ func (mj *MapleJuiceService) dispatchMapleJuiceTask(args *MapleJuiceTaskArgs) {
 	}
 
 	// 5.
-	completeTaskCount := args.NumWorkers
+	completeTaskCount := numWorkers
 	for completeTaskCount > 0 {
 		select {
 		case workerID := <-waitChan:
 			completeTaskCount--
-			SLOG.Printf("[DispatchMapleJuiceTask] work done! workerID: %d, Files: %+q ... %d/%d remaining", workerID, worker_and_files[workerID], completeTaskCount, args.NumWorkers)
+			SLOG.Printf("[DispatchMapleJuiceTask] work done! workerID: %d, Files: %+q ... %d/%d remaining", workerID, worker_and_files[workerID], completeTaskCount, numWorkers)
 			delete(worker_and_files, workerID)
 		case failureWorkerID := <-mj.SelfNode.FailureNodeChan:
 			SLOG.Printf("[DispatchMapleJuiceTask] work from workerid: %d has failed, finding a new worker!", failureWorkerID)
@@ -168,7 +182,7 @@ func (mj *MapleJuiceService) dispatchMapleJuiceTask(args *MapleJuiceTaskArgs) {
 	// 6.
 	if args.DeleteInput {
 		if args.TaskType == JuiceTask {
-			mj.SelfNode.DeleteSDFSDirRequest(args.InputPath)
+			mj.SelfNode.DeleteSDFSDirRequest(Selector{Pattern: args.InputPath})
 		} else {
 			SLOG.Print("unexpected deleteInput")
 		}
@@ -200,8 +214,8 @@ func ReplyTaskResultToDcli(message, clientAddress string) {
 // TODO: test this
 func (mj *MapleJuiceService) reDispatchMapleJuiceTask(taskType MapleJuiceTaskType, failureWorkerID int, worker_and_files map[int][]string, waitChan chan int, args *MapleJuiceTaskArgs) {
 	newWorkerId := -1
-	for nodeId, _ := range mj.SelfNode.MbList.Member_map {
-		if _, exists := worker_and_files[nodeId]; !exists {
+	for nodeId, member := range mj.SelfNode.MbList.Member_map {
+		if _, exists := worker_and_files[nodeId]; !exists && member.CanCompute() {
 			newWorkerId = nodeId
 			break
 		}
@@ -225,7 +239,7 @@ func CallMapleJuiceRequest(workerID int, workerAddress string, files []string, a
 		InputFiles: files,
 		OutputPath: args.OutputPath,
 	}
-	client, err := rpc.Dial("tcp", workerAddress)
+	client, err := DialRPC(workerAddress)
 	if err != nil {
 		SLOG.Printf("[CallMapleJuiceRequest] Dial failed, address: %s", workerAddress)
 		return
@@ -254,7 +268,7 @@ func CallNodesMergeTmpFiles(receiverAddress []string) {
 }
 
 func CallSingleNodeMergeTmpFiles(address string, ts int, c chan int) {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		SLOG.Printf("[CallNodeMergeTmpFiles] Dial failed, address: %s", address)
 		return
@@ -270,6 +284,10 @@ func CallSingleNodeMergeTmpFiles(address string, ts int, c chan int) {
 
 func (node *Node) PartitionFiles(files []string, numWorkers int, partitionMethod string) map[int][]string {
 	workerMap := make(map[int][]string)
+	if workers := node.workerCount(); numWorkers > workers {
+		SLOG.Printf("[PartitionFiles] %d workers asked, only %d nodes take work", numWorkers, workers)
+		numWorkers = workers
+	}
 	if partitionMethod == "hash" {
 		partitionedFiles := make([][]string, numWorkers)
 		for i, _ := range partitionedFiles {
@@ -279,15 +297,15 @@ func (node *Node) PartitionFiles(files []string, numWorkers int, partitionMethod
 			hashIndex := getHashID(file) % numWorkers
 			partitionedFiles[hashIndex] = append(partitionedFiles[hashIndex], file)
 		}
-		workerId := node.MbList.GetNode(node.Id).next.Id
+		workerId := node.nextWorkerId(node.Id)
 		for i := 0; i < numWorkers; i++ {
 			workerMap[workerId] = partitionedFiles[i]
-			workerId = node.MbList.GetNode(workerId).next.Id
+			workerId = node.nextWorkerId(workerId)
 		}
 	} else if partitionMethod == "range" {
 		minFiles := len(files) / numWorkers
 		extra := len(files) % numWorkers
-		workerId := node.MbList.GetNode(node.Id).next.Id
+		workerId := node.nextWorkerId(node.Id)
 		file_i := 0
 		for i := 0; i < numWorkers; i++ {
 			workerMap[workerId] = []string{}
@@ -300,7 +318,7 @@ func (node *Node) PartitionFiles(files []string, numWorkers int, partitionMethod
 				file_i++
 				extra--
 			}
-			workerId = node.MbList.GetNode(workerId).next.Id
+			workerId = node.nextWorkerId(workerId)
 		}
 		if file_i != len(files) {
 			SLOG.Fatal("[PartitionFiles] assertion error")
@@ -311,6 +329,36 @@ func (node *Node) PartitionFiles(files []string, numWorkers int, partitionMethod
 	return workerMap
 }
 
+// workerCount returns the number of nodes nextWorkerId goes through
+func (node *Node) workerCount() int {
+	node.MbList.lock.Lock()
+	defer node.MbList.lock.Unlock()
+	cnt := 0
+	for _, member := range node.MbList.Member_map {
+		if member.CanCompute() {
+			cnt++
+		}
+	}
+	if cnt == 0 {
+		return len(node.MbList.Member_map) // storage-only nodes take it all
+	}
+	return cnt
+}
+
+// nextWorkerId returns the ring successor of id that takes MapleJuice work,
+// storage-only nodes are skipped unless no other node is left
+func (node *Node) nextWorkerId(id int) int {
+	next := node.MbList.GetNode(id).next
+	for cur := next; ; cur = cur.next {
+		if cur.CanCompute() {
+			return cur.Id
+		}
+		if cur.Id == id {
+			return next.Id
+		}
+	}
+}
+
 /*****
  * Worker
  *****/
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
@@ -80,9 +79,9 @@ func (node *Node) StartMapleJuiceTask(des *TaskDescription) error {
 	// 5. append files to SDFS
 	var args *PutFileArgs
 	if des.TaskType == MapleTask {
-		args = &PutFileArgs{local_output_path, des.OutputPath, true, true, true}
+		args = &PutFileArgs{LocalName: local_output_path, SdfsName: des.OutputPath, ForceUpdate: true, Appending: true, Tmp: true}
 	} else {
-		args = &PutFileArgs{local_output_path, des.OutputPath + SPLIT + strconv.Itoa(node.Id), true, true, true}
+		args = &PutFileArgs{LocalName: local_output_path, SdfsName: des.OutputPath + SPLIT + strconv.Itoa(node.Id), ForceUpdate: true, Appending: true, Tmp: true}
 	}
 
 	var result RPCResultType
@@ -224,14 +223,7 @@ func (node *Node) GetFilesFromSDFS(sdfsfiles []string, dir string) error {
 	for _, sdfsPath := range sdfsfiles {
 		filename := filepath.Base(sdfsPath)
 		localPath := filepath.Join(dir, filename)
-		file_addr, _ := node.GetAddressOfLatestTS(sdfsPath)
-		var data []byte
-		err := GetFile(file_addr, sdfsPath, &data)
-		if err != nil {
-			SLOG.Println(err)
-			return err
-		}
-		err = ioutil.WriteFile(localPath, data, 0777)
+		err := node.FetchFile(sdfsPath, localPath)
 		if err != nil {
 			SLOG.Println(localPath, err)
 			return err
@@ -248,7 +240,7 @@ func dialLocalNode() (*rpc.Client, string) {
 	}
 	ip := fmt.Sprintf("%s", addr_raw[0])
 	address := ip + ":" + RPC_DEFAULT_PORT
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		log.Fatal(err)
 	}
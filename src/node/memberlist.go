@@ -24,6 +24,9 @@ type MemberNode struct {
 	Ip          string
 	Port        string
 	RPC_Port    string
+	Incarnation int
+	Suspect     bool
+	Labels      map[string]string
 	prev        *MemberNode
 	next        *MemberNode
 }
@@ -48,7 +51,10 @@ type MemberList struct {
 	Member_map     map[int]*MemberNode
 	Capacity, Size int
 	SelfId         int
+	View           int // increases on every membership change
 	lock           *sync.Mutex
+	ring           []RingToken // tokens sorted by position, see placement.go
+	ringView       int         // View the ring was built in
 	smallestId     int
 }
 
@@ -61,6 +67,10 @@ func CreateMemberList(selfId, capacity int) *MemberList {
 }
 
 func (mbList *MemberList) InsertNode(id int, ip, port, rpc_port string, heartbeat_t int, hostname string) {
+	mbList.InsertNodeWithLabels(id, ip, port, rpc_port, heartbeat_t, hostname, nil)
+}
+
+func (mbList *MemberList) InsertNodeWithLabels(id int, ip, port, rpc_port string, heartbeat_t int, hostname string, labels map[string]string) {
 	mbList.lock.Lock()
 	defer mbList.lock.Unlock()
 	if _, exist := mbList.Member_map[id]; exist {
@@ -68,9 +78,11 @@ func (mbList *MemberList) InsertNode(id int, ip, port, rpc_port string, heartbea
 		return
 	}
 	new_node := CreateMemberNode(id, ip, port, rpc_port, heartbeat_t, hostname)
+	new_node.Labels = copyLabels(labels)
 	SLOG.Printf("[MembershipList %d] Inserted node (%d, %s:%s, %d)", mbList.SelfId, id, ip, port, heartbeat_t)
 	mbList.Member_map[id] = new_node
 	mbList.Size++
+	mbList.View++
 	if id < mbList.smallestId {
 		mbList.smallestId = id
 	}
@@ -109,6 +121,31 @@ func (mbList *MemberList) FindLeastFreeId() int {
 	return -1 // Should not happend
 }
 
+// GetIdByAddress returns the id of the member listening on ip:port, or -1
+func (mbList *MemberList) GetIdByAddress(ip, port string) int {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	for id, member := range mbList.Member_map {
+		if member.Ip == ip && member.Port == port {
+			return id
+		}
+	}
+	return -1
+}
+
+// FindNextFreeId returns the first free id clockwise from start, or -1
+func (mbList *MemberList) FindNextFreeId(start int) int {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	for i := 0; i < mbList.Capacity; i++ {
+		id := (start + i) % mbList.Capacity
+		if _, exist := mbList.Member_map[id]; !exist {
+			return id
+		}
+	}
+	return -1
+}
+
 func (mbList *MemberList) DeleteNode(id int) {
 	mbList.lock.Lock()
 	defer mbList.lock.Unlock()
@@ -126,6 +163,7 @@ func (mbList *MemberList) DeleteNode(id int) {
 	}
 	delete(mbList.Member_map, id)
 	mbList.Size--
+	mbList.View++
 	SLOG.Printf("[MembershipList %d] Deleted node %d", mbList.SelfId, id)
 	mbList.DumpToTmpFile()
 }
@@ -143,6 +181,49 @@ func (mbList *MemberList) UpdateNodeHeartbeat(id, heartbeat_t int) {
 	mbList.DumpToTmpFile()
 }
 
+// MarkSuspect returns true if the node turns into suspect state
+func (mbList *MemberList) MarkSuspect(id, incarnation int) bool {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	node := mbList.GetNode(id)
+	if node == nil || incarnation < node.Incarnation {
+		return false
+	}
+	if node.Suspect && incarnation == node.Incarnation {
+		return false
+	}
+	node.Suspect = true
+	node.Incarnation = incarnation
+	mbList.View++
+	return true
+}
+
+// MarkAlive returns true if the incarnation overrides the current one
+func (mbList *MemberList) MarkAlive(id, incarnation int) bool {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	node := mbList.GetNode(id)
+	if node == nil || incarnation <= node.Incarnation {
+		return false
+	}
+	node.Suspect = false
+	node.Incarnation = incarnation
+	mbList.View++
+	return true
+}
+
+func (mbList *MemberList) GetView() int {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	return mbList.View
+}
+
+func (mbList *MemberList) GetSize() int {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	return mbList.Size
+}
+
 func (mbList *MemberList) GetNode(id int) *MemberNode {
 	return mbList.Member_map[id]
 }
@@ -203,12 +284,22 @@ func (mbList *MemberList) GetPrevKNodes(id, k int) []MemberNode {
 }
 
 func (mbList *MemberList) GetNextKNodes(id, k int) []MemberNode {
+	arr, ok := mbList.nextKNodes(id, k)
+	if !ok {
+		SLOG.Panic("start id doesn't exit in node")
+		return nil
+	}
+	return arr
+}
+
+// nextKNodes is GetNextKNodes for an id that may leave the list meanwhile, ok
+// is false if it is not in the list
+func (mbList *MemberList) nextKNodes(id, k int) ([]MemberNode, bool) {
 	mbList.lock.Lock()
 	defer mbList.lock.Unlock()
 	node := mbList.GetNode(id)
 	if node == nil {
-		SLOG.Panic("start id doesn't exit in node")
-		return nil
+		return nil, false
 	}
 	arr := make([]MemberNode, 0)
 	next := node.next
@@ -216,7 +307,7 @@ func (mbList *MemberList) GetNextKNodes(id, k int) []MemberNode {
 		arr = append(arr, *next)
 		next = next.next
 	}
-	return arr
+	return arr, true
 }
 
 func (mbList *MemberList) GetSmallestNode() *MemberNode {
@@ -287,6 +378,26 @@ func ConstructFromTmpFile() *MemberList {
 	return &new_mbList
 }
 
+// ReadLastKnownAddresses returns the udp addresses of other members in the
+// last dumped membership list, a restarted node can rejoin through them
+func ReadLastKnownAddresses() []string {
+	dat, err := ioutil.ReadFile(MEMBER_LIST_FILE)
+	if err != nil {
+		return nil
+	}
+	var mbList MemberList
+	if json.Unmarshal(dat, &mbList) != nil {
+		return nil
+	}
+	res := []string{}
+	for id, member := range mbList.Member_map {
+		if id != mbList.SelfId {
+			res = append(res, member.Ip+":"+member.Port)
+		}
+	}
+	return res
+}
+
 func (mbList *MemberList) NicePrint() {
 	w := tabwriter.NewWriter(os.Stdout, 10, 0, 4, ' ', 0)
 	var keys []int
@@ -294,16 +405,38 @@ func (mbList *MemberList) NicePrint() {
 		keys = append(keys, k)
 	}
 	sort.Ints(keys)
-	fmt.Fprintln(w, "ID\tHostname\tIP\tPORT\tHeartbeat\tJoin Time")
+	fmt.Fprintln(w, "ID\tHostname\tIP\tPORT\tHeartbeat\tJoin Time\tStatus\tLabels")
 	for _, k := range keys {
 		node := mbList.Member_map[k]
 		ts := time.Unix(int64(node.Heartbeat_t/1000), 0).Format("2006.01.02 15:04:05")
-		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n",
-			node.Id, node.Hostname, node.Ip, node.Port, ts, node.JoinTime)
+		status := "alive"
+		if node.Suspect {
+			status = "suspect"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			node.Id, node.Hostname, node.Ip, node.Port, ts, node.JoinTime, status, FormatLabels(node.Labels))
 	}
 	fmt.Fprintln(w)
-	fmt.Fprintf(w, "Self ID: %d\tSize: %d\tCapacity: %d\n",
-		mbList.SelfId, mbList.Size, mbList.Capacity)
+	fmt.Fprintf(w, "Self ID: %d\tSize: %d\tCapacity: %d\tView: %d\n",
+		mbList.SelfId, mbList.Size, mbList.Capacity, mbList.View)
+	w.Flush()
+}
+
+// PrintOwnership prints the share of the ring mastered by each member
+func (mbList *MemberList) PrintOwnership() {
+	w := tabwriter.NewWriter(os.Stdout, 10, 0, 4, ' ', 0)
+	var keys []int
+	for k, _ := range mbList.Member_map {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	ownership := mbList.Ownership()
+	fmt.Fprintln(w, "ID\tHostname\tVNodes\tSlots\tOwnership")
+	for _, k := range keys {
+		node := mbList.Member_map[k]
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%.1f%%\n",
+			node.Id, node.Hostname, node.VNodes(), ownership[k], float64(ownership[k])*100/MAX_CAPACITY)
+	}
 	w.Flush()
 }
 
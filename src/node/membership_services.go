@@ -0,0 +1,77 @@
+/*
+This file defines the rpc service for membership reconciliation.
+
+Two nodes exchange their whole membership state (members with incarnations
+and recent tombstones) and view numbers, then each side merges what the other
+knows better. A joining node calls it on its introducer, so it converges even
+if membership changed while the ACTION_REPLY_JOIN was in flight.
+*/
+
+package node
+
+import (
+	"errors"
+	"net/rpc"
+	. "slogger"
+)
+
+const MembershipServiceName = "MembershipService"
+
+type ReconcileArgs struct {
+	Id      int
+	View    int
+	Members []MemberUpdate
+}
+
+type ReconcileReply struct {
+	View    int
+	Members []MemberUpdate // updates the caller doesn't know yet
+}
+
+type MembershipService struct {
+	node *Node
+}
+
+func (node *Node) RegisterMembershipService(address string) error {
+	return rpc.RegisterName(MembershipServiceName+address, &MembershipService{node: node})
+}
+
+/* Callee begin */
+
+func (ms *MembershipService) Reconcile(args *ReconcileArgs, reply *ReconcileReply) error {
+	node := ms.node
+	if node.MbList == nil {
+		return errors.New("membership list is not initialized")
+	}
+	reply.Members = node.updatesMissingFrom(digestFromUpdates(args.Members))
+	node.applyUpdates(args.Members)
+	reply.View = node.MbList.GetView()
+	SLOG.Printf("[Node %d] Reconciled membership with node %d, view: %d, remote view: %d", node.Id, args.Id, reply.View, args.View)
+	return nil
+}
+
+/* Callee end */
+
+/* Caller begin */
+
+// ReconcileMembership merges views with the node listening on the rpc
+// address, it returns the view number of the remote node
+func (node *Node) ReconcileMembership(address string) (int, error) {
+	client, err := DialRPC(address)
+	if err != nil {
+		SLOG.Printf("[ReconcileMembership] Dial failed, address: %s", address)
+		return -1, err
+	}
+	defer client.Close()
+	args := &ReconcileArgs{Id: node.Id, View: node.MbList.GetView(), Members: node.membershipState()}
+	var reply ReconcileReply
+	err = client.Call(MembershipServiceName+address+".Reconcile", args, &reply)
+	if err != nil {
+		SLOG.Println("[ReconcileMembership] send_err:", err)
+		return -1, err
+	}
+	node.applyUpdates(reply.Members)
+	return reply.View, nil
+}
+
+/* Caller end */
@@ -0,0 +1,536 @@
+/*
+This file defines the sdfs namespace.
+
+Every directory has a directory object, a json list of its entries stored as
+the sdfs file <dir>/.sdfsdir (.sdfsdir for the root), so it is placed on the
+ring by its path and replicated like any file. Updates of a directory go to
+the primary of its object, which applies them one at a time and writes the
+new version. A put of a new file adds it to its directory and a delete
+removes it, a directory that does not exist yet is created along with its
+parents.
+
+Listing a directory reads its object for the subdirectories, and asks every
+member for the files too, since files like the output of MapleJuice or the
+ones written before the namespace existed are not in any object. Moving or
+deleting a directory moves or deletes those files as well.
+*/
+
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "slogger"
+	"sort"
+	"strings"
+)
+
+const DIR_OBJECT = ".sdfsdir"
+
+var ErrNoDir = errors.New("directory not found")
+var ErrNotFound = errors.New("file or directory not found")
+var ErrExists = errors.New("file or directory already exists")
+var ErrBadName = errors.New("reserved sdfs name")
+
+type DirEntry struct {
+	Name  string
+	IsDir bool
+}
+
+type Directory struct {
+	Entries []DirEntry // sorted by name
+}
+
+type DirUpdate struct {
+	Dir    string
+	Entry  DirEntry // empty only creates the directory
+	Remove bool
+}
+
+type ListDirArgs struct {
+	Dir       string
+	Recursive bool
+}
+
+// RenameArgs are the paths of a rename or a copy
+type RenameArgs struct {
+	Src string
+	Dst string
+}
+
+type FileStat struct {
+	Name      string
+	IsDir     bool
+	Size      int64
+	Timestamp int
+	Entries   int // for a directory
+	Replicas  int // replicas the file should have
+	Holders   int // replicas holding the latest version
+	Conflicts int
+}
+
+// CleanPath normalizes a sdfs path, the root is ""
+func CleanPath(path string) string {
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	return path
+}
+
+func parentDir(path string) string {
+	return CleanPath(filepath.Dir(path))
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+func dirObjectName(dir string) string {
+	return joinPath(dir, DIR_OBJECT)
+}
+
+func IsDirObject(sdfsName string) bool {
+	return filepath.Base(sdfsName) == DIR_OBJECT
+}
+
+func isReservedName(sdfsName string) bool {
+	return IsDirObject(sdfsName) || IsBlockName(sdfsName)
+}
+
+// apply changes the entries, it tells if anything changed
+func (d *Directory) apply(update *DirUpdate) bool {
+	i := sort.Search(len(d.Entries), func(i int) bool { return d.Entries[i].Name >= update.Entry.Name })
+	found := i < len(d.Entries) && d.Entries[i].Name == update.Entry.Name
+	if update.Entry.Name == "" {
+		return false
+	}
+	if update.Remove {
+		if !found {
+			return false
+		}
+		d.Entries = append(d.Entries[:i], d.Entries[i+1:]...)
+		return true
+	}
+	if found {
+		if d.Entries[i] == update.Entry {
+			return false
+		}
+		d.Entries[i] = update.Entry
+		return true
+	}
+	d.Entries = append(d.Entries, DirEntry{})
+	copy(d.Entries[i+1:], d.Entries[i:])
+	d.Entries[i] = update.Entry
+	return true
+}
+
+// readDir fetches the latest object of a directory, the timestamp is -1 if
+// the directory does not exist
+func (node *Node) readDir(dir string) (*Directory, int, error) {
+	name := dirObjectName(dir)
+	directory := &Directory{}
+	address, ts := node.GetAddressOfLatestTS(name)
+	if ts == -1 {
+		return directory, -1, nil
+	}
+	tmpFile, err := ioutil.TempFile("", "dir")
+	if err != nil {
+		return nil, 0, err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	if err := GetFileToLocal(address, name, tmpFile.Name()); err != nil {
+		return nil, 0, err
+	}
+	data, err := ioutil.ReadFile(tmpFile.Name())
+	if err != nil {
+		return nil, 0, err
+	}
+	return directory, ts, json.Unmarshal(data, directory)
+}
+
+func (node *Node) writeDir(dir string, directory *Directory, prevTs int) error {
+	tmpFile, err := ioutil.TempFile("", "dir")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	err = json.NewEncoder(tmpFile).Encode(directory)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	name := dirObjectName(dir)
+	args := &StoreFileArgs{SdfsName: name, PrevTs: prevTs, Replication: Replication{}.Normalize()}
+	var result RPCResultType
+	if err := node.replicateSection(name, args, fileSection{tmpFile.Name(), 0, -1}, &result); err != nil {
+		return err
+	}
+	if result == RPC_FAIL {
+		return errors.New("fail to write directory " + dir)
+	}
+	return nil
+}
+
+// UpdateDir sends an update to the primary of the directory object, or to
+// the next replica if the primary can not be reached
+func (node *Node) UpdateDir(update *DirUpdate) error {
+	name := dirObjectName(update.Dir)
+	var err error
+	for _, address := range node.GetResponsibleAddresses(name) {
+		if err = CallUpdateDir(address, update); err == nil {
+			return nil
+		}
+		if _, unreachable := err.(dialError); !unreachable {
+			return err
+		}
+	}
+	return err
+}
+
+// applyDirUpdate runs on the primary of the directory object, a directory
+// created by the update is added to its parent
+func (node *Node) applyDirUpdate(update *DirUpdate) error {
+	lock := node.appendLock(dirObjectName(update.Dir))
+	lock.Lock()
+	defer lock.Unlock()
+	directory, ts, err := node.readDir(update.Dir)
+	if err != nil {
+		return err
+	}
+	created := ts == -1
+	if created && update.Remove {
+		return nil
+	}
+	if !directory.apply(update) && !created {
+		return nil
+	}
+	if err := node.writeDir(update.Dir, directory, ts); err != nil {
+		return err
+	}
+	if created && update.Dir != "" {
+		return node.UpdateDir(&DirUpdate{Dir: parentDir(update.Dir), Entry: DirEntry{filepath.Base(update.Dir), true}})
+	}
+	return nil
+}
+
+// addToNamespace records a new file in its directory
+func (node *Node) addToNamespace(sdfsName string) {
+	sdfsName = CleanPath(sdfsName)
+	err := node.UpdateDir(&DirUpdate{Dir: parentDir(sdfsName), Entry: DirEntry{filepath.Base(sdfsName), false}})
+	if err != nil {
+		SLOG.Printf("[Namespace] fail to add %s: %v", sdfsName, err)
+	}
+}
+
+// removeFromNamespace drops a deleted file or directory from its parent
+func (node *Node) removeFromNamespace(path string, isDir bool) {
+	path = CleanPath(path)
+	err := node.UpdateDir(&DirUpdate{Dir: parentDir(path), Entry: DirEntry{filepath.Base(path), isDir}, Remove: true})
+	if err != nil {
+		SLOG.Printf("[Namespace] fail to remove %s: %v", path, err)
+	}
+}
+
+// Mkdir creates a directory and its parents
+func (node *Node) Mkdir(dir string) error {
+	dir = CleanPath(dir)
+	if isReservedName(dir) {
+		return ErrBadName
+	}
+	if _, err := node.Stat(dir); err == nil {
+		return ErrExists
+	} else if err != ErrNotFound {
+		return err
+	}
+	return node.UpdateDir(&DirUpdate{Dir: dir})
+}
+
+// ListDir lists a directory, subdirectories end with a "/" and are followed
+// by their content if recursive
+func (node *Node) ListDir(dir string, recursive bool) ([]string, error) {
+	dir = CleanPath(dir)
+	directory, ts, err := node.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if ts == -1 {
+		return nil, ErrNoDir
+	}
+	res := []string{}
+	for _, entry := range directory.Entries {
+		path := joinPath(dir, entry.Name)
+		if !entry.IsDir {
+			res = append(res, path)
+			continue
+		}
+		res = append(res, path+"/")
+		if recursive {
+			sub, err := node.ListDir(path, true)
+			if err != nil && err != ErrNoDir {
+				return nil, err
+			}
+			res = append(res, sub...)
+		}
+	}
+	return res, nil
+}
+
+// Stat describes a file or a directory
+func (node *Node) Stat(path string) (FileStat, error) {
+	path = CleanPath(path)
+	directory, ts, err := node.readDir(path)
+	if err != nil {
+		return FileStat{}, err
+	}
+	if ts != -1 {
+		return FileStat{Name: path, IsDir: true, Timestamp: ts, Entries: len(directory.Entries)}, nil
+	}
+	replication := node.GetReplication(path)
+	stat := FileStat{Name: path, Replicas: replication.Replicas, Timestamp: -1}
+	manifest := false
+	for _, address := range node.GetResponsibleAddressesWithReplicas(path, replication.Replicas) {
+		meta, err := CallGetFileMeta(address, path)
+		if err != nil {
+			continue
+		}
+		if meta.Timestamp > stat.Timestamp {
+			stat.Timestamp, stat.Size, stat.Holders = meta.Timestamp, meta.Size, 0
+			stat.Conflicts, manifest = len(meta.Conflicts), meta.Manifest
+		}
+		if meta.Timestamp == stat.Timestamp {
+			stat.Holders++
+		}
+	}
+	if stat.Holders == 0 {
+		return FileStat{}, ErrNotFound
+	}
+	if manifest {
+		m, err := node.ReadManifest(path)
+		if err != nil {
+			return FileStat{}, err
+		}
+		stat.Size = m.Size
+	}
+	return stat, nil
+}
+
+// checkMove checks that src can be moved or copied to dst and returns the
+// stat of src
+func (node *Node) checkMove(src, dst string) (FileStat, error) {
+	if src == "" || isReservedName(src) || isReservedName(dst) || strings.HasPrefix(dst+"/", src+"/") {
+		return FileStat{}, ErrBadName
+	}
+	if _, err := node.Stat(dst); err == nil {
+		return FileStat{}, ErrExists
+	} else if err != ErrNotFound {
+		return FileStat{}, err
+	}
+	return node.Stat(src)
+}
+
+// Rename moves a file or a directory with its content to dst, dst must not
+// exist
+func (node *Node) Rename(src, dst string) error {
+	src, dst = CleanPath(src), CleanPath(dst)
+	stat, err := node.checkMove(src, dst)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir {
+		return node.renameFile(src, dst)
+	}
+	directory, _, err := node.readDir(src)
+	if err != nil {
+		return err
+	}
+	if err := node.UpdateDir(&DirUpdate{Dir: dst}); err != nil {
+		return err
+	}
+	for _, entry := range directory.Entries {
+		if err := node.Rename(joinPath(src, entry.Name), joinPath(dst, entry.Name)); err != nil {
+			return err
+		}
+	}
+	// what is left under src was written without the namespace
+	unlisted, err := node.ListFilesWithPrefixRequest(Selector{Pattern: src + "/", Literal: true})
+	if err != nil {
+		return err
+	}
+	for _, sdfsName := range unlisted {
+		if err := node.renameFile(sdfsName, dst+strings.TrimPrefix(sdfsName, src)); err != nil {
+			return err
+		}
+	}
+	var result RPCResultType
+	node.deleteFile(dirObjectName(src), &result)
+	if result != RPC_SUCCESS {
+		return errors.New("fail to delete the directory object of " + src)
+	}
+	node.removeFromNamespace(src, true)
+	return nil
+}
+
+// renameFile copies a file to dst on the storage nodes, then deletes it
+func (node *Node) renameFile(src, dst string) error {
+	if err := node.copyFile(src, dst); err != nil {
+		return err
+	}
+	var result RPCResultType
+	if err := node.DeleteFileRequest(src, &result); err != nil {
+		return err
+	}
+	if result != RPC_SUCCESS {
+		return errors.New("fail to delete " + src)
+	}
+	return nil
+}
+
+// Copy copies a file or a directory with its content to dst, dst must not
+// exist
+func (node *Node) Copy(src, dst string) error {
+	src, dst = CleanPath(src), CleanPath(dst)
+	stat, err := node.checkMove(src, dst)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir {
+		return node.copyFile(src, dst)
+	}
+	directory, _, err := node.readDir(src)
+	if err != nil {
+		return err
+	}
+	if err := node.UpdateDir(&DirUpdate{Dir: dst}); err != nil {
+		return err
+	}
+	for _, entry := range directory.Entries {
+		if err := node.Copy(joinPath(src, entry.Name), joinPath(dst, entry.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUnlisted deletes the files under a directory that were written
+// without the namespace
+func (node *Node) deleteUnlisted(dir string) error {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	files, err := node.ListFilesWithPrefixRequest(Selector{Pattern: prefix, Literal: true})
+	if err != nil {
+		return err
+	}
+	return node.deleteFiles(files)
+}
+
+func (node *Node) deleteFiles(files []string) error {
+	var result RPCResultType
+	for _, sdfsName := range files {
+		if err := node.DeleteFileRequest(sdfsName, &result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanDir is the dir of the files of a sdfs dir in the local file lists
+func scanDir(dir string) string {
+	if dir = CleanPath(dir); dir == "" {
+		return "."
+	}
+	return dir
+}
+
+// deleteDirTree deletes the files and subdirectories of a directory, then
+// the directory itself
+func (node *Node) deleteDirTree(dir string) error {
+	directory, _, err := node.readDir(dir)
+	if err != nil {
+		return err
+	}
+	var result RPCResultType
+	for _, entry := range directory.Entries {
+		path := joinPath(dir, entry.Name)
+		if entry.IsDir {
+			err = node.deleteDirTree(path)
+		} else {
+			err = node.DeleteFileRequest(path, &result)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	node.deleteFile(dirObjectName(dir), &result)
+	if dir != "" {
+		node.removeFromNamespace(dir, true)
+	}
+	return nil
+}
+
+/* Callee begin */
+func (fileService *FileService) UpdateDirRequest(update *DirUpdate, result *RPCResultType) error {
+	*result = RPC_FAIL
+	if err := fileService.node.applyDirUpdate(update); err != nil {
+		return err
+	}
+	*result = RPC_SUCCESS
+	return nil
+}
+
+func (fileService *FileService) MkdirRequest(dir string, result *RPCResultType) error {
+	*result = RPC_FAIL
+	if fileService.node.IsDegraded() {
+		return ErrNoQuorum
+	}
+	if err := fileService.node.Mkdir(dir); err != nil {
+		return err
+	}
+	*result = RPC_SUCCESS
+	return nil
+}
+
+func (fileService *FileService) ListDirRequest(args *ListDirArgs, res *[]string) error {
+	entries, err := fileService.node.ListDir(args.Dir, args.Recursive)
+	*res = entries
+	return err
+}
+
+func (fileService *FileService) RenameRequest(args *RenameArgs, result *RPCResultType) error {
+	*result = RPC_FAIL
+	if fileService.node.IsDegraded() {
+		return ErrNoQuorum
+	}
+	if err := fileService.node.Rename(args.Src, args.Dst); err != nil {
+		return err
+	}
+	*result = RPC_SUCCESS
+	return nil
+}
+
+func (fileService *FileService) StatRequest(path string, res *FileStat) error {
+	stat, err := fileService.node.Stat(path)
+	*res = stat
+	return err
+}
+
+/* Callee end */
+
+/* Caller begin */
+func CallUpdateDir(address string, update *DirUpdate) error {
+	client, err := DialRPC(address)
+	if err != nil {
+		return dialError{err}
+	}
+	defer client.Close()
+	var result RPCResultType
+	return client.Call(FileServiceName+address+".UpdateDirRequest", update, &result)
+}
+
+/* Caller end */
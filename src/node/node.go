@@ -2,7 +2,6 @@ package node
 
 import (
 	"encoding/json"
-	"math/rand"
 	"net"
 	"os"
 	"os/user"
@@ -28,20 +27,75 @@ type Node struct {
 	active             bool
 	DisableMonitorHB   bool // Disalbe monitor heartbeat, for test
 	FailureNodeChan    chan int
+	Detector           DetectorType
+	incarnation        int // of this node, guarded by memberLock
+	probeSeq           int
+	ackLock            *sync.Mutex
+	ackWaiters         map[int]chan bool
+	suspectTimers      map[int]*time.Timer
+	probeOrder         []int
+	gossiper           *Gossiper
+	joinLock           *sync.Mutex
+	joinReplies        map[string]*joinReplyCache // Key: joiner address
+	ScanRetries        int                        // rounds of pings sent by ScanIntroducer
+	ScanTimeout        time.Duration              // wait for an ACK in each round
+	Transport          Transport
+	Timing             Timing
+	Secret             []byte // HMAC key of membership packets, nil to disable
+	replays            *replayGuard
+	Labels             map[string]string
+	quorumLock         *sync.Mutex
+	knownSize          int  // cluster size the quorum is based on
+	degraded           bool // read only, the node is on the minority side
+	quorumTimer        *time.Timer
+	BlockSize          int64 // files larger than this are stored in blocks, 0 to disable
+	resyncPending      bool  // files were restored, resync them after joining
+	Clock              *HLC  // orders the sdfs writes, see hlc.go
+	appendLocks        map[string]*sync.Mutex
+	appendLocksLock    *sync.Mutex
+	stages             map[int]*FileInfo // copies staged on this replica, see copy.go
+	stagesLock         *sync.Mutex
+	readRepairer       *readRepairer
+	hints              *hintStore // writes kept for unreachable replicas, see hints.go
+}
+
+type Timing struct {
+	HeartbeatInterval   time.Duration
+	TimeoutThreshold    time.Duration
+	ProbeInterval       time.Duration
+	ProbeTimeout        time.Duration
+	SuspectTimeout      time.Duration
+	AntiEntropyInterval time.Duration
+	QuorumStablePeriod  time.Duration
+	ScrubInterval       time.Duration
+	HintInterval        time.Duration
 }
 
 type Packet struct {
-	Action   ActionType
-	Id       int
-	Hostname string
-	IP       string
-	Port     string
-	RPC_Port string
-	Map      *MemberList
+	Action      ActionType
+	Id          int
+	Hostname    string
+	IP          string
+	Port        string
+	RPC_Port    string
+	Seq         int // probe sequence number, 0 for introducer ping, join attempt in ACTION_JOIN
+	Target      int // node to be probed by ACTION_PING_REQ
+	Incarnation int
+	Updates     []MemberUpdate // piggybacked membership deltas
+	Digest      []DigestEntry  // membership digest for anti-entropy
+	Members     []MemberUpdate // a fragment of the member list in ACTION_REPLY_JOIN
+	Fragment    int
+	FragmentCnt int
+	Missing     []int // fragments asked by ACTION_RESEND_JOIN
+	Left        bool  // the deleted node left voluntarily
+	ClusterSize int   // size of the sender's side in ACTION_HEAL
+	SmallestId  int
+	Labels      map[string]string // labels of the node in Id
 }
 
-type ActionType int8
+type ActionType int32
 type StatusType int8
+type DetectorType int8
 
 const (
 	ACTION_JOIN        ActionType = 1 << 0
@@ -51,20 +105,56 @@ const (
 	ACTION_HEARTBEAT   ActionType = 1 << 4
 	ACTION_PING        ActionType = 1 << 5
 	ACTION_ACK         ActionType = 1 << 6
+	ACTION_PING_REQ    ActionType = 1 << 7
+	ACTION_SUSPECT     ActionType = 1 << 8
+	ACTION_ALIVE       ActionType = 1 << 9
+	ACTION_GOSSIP      ActionType = 1 << 10
+	ACTION_SYNC        ActionType = 1 << 11
+	ACTION_SYNC_REPLY  ActionType = 1 << 12
+	ACTION_RESEND_JOIN ActionType = 1 << 13
+	ACTION_HEAL        ActionType = 1 << 14
+	ACTION_REJECT_JOIN ActionType = 1 << 15
 
 	STATUS_OK   StatusType = 1 << 0
 	STATUS_FAIL StatusType = 1 << 1
 	STATUS_END  StatusType = 1 << 2
 
 	LOSS_RATE              = 0.00
+	UDP_BUFFER_SIZE        = 65536
 	NUM_MONITORS       int = 3
 	HEARTBEAT_INTERVAL     = 1500 * time.Millisecond
 	TIMEOUT_THRESHOLD      = 4 * time.Second
+	SCAN_RETRIES           = 3
+	SCAN_TIMEOUT           = 500 * time.Millisecond
+
+	DETECTOR_HEARTBEAT DetectorType = 0 // ring heartbeat, default
+	DETECTOR_SWIM      DetectorType = 1 // ping, ping-req and suspicion
+
+	// packets that carry piggybacked membership deltas
+	PIGGYBACK_ACTIONS = ACTION_HEARTBEAT | ACTION_PING | ACTION_ACK | ACTION_PING_REQ | ACTION_GOSSIP | ACTION_SYNC
 )
 
 var HEARTBEAT_LOG_FLAG = false // debug
 
+func DefaultTiming() Timing {
+	return Timing{
+		HeartbeatInterval:   HEARTBEAT_INTERVAL,
+		TimeoutThreshold:    TIMEOUT_THRESHOLD,
+		ProbeInterval:       PROBE_INTERVAL,
+		ProbeTimeout:        PROBE_TIMEOUT,
+		SuspectTimeout:      SUSPECT_TIMEOUT,
+		AntiEntropyInterval: ANTI_ENTROPY_INTERVAL,
+		QuorumStablePeriod:  QUORUM_STABLE_PERIOD,
+		ScrubInterval:       SCRUB_INTERVAL,
+		HintInterval:        HINT_INTERVAL,
+	}
+}
+
 func CreateNode(ip, port, rpc_port string) *Node {
+	return CreateNodeWithDetector(ip, port, rpc_port, DETECTOR_HEARTBEAT)
+}
+
+func CreateNodeWithDetector(ip, port, rpc_port string, detector DetectorType) *Node {
 	ID := getHashID(ip + ":" + port)
 	timer_map := make(map[int]*time.Timer)
 	fileList := CreateFileList(ID)
@@ -78,9 +168,30 @@ func CreateNode(ip, port, rpc_port string) *Node {
 	}
 	node.Hostname = ip
 	node.chan_introducer = make(chan string, 20)
-	node.chan_packet = make(chan Packet, 20)
+	node.chan_packet = make(chan Packet, JOIN_QUEUE_SIZE)
 	node.active = true
 	node.DisableMonitorHB = false
+	node.Detector = detector
+	node.ackLock = &sync.Mutex{}
+	node.ackWaiters = make(map[int]chan bool)
+	node.suspectTimers = make(map[int]*time.Timer)
+	node.gossiper = CreateGossiper()
+	node.replays = createReplayGuard()
+	node.joinLock = &sync.Mutex{}
+	node.joinReplies = make(map[string]*joinReplyCache)
+	node.ScanRetries = SCAN_RETRIES
+	node.ScanTimeout = SCAN_TIMEOUT
+	node.Transport = CreateUDPTransport()
+	node.Timing = DefaultTiming()
+	node.quorumLock = &sync.Mutex{}
+	node.BlockSize = DEFAULT_BLOCK_SIZE
+	node.Clock = CreateHLC()
+	node.appendLocks = make(map[string]*sync.Mutex)
+	node.appendLocksLock = &sync.Mutex{}
+	node.stages = make(map[int]*FileInfo)
+	node.stagesLock = &sync.Mutex{}
+	node.readRepairer = createReadRepairer()
+	node.hints = createHintStore()
 	return node
 }
 
@@ -88,10 +199,18 @@ func (node *Node) UpdateHostname(name string) {
 	node.Hostname = name
 }
 
+// UpdateId moves the node to another ring position, the introducer assigns
+// one when the hash ID is taken by another address
+func (node *Node) UpdateId(id int) {
+	node.Id = id
+	node.FileList.ID = id
+}
+
 func (node *Node) InitMemberList() {
 	SLOG.Printf("[Node %d] Init Membership List", node.Id)
 	node.MbList = CreateMemberList(node.Id, MAX_CAPACITY)
-	node.MbList.InsertNode(node.Id, node.IP, node.Port, node.RPC_Port, GetMillisecond(), node.Hostname)
+	node.MbList.InsertNodeWithLabels(node.Id, node.IP, node.Port, node.RPC_Port, GetMillisecond(), node.Hostname, node.Labels)
+	node.updateQuorum()
 }
 
 func (node *Node) IsAlive() bool {
@@ -107,15 +226,17 @@ func (node *Node) ScanIntroducer(addresses []string) (string, bool) {
 		RPC_Port: node.RPC_Port,
 		Hostname: node.Hostname,
 	}
-	for _, introAddr := range addresses {
-		go node.sendPacketUDP(introAddr, pingPacket)
-	}
-	select {
-	case res := <-node.chan_introducer:
-		SLOG.Print(res)
-		return res, true
-	case <-time.After(500 * time.Millisecond):
-		break
+	for i := 0; i < node.ScanRetries; i++ {
+		for _, introAddr := range addresses {
+			go node.sendPacket(introAddr, pingPacket)
+		}
+		select {
+		case res := <-node.chan_introducer:
+			SLOG.Print(res)
+			return res, true
+		case <-time.After(node.ScanTimeout):
+			SLOG.Printf("[Node %d] No introducer found, round: %d", node.Id, i+1)
+		}
 	}
 	return "", false
 }
@@ -129,33 +250,64 @@ func (node *Node) Join(address string) bool {
 		Id:       node.Id,
 		RPC_Port: node.RPC_Port,
 		Hostname: node.Hostname,
+		Seq:      int(time.Now().UnixNano()), // differs after a restart
+		Labels:   node.Labels,
+	}
+	// drop fragments left over from a previous join
+	for len(node.chan_packet) > 0 {
+		<-node.chan_packet
 	}
 	SLOG.Printf("Sending Join packet, source %s:%s, destination %s", node.IP, node.Port, address)
-	err := node.sendPacketUDP(address, packet)
+	err := node.sendPacket(address, packet)
 	if err != nil {
 		SLOG.Panic(err)
 	}
+	previous := node.MbList
 	node.MbList = CreateMemberList(node.Id, MAX_CAPACITY)
-	select {
-	case mblistPacket := <-node.chan_packet:
-		for _, item := range mblistPacket.Map.Member_map {
-			node.MbList.InsertNode(item.Id, item.Ip, item.Port, item.RPC_Port, GetMillisecond(), item.Hostname)
+	reply, ok := node.receiveJoinReply(address, packet)
+	if !ok {
+		SLOG.Printf("Join failed, source: %s:%s", node.IP, node.Port)
+		if previous != nil {
+			node.MbList = previous // keep the partitioned view to heal later
 		}
-		node.MbList.InsertNode(node.Id, node.IP, node.Port, node.RPC_Port, GetMillisecond(), node.Hostname)
-		for _, prevNode := range node.MbList.GetPrevKNodes(node.Id, NUM_MONITORS) {
-			node.monitorIfNecessary(prevNode.Id)
-		}
-		return true
-	case <-time.After(time.Second):
-		SLOG.Printf("Join Time out, source: %s:%s", node.IP, node.Port)
 		return false
 	}
+	node.gossiper.Reset()
+	if reply.Id != node.Id {
+		SLOG.Printf("[Node %d] Hash ID collides, adopt assigned id: %d", node.Id, reply.Id)
+		node.UpdateId(reply.Id)
+		node.MbList = CreateMemberList(node.Id, MAX_CAPACITY)
+	}
+	for _, item := range reply.Members {
+		node.MbList.InsertNodeWithLabels(item.Id, item.IP, item.Port, item.RPC_Port, GetMillisecond(), item.Hostname, item.Labels)
+		node.MbList.MarkAlive(item.Id, item.Incarnation)
+	}
+	node.setIncarnation(reply.Incarnation)
+	node.MbList.InsertNodeWithLabels(node.Id, node.IP, node.Port, node.RPC_Port, GetMillisecond(), node.Hostname, node.Labels)
+	node.MbList.MarkAlive(node.Id, reply.Incarnation)
+	for _, prevNode := range node.MbList.GetPrevKNodes(node.Id, NUM_MONITORS) {
+		node.monitorIfNecessary(prevNode.Id)
+	}
+	node.resetQuorum() // the introducer's side has the quorum
+	if node.resyncPending {
+		node.resyncPending = false
+		go node.ResyncRestoredFiles()
+	}
+	// catch up on changes made while the reply was in flight
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if introducerId := node.MbList.GetIdByAddress(host, port); introducerId != -1 {
+			go node.ReconcileMembership(node.MbList.GetRPCAddress(introducerId))
+		}
+	}
+	return true
 }
 
 func (node *Node) Leave() {
 	deleteNodePacket := &Packet{
-		Action: ACTION_DELETE_NODE,
-		Id:     node.Id,
+		Action:      ACTION_DELETE_NODE,
+		Id:          node.Id,
+		Incarnation: node.GetIncarnation(),
+		Left:        true,
 	}
 	node.MbList.DeleteNode(node.Id)
 	node.Broadcast(deleteNodePacket)
@@ -172,7 +324,7 @@ func (node *Node) SendHeartbeat() {
 		if HEARTBEAT_LOG_FLAG {
 			SLOG.Printf("[Node %d] Sending ACTION_HEARTBEAT to %s", node.Id, address)
 		}
-		node.sendPacketUDP(address, heartbeatPacket)
+		node.sendPacket(address, heartbeatPacket)
 	}
 }
 
@@ -181,86 +333,109 @@ func (node *Node) SendHeartbeatRoutine() {
 		if !node.active {
 			break
 		}
-		if rand.Float64() >= LOSS_RATE { // simulate loss packet
-			node.SendHeartbeat()
-		}
-		time.Sleep(HEARTBEAT_INTERVAL)
+		node.SendHeartbeat()
+		time.Sleep(node.Timing.HeartbeatInterval)
 	}
 }
 
-func (node *Node) sendPacketUDP(address string, packet *Packet) error {
+func (node *Node) StartFailureDetector() {
+	if node.Detector == DETECTOR_SWIM {
+		node.SWIMProbeRoutine()
+	} else {
+		node.SendHeartbeatRoutine()
+	}
+}
+
+func (node *Node) sendPacket(address string, packet *Packet) error {
 	if !node.active {
 		SLOG.Printf("[Node %d] is no longer active. Stop sending packet to address: %s", node.Id, address)
 	}
-	data, err := json.Marshal(packet)
-	if err != nil {
-		SLOG.Print(err)
-		return err
+	if packet.Action&PIGGYBACK_ACTIONS != 0 && packet.Updates == nil && node.MbList != nil {
+		piggybacked := *packet
+		piggybacked.Updates = node.gossiper.TakePiggyback()
+		packet = &piggybacked
 	}
-	var conn net.Conn
-	conn, err = net.Dial("udp", address)
+	data, err := json.Marshal(packet)
 	if err != nil {
-		SLOG.Printf("Dial Failed: address: %s", address)
 		SLOG.Print(err)
 		return err
 	}
-	defer conn.Close()
-	conn.Write(data)
-	return nil
+	return node.Transport.Send(node.IP+":"+node.Port, address, node.sealPacket(data))
 }
 
+// Broadcast disseminates a membership packet by gossip
 func (node *Node) Broadcast(packet *Packet) {
-	addresses := node.MbList.GetAllAddressesExcludeSelf()
-	for _, addr := range addresses {
-		node.sendPacketUDP(addr, packet)
-	}
+	node.Gossip(updateFromPacket(packet))
 }
 
 func (node *Node) handlePacket(packet Packet) {
+	if len(packet.Updates) > 0 {
+		node.applyUpdates(packet.Updates)
+	}
 	switch packet.Action {
-	case ACTION_NEW_NODE:
-		SLOG.Printf("[Node %d] Received ACTION_NEW_NODE (%d, %s:%s)", node.Id, packet.Id, packet.IP, packet.Port)
-		node.JoinNode(packet)
-	case ACTION_DELETE_NODE:
-		SLOG.Printf("[Node %d] Received ACTION_DELETE_NODE (%d), source: %s, port: %s", node.Id, packet.Id, packet.IP, packet.Port)
-
-		if packet.Id == node.Id {
-			SLOG.Println("Going to delete self")
-			node.active = false
+	case ACTION_NEW_NODE, ACTION_DELETE_NODE, ACTION_SUSPECT, ACTION_ALIVE:
+		SLOG.Printf("[Node %d] Received membership packet %d (%d, incarnation %d), source: %s:%s", node.Id, packet.Action, packet.Id, packet.Incarnation, packet.IP, packet.Port)
+		node.applyUpdates([]MemberUpdate{updateFromPacket(&packet)})
+	case ACTION_JOIN:
+		if node.isRepeatedJoin(packet) {
 			break
 		}
-		lose_heartbeat := node.isPrevKNodes(packet.Id)
-		node.LostNode(packet.Id, lose_heartbeat)
-	case ACTION_JOIN:
 		reply_address := packet.IP + ":" + packet.Port
 		new_id := packet.Id
-		SLOG.Printf("[Node %d] Received ACTION_JOIN from %s:%s, assign id: %d", node.Id, packet.IP, packet.Port, new_id)
-		if node.MbList.GetNode(new_id) != nil {
-			n := node.MbList.GetNode(new_id)
-			SLOG.Printf("[WTF] Duplicated hash ID. reply_address: %s, id: %d, victim: %s", reply_address, new_id, n.Ip)
-			os.Exit(1)
-		}
-		sendMemberListPacket := &Packet{
-			Action: ACTION_REPLY_JOIN,
-			Map:    node.MbList,
+		if id := node.MbList.GetIdByAddress(packet.IP, packet.Port); id != -1 {
+			new_id = id // may differ from the hash ID if it was assigned
+		} else if node.MbList.GetNode(new_id) != nil {
+			victim := node.MbList.GetNode(new_id)
+			new_id = node.MbList.FindNextFreeId(new_id)
+			SLOG.Printf("[Node %d] Duplicated hash ID %d. reply_address: %s, victim: %s:%s, reassign id: %d",
+				node.Id, packet.Id, reply_address, victim.Ip, victim.Port, new_id)
+			if new_id == -1 {
+				SLOG.Printf("[Node %d] Membership list is full, reject %s", node.Id, reply_address)
+				node.sendPacket(reply_address, &Packet{Action: ACTION_REJECT_JOIN, Id: packet.Id, IP: node.IP, Port: node.Port})
+				break
+			}
 		}
-		err := node.sendPacketUDP(reply_address, sendMemberListPacket)
-		if err != nil {
-			SLOG.Println("Error in sending memberlist packet", err)
+		packet.Id = new_id
+		SLOG.Printf("[Node %d] Received ACTION_JOIN from %s:%s, assign id: %d", node.Id, packet.IP, packet.Port, new_id)
+		// a rejoining node must outlive the tombstone of its previous life
+		incarnation := node.gossiper.GetTombstone(new_id) + 1
+		n := node.MbList.GetNode(new_id)
+		if n != nil {
+			// same address, the node restarted before its old entry was deleted
+			incarnation = n.Incarnation + 1
+			SLOG.Printf("[Node %d] Node %d rejoined, incarnation: %d", node.Id, new_id, incarnation)
 		}
+		node.sendJoinReply(reply_address, packet.Seq, new_id, incarnation)
 		newNodePacket := &Packet{
-			Action:   ACTION_NEW_NODE,
-			Id:       new_id,
-			IP:       packet.IP,
-			Port:     packet.Port,
-			RPC_Port: packet.RPC_Port,
-			Hostname: packet.Hostname,
+			Action:      ACTION_NEW_NODE,
+			Id:          new_id,
+			IP:          packet.IP,
+			Port:        packet.Port,
+			RPC_Port:    packet.RPC_Port,
+			Hostname:    packet.Hostname,
+			Incarnation: incarnation,
+			Labels:      packet.Labels,
 		}
 		node.Broadcast(newNodePacket)
-		node.JoinNode(packet)
-	case ACTION_REPLY_JOIN:
-		SLOG.Printf("[Node %d] Received ACTION_REPLY_JOIN assigned, member cnt: %d", node.Id, len(packet.Map.Member_map))
-		node.chan_packet <- packet
+		if n != nil {
+			node.rejoinNode(packet, incarnation)
+		} else {
+			node.gossiper.RemoveTombstone(new_id)
+			node.JoinNode(packet)
+			node.MbList.MarkAlive(new_id, incarnation)
+		}
+	case ACTION_REPLY_JOIN, ACTION_REJECT_JOIN:
+		SLOG.Printf("[Node %d] Received join reply %d, fragment: %d/%d, member cnt: %d",
+			node.Id, packet.Action, packet.Fragment+1, packet.FragmentCnt, len(packet.Members))
+		select {
+		case node.chan_packet <- packet:
+		default: // nobody is joining, or it is asked again if missing
+			SLOG.Printf("[Node %d] Drop join reply fragment %d", node.Id, packet.Fragment+1)
+		}
+	case ACTION_RESEND_JOIN:
+		node.resendJoinReply(packet)
+	case ACTION_HEAL:
+		node.handleHeal(packet)
 	case ACTION_HEARTBEAT:
 		if HEARTBEAT_LOG_FLAG {
 			SLOG.Printf("[Node %d] Received ACTION_HEARTBEAT id: %d", node.Id, packet.Id)
@@ -268,6 +443,10 @@ func (node *Node) handlePacket(packet Packet) {
 		node.MbList.UpdateNodeHeartbeat(packet.Id, GetMillisecond())
 		node.resetTimer(packet.Id)
 	case ACTION_PING:
+		if packet.Seq != 0 {
+			node.handleProbe(packet)
+			break
+		}
 		if packet.IP == node.IP && packet.Port == node.Port {
 			break // self should not ack
 		}
@@ -281,37 +460,53 @@ func (node *Node) handlePacket(packet Packet) {
 			IP:     node.IP,
 			Port:   node.Port,
 		}
-		node.sendPacketUDP(address, ackPacket)
+		node.sendPacket(address, ackPacket)
 	case ACTION_ACK:
+		if packet.Seq != 0 {
+			node.deliverAck(packet.Seq)
+			break
+		}
 		SLOG.Printf("[Node x] Received ACTION_ACK from %s:%s", packet.IP, packet.Port)
 		address := packet.IP + ":" + packet.Port
 		node.chan_introducer <- address
+	case ACTION_PING_REQ:
+		node.handlePingReq(packet)
+	case ACTION_SYNC, ACTION_SYNC_REPLY:
+		node.handleSync(packet)
 	}
 
 }
 
 func (node *Node) MonitorInputPacket() {
-	conn, err := net.ListenPacket("udp", node.IP+":"+node.Port)
+	err := node.Transport.Listen(node.IP+":"+node.Port, func(data []byte) {
+		rec_packet, ok := node.decodePacket(data)
+		if !ok {
+			return
+		}
+		go node.handlePacket(rec_packet)
+	})
 	if err != nil {
 		SLOG.Fatal("[Fatal] error in starting listenPacket", err)
 	}
-	defer conn.Close()
-	for {
-		buf := make([]byte, 4096)
-		length, _, err := conn.ReadFrom(buf)
-		if err != nil {
-			SLOG.Println("Error in MonitorInputPacket:", err)
-		}
-		var rec_packet Packet
-		json.Unmarshal(buf[:length], &rec_packet)
-		go node.handlePacket(rec_packet)
+}
+
+// decodePacket drops packets that are not signed with the cluster secret, or
+// replayed
+func (node *Node) decodePacket(data []byte) (Packet, bool) {
+	var rec_packet Packet
+	data, ok := node.openPacket(data)
+	if !ok {
+		SLOG.Printf("[Node %d] Dropped a packet with invalid MAC or replayed", node.Id)
+		return rec_packet, false
 	}
+	err := json.Unmarshal(data, &rec_packet)
+	return rec_packet, err == nil
 }
 
 func (node *Node) resetTimer(id int) {
 	node.mapLock.Lock()
 	if timer, ok := node.timerMap[id]; ok {
-		timer.Reset(TIMEOUT_THRESHOLD)
+		timer.Reset(node.Timing.TimeoutThreshold)
 	} else {
 		SLOG.Printf("[Node %d] trying to reset a non-existed timer %d", node.Id, id)
 	}
@@ -320,7 +515,7 @@ func (node *Node) resetTimer(id int) {
 }
 
 func (node *Node) monitorIfNecessary(id int) {
-	if !node.isPrevKNodes(id) || node.DisableMonitorHB {
+	if node.Detector == DETECTOR_SWIM || !node.isPrevKNodes(id) || node.DisableMonitorHB {
 		return
 	}
 	node.mapLock.Lock()
@@ -328,7 +523,7 @@ func (node *Node) monitorIfNecessary(id int) {
 		node.timerMap[id].Stop()
 		SLOG.Printf("[Node %d] Stop existed timer %d", node.Id, id)
 	}
-	node.timerMap[id] = time.AfterFunc(TIMEOUT_THRESHOLD, func() {
+	node.timerMap[id] = time.AfterFunc(node.Timing.TimeoutThreshold, func() {
 		node.nodeTimeOut(id)
 	})
 	node.mapLock.Unlock()
@@ -344,15 +539,17 @@ func (node *Node) isPrevKNodes(id int) bool {
 }
 
 func (node *Node) nodeTimeOut(id int) {
-	if !node.isPrevKNodes(id) || !node.active {
+	member := node.MbList.GetNode(id)
+	if member == nil || !node.isPrevKNodes(id) || !node.active {
 		return
 	}
 	SLOG.Printf("[Node %d] found failure node id: %d\n", node.Id, id)
 	deleteNodePacket := &Packet{
-		Action: ACTION_DELETE_NODE,
-		Id:     id,
-		IP:     node.IP,
-		Port:   node.Port,
+		Action:      ACTION_DELETE_NODE,
+		Id:          id,
+		IP:          node.IP,
+		Port:        node.Port,
+		Incarnation: member.Incarnation,
 	}
 	node.Broadcast(deleteNodePacket)
 	node.LostNode(id, true)
@@ -370,15 +567,17 @@ func (node *Node) LostNode(id int, lose_heartbeat bool) {
 		node.memberLock.Unlock()
 		return
 	}
-	next_node_id := to_delete_node.GetNextNode().Id
+	node.gossiper.AddTombstone(id, to_delete_node.Incarnation)
+	node.gossiper.AddLost(updateFromMember(ACTION_DELETE_NODE, to_delete_node))
 	node.MbList.DeleteNode(id)
 	node.memberLock.Unlock()
+	node.updateQuorum()
 
 	if node.file_service_on {
-		node.FileList.UpdateMasterID(next_node_id, func(fileInfo *FileInfo) bool {
-			return fileInfo.MasterNodeID == id
-		})
+		orphaned := node.FileList.GetOwnedFileInfos(id)
+		node.updateMasters()
 		node.FileList.DeleteTmpFilesFromFailedWorker(id)
+		go node.rereplicate(orphaned)
 		go node.DuplicateReplica()
 	}
 	if lose_heartbeat {
@@ -393,19 +592,29 @@ func (node *Node) LostNode(id int, lose_heartbeat bool) {
 	}
 }
 
+// rejoinNode replaces the entry of a node that restarted from the same
+// address, the old instance is handled as failed so its files are handed over
+func (node *Node) rejoinNode(packet Packet, incarnation int) {
+	node.LostNode(packet.Id, node.isPrevKNodes(packet.Id))
+	node.gossiper.RemoveTombstone(packet.Id)
+	node.JoinNode(packet)
+	node.MbList.MarkAlive(packet.Id, incarnation)
+}
+
 func (node *Node) JoinNode(packet Packet) {
-	node.MbList.InsertNode(packet.Id, packet.IP, packet.Port, packet.RPC_Port, GetMillisecond(), packet.Hostname)
+	node.MbList.InsertNodeWithLabels(packet.Id, packet.IP, packet.Port, packet.RPC_Port, GetMillisecond(), packet.Hostname, packet.Labels)
+	node.gossiper.RemoveLost(packet.Id)
+	node.updateQuorum()
 	node.monitorIfNecessary(packet.Id)
 
 	if node.file_service_on {
-		new_node := node.MbList.GetNode(packet.Id)
-		prev_node_id := new_node.GetPrevNode().Id
-		next_node_id := new_node.GetNextNode().Id
-		node.FileList.UpdateMasterID(packet.Id, func(fileInfo *FileInfo) bool {
-			return IsInCircleRange(fileInfo.HashID, prev_node_id+1, packet.Id)
-		})
-		if next_node_id == node.Id {
-			node.TransferOwnership(new_node.Id)
+		ownedFileInfos := node.FileList.GetOwnedFileInfos(node.Id)
+		node.updateMasters()
+		for _, info := range ownedFileInfos {
+			if node.masterIdForHash(info.HashID) == packet.Id {
+				node.TransferOwnership(packet.Id)
+				break
+			}
 		}
 
 		node.DeleteRedundantFile()
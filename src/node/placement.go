@@ -0,0 +1,267 @@
+/*
+This file defines where the replicas of a file are placed.
+
+Each member owns VNodes() points (tokens) on the ring of MAX_CAPACITY slots:
+its id, and for virtual nodes, hashes of the id. A file hashed to hashId
+belongs to the first token clockwise, its master is the owner of that token,
+or the next member storing files if the owner is compute-only. With more
+tokens per member, ownership is spread more evenly and the range of a member
+that leaves is split over many successors.
+
+The other DUPLICATE_CNT-1 replicas are picked walking the ring from the
+master's token. If any member has a zone or rack label, each pick prefers the
+node sharing the smallest failure domain (zone > rack > host) with the
+replicas already picked, so copies spread over zones, racks and machines.
+Without labels this is plain ring order.
+
+GetResponsibleAddresses, DuplicateReplica and DeleteRedundantFile all go
+through ReplicasOf, so they agree on the replicas. The sorted ring is built
+once per view of the member list.
+*/
+
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const DEFAULT_VNODES = 1
+const MAX_VNODES = 64
+
+type RingToken struct {
+	Pos int
+	Id  int
+}
+
+// VNodes returns the number of tokens of the member, from its vnodes label
+func (mNode *MemberNode) VNodes() int {
+	n, err := strconv.Atoi(mNode.Labels[LABEL_VNODES])
+	if err != nil || n < 1 {
+		return DEFAULT_VNODES
+	}
+	if n > MAX_VNODES {
+		return MAX_VNODES
+	}
+	return n
+}
+
+// Tokens returns the ring positions of the member, the first one is its id
+func (mNode *MemberNode) Tokens() []int {
+	res := []int{mNode.Id}
+	for i := 1; i < mNode.VNodes(); i++ {
+		res = append(res, getHashID(fmt.Sprintf("%d#%d", mNode.Id, i)))
+	}
+	return res
+}
+
+// Ring returns the tokens of all members sorted by position, a tie goes to
+// the smaller id
+func (mbList *MemberList) Ring() []RingToken {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	return append([]RingToken{}, mbList.ringLocked()...)
+}
+
+// ringLocked returns the ring of the current view, the caller holds the lock
+// and must not modify it
+func (mbList *MemberList) ringLocked() []RingToken {
+	if mbList.ring != nil && mbList.ringView == mbList.View {
+		return mbList.ring
+	}
+	ring := []RingToken{}
+	for id, member := range mbList.Member_map {
+		for _, pos := range member.Tokens() {
+			ring = append(ring, RingToken{pos, id})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].Pos != ring[j].Pos {
+			return ring[i].Pos < ring[j].Pos
+		}
+		return ring[i].Id < ring[j].Id
+	})
+	mbList.ring, mbList.ringView = ring, mbList.View
+	return ring
+}
+
+// masterIndex returns the index in ring of the token whose owner is the
+// master of hashId
+func (mbList *MemberList) masterIndex(ring []RingToken, hashId int) int {
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].Pos >= hashId })
+	for i := 0; i < len(ring); i++ {
+		idx := (start + i) % len(ring)
+		if mbList.Member_map[ring[idx].Id].CanStore() {
+			return idx
+		}
+	}
+	return start % len(ring) // no node stores files, ignore the roles
+}
+
+// MasterOf returns the master of the files hashed to hashId, -1 if the list
+// is empty
+func (mbList *MemberList) MasterOf(hashId int) int {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	ring := mbList.ringLocked()
+	if len(ring) == 0 {
+		return -1
+	}
+	return ring[mbList.masterIndex(ring, hashId)].Id
+}
+
+// ReplicasOf returns at most k replicas of a file hashed to hashId and
+// mastered by masterId, the master comes first. If masterId is not the
+// current master of hashId, the walk starts from the first token of masterId.
+// It returns nil if masterId is not a member
+func (mbList *MemberList) ReplicasOf(masterId, hashId, k int) []int {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	ring := mbList.ringLocked()
+	master := mbList.Member_map[masterId]
+	if len(ring) == 0 || master == nil {
+		return nil
+	}
+	domains := mbList.hasFailureDomainsLocked()
+	start := mbList.masterIndex(ring, hashId)
+	if ring[start].Id != masterId {
+		for i, token := range ring {
+			if token.Id == masterId && token.Pos == masterId {
+				start = i
+				break
+			}
+		}
+	}
+	res := []int{masterId}
+	candidates := []*MemberNode{}
+	seen := map[int]bool{masterId: true}
+	// without failure domains the first k-1 in ring order are the replicas
+	for i := 1; i < len(ring) && (domains || len(candidates) < k-1); i++ {
+		member := mbList.Member_map[ring[(start+i)%len(ring)].Id]
+		if !seen[member.Id] && member.CanStore() {
+			candidates = append(candidates, member)
+		}
+		seen[member.Id] = true
+	}
+	if !domains {
+		for i := 0; i < len(candidates) && len(res) < k; i++ {
+			res = append(res, candidates[i].Id)
+		}
+		return res
+	}
+	chosen := []*MemberNode{master}
+	used := make([]bool, len(candidates))
+	for len(res) < k {
+		best, bestScore := -1, -1
+		for i, c := range candidates {
+			if used[i] {
+				continue
+			}
+			if score := spreadScore(c, chosen); score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best == -1 {
+			break
+		}
+		used[best] = true
+		chosen = append(chosen, candidates[best])
+		res = append(res, candidates[best].Id)
+	}
+	return res
+}
+
+// Ownership returns the number of ring slots mastered by each member
+func (mbList *MemberList) Ownership() map[int]int {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	res := make(map[int]int)
+	ring := mbList.ringLocked()
+	if len(ring) == 0 {
+		return res
+	}
+	for hashId := 0; hashId < MAX_CAPACITY; hashId++ {
+		res[ring[mbList.masterIndex(ring, hashId)].Id]++
+	}
+	return res
+}
+
+// spreadScore is 3 for a new zone, 2 for a new rack, 1 for a new host and 0
+// for a host that already has a replica
+func spreadScore(c *MemberNode, chosen []*MemberNode) int {
+	maxShared := 0
+	for _, r := range chosen {
+		shared := 0
+		if c.Labels[LABEL_ZONE] == r.Labels[LABEL_ZONE] {
+			shared = 1
+			if c.Labels[LABEL_RACK] == r.Labels[LABEL_RACK] {
+				shared = 2
+				if c.Ip == r.Ip {
+					shared = 3
+				}
+			}
+		}
+		if shared > maxShared {
+			maxShared = shared
+		}
+	}
+	return 3 - maxShared
+}
+
+// HasFailureDomains returns true if any member has a zone or rack label
+func (mbList *MemberList) HasFailureDomains() bool {
+	mbList.lock.Lock()
+	defer mbList.lock.Unlock()
+	return mbList.hasFailureDomainsLocked()
+}
+
+func (mbList *MemberList) hasFailureDomainsLocked() bool {
+	for _, member := range mbList.Member_map {
+		if member.Labels[LABEL_ZONE] != "" || member.Labels[LABEL_RACK] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// masterIdForHash returns the master of the files hashed to hashId
+func (node *Node) masterIdForHash(hashId int) int {
+	return node.MbList.MasterOf(hashId)
+}
+
+// isReplicaOf returns true if this node should store the files hashed to
+// hashId with the given number of replicas
+func (node *Node) isReplicaOf(hashId, replicas int) bool {
+	for _, id := range node.MbList.ReplicasOf(node.masterIdForHash(hashId), hashId, replicas) {
+		if id == node.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// updateMasters points every local file to its master in the current view
+func (node *Node) updateMasters() {
+	node.FileList.UpdateMasterIDBy(func(fileInfo *FileInfo) int {
+		return node.masterIdForHash(fileInfo.HashID)
+	})
+}
+
+// rereplicate pushes files whose master left to their new replicas, every
+// node holding a copy takes part so the load is spread
+func (node *Node) rereplicate(fileInfos []FileInfo) {
+	for _, info := range fileInfos {
+		if info.Tmp {
+			continue
+		}
+		info.MasterNodeID = node.masterIdForHash(info.HashID)
+		targets := []int{}
+		for _, id := range node.MbList.ReplicasOf(info.MasterNodeID, info.HashID, info.Replication.Normalize().Replicas) {
+			if id != node.Id {
+				targets = append(targets, id)
+			}
+		}
+		node.SendFileIfNecessary(info, node.GetAddressesWithIds(targets))
+	}
+}
@@ -0,0 +1,181 @@
+/*
+This file defines the split brain protection.
+
+A node remembers the cluster size it last agreed on (knownSize). If the
+members it sees are not a strict majority of knownSize, the node is on the
+minority side of a partition and becomes degraded: it refuses writes and
+MapleJuice jobs, so the two sides never diverge. knownSize grows as soon as
+members join, and shrinks only after the view stayed stable with a quorum
+for QuorumStablePeriod, so the majority keeps working after real failures.
+
+A degraded node stops gossiping, so the members it deleted are not deleted
+on the other side once the network heals. It keeps sending ACTION_HEAL to
+the members it lost. A node that has a quorum, or whose side wins the tie
+(more members, then the smallest id), answers with an ACK and the degraded
+node rejoins through it.
+The rejoin hands files over like any join, and replicas with older
+timestamps are overwritten by DuplicateReplica.
+*/
+
+package node
+
+import (
+	"errors"
+	. "slogger"
+	"time"
+)
+
+const (
+	QUORUM_STABLE_PERIOD = 30 * time.Second
+	LOST_MEMBER_TTL      = 10 * time.Minute
+)
+
+var ErrNoQuorum = errors.New("no quorum, the node is read only until the partition heals")
+
+func (node *Node) HasQuorum() bool {
+	node.quorumLock.Lock()
+	defer node.quorumLock.Unlock()
+	return !node.degraded
+}
+
+func (node *Node) IsDegraded() bool {
+	return !node.HasQuorum()
+}
+
+// GetKnownSize returns the cluster size the quorum is based on
+func (node *Node) GetKnownSize() int {
+	node.quorumLock.Lock()
+	defer node.quorumLock.Unlock()
+	return node.knownSize
+}
+
+// updateQuorum is called after every membership change
+func (node *Node) updateQuorum() {
+	if node.MbList == nil {
+		return
+	}
+	size := node.MbList.Size
+	node.quorumLock.Lock()
+	defer node.quorumLock.Unlock()
+	if size > node.knownSize {
+		node.knownSize = size
+	}
+	node.setDegraded(size*2 <= node.knownSize, size)
+	if node.quorumTimer != nil {
+		node.quorumTimer.Stop()
+	}
+	node.quorumTimer = time.AfterFunc(node.Timing.QuorumStablePeriod, node.commitKnownSize)
+}
+
+// resetQuorum adopts the size of the view received on join
+func (node *Node) resetQuorum() {
+	node.quorumLock.Lock()
+	node.knownSize = 0
+	node.quorumLock.Unlock()
+	node.updateQuorum()
+}
+
+// leftNode deletes a node that left voluntarily, the cluster shrinks
+// without losing the quorum
+func (node *Node) leftNode(id int, lose_heartbeat bool) {
+	node.quorumLock.Lock()
+	if node.knownSize > 1 {
+		node.knownSize--
+	}
+	node.quorumLock.Unlock()
+	node.LostNode(id, lose_heartbeat)
+	node.gossiper.RemoveLost(id)
+}
+
+// commitKnownSize accepts a smaller stable view if it still has a quorum
+func (node *Node) commitKnownSize() {
+	size := node.MbList.Size
+	node.quorumLock.Lock()
+	defer node.quorumLock.Unlock()
+	if size*2 > node.knownSize && size != node.knownSize {
+		SLOG.Printf("[Node %d] Cluster size is stable, known size: %d -> %d", node.Id, node.knownSize, size)
+		node.knownSize = size
+	}
+}
+
+func (node *Node) setDegraded(degraded bool, size int) {
+	if degraded == node.degraded {
+		return
+	}
+	if degraded {
+		SLOG.Printf("[Node %d] Lost quorum (%d of %d members), enter degraded mode", node.Id, size, node.knownSize)
+		node.gossiper.Clear() // deletes of the other side must not spread after heal
+	} else {
+		SLOG.Printf("[Node %d] Regained quorum (%d of %d members)", node.Id, size, node.knownSize)
+	}
+	node.degraded = degraded
+}
+
+// tryHeal asks the lost members for an introducer, and rejoins through the
+// first one that answers
+func (node *Node) tryHeal() bool {
+	lost := node.gossiper.GetLost()
+	if len(lost) == 0 {
+		return false
+	}
+	healPacket := &Packet{
+		Action:      ACTION_HEAL,
+		Id:          node.Id,
+		IP:          node.IP,
+		Port:        node.Port,
+		ClusterSize: node.MbList.Size,
+		SmallestId:  node.MbList.smallestId,
+	}
+	for len(node.chan_introducer) > 0 {
+		<-node.chan_introducer
+	}
+	for _, member := range lost {
+		go node.sendPacket(member.IP+":"+member.Port, healPacket)
+	}
+	var address string
+	select {
+	case address = <-node.chan_introducer:
+	case <-time.After(node.ScanTimeout):
+		return false
+	}
+	SLOG.Printf("[Node %d] Partition healed, rejoin through %s", node.Id, address)
+	if !node.Join(address) {
+		return false
+	}
+	node.reconcileFiles()
+	return true
+}
+
+func (node *Node) handleHeal(packet Packet) {
+	if !node.active || node.MbList == nil || node.MbList.GetNode(node.Id) == nil {
+		return
+	}
+	if node.IsDegraded() && !node.winsHeal(packet.ClusterSize, packet.SmallestId) {
+		return
+	}
+	ackPacket := &Packet{
+		Action: ACTION_ACK,
+		IP:     node.IP,
+		Port:   node.Port,
+	}
+	node.sendPacket(packet.IP+":"+packet.Port, ackPacket)
+}
+
+// winsHeal decides which side of an even split the other one joins
+func (node *Node) winsHeal(size, smallestId int) bool {
+	if node.MbList.Size != size {
+		return node.MbList.Size > size
+	}
+	return node.MbList.smallestId < smallestId
+}
+
+// reconcileFiles reassigns the masters of local files after a rejoin, and
+// pushes them to replicas holding older timestamps
+func (node *Node) reconcileFiles() {
+	if !node.file_service_on {
+		return
+	}
+	node.updateMasters()
+	node.DeleteRedundantFile()
+	go node.DuplicateReplica()
+}
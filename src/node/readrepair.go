@@ -0,0 +1,171 @@
+/*
+This file defines the read repair.
+
+A read asks the read quorum of a file for their timestamps and fetches the
+latest copy. The replicas that answered with an older timestamp, or without
+the file, are stale: once the read succeeded, the node asks the replica it
+read from to push its copy, with the old versions, to them in the
+background. A file is repaired by one read at a time. Every node counts the
+reads that started a repair and the replicas repaired or not, see
+GetRepairMetrics and dcli metrics.
+*/
+
+package node
+
+import (
+	"errors"
+	. "slogger"
+	"sync"
+	"time"
+)
+
+var ErrCopyChanged = errors.New("the copy changed since it was read")
+
+type RepairMetrics struct {
+	Reads    int // reads that found stale replicas
+	Repaired int // stale replicas repaired
+	Failed   int // stale replicas that could not be repaired
+}
+
+type PushReplicaArgs struct {
+	SdfsName string
+	Ts       int      // version the reader got
+	Targets  []string // stale replicas
+}
+
+// readRepairer keeps the read repairs of a node
+type readRepairer struct {
+	lock      *sync.Mutex
+	repairing map[string]bool // files being repaired
+	metrics   RepairMetrics
+}
+
+func createReadRepairer() *readRepairer {
+	return &readRepairer{lock: &sync.Mutex{}, repairing: make(map[string]bool)}
+}
+
+// startReadRepair has source push its copy of a file to the stale replicas
+// unless the file is being repaired already
+func (node *Node) startReadRepair(sdfsName, source string, ts int, stale []string) {
+	if len(stale) == 0 || ts == -1 {
+		return
+	}
+	rr := node.readRepairer
+	rr.lock.Lock()
+	if rr.repairing[sdfsName] {
+		rr.lock.Unlock()
+		return
+	}
+	rr.repairing[sdfsName] = true
+	rr.metrics.Reads++
+	rr.lock.Unlock()
+	go func() {
+		repaired, err := CallPushReplica(source, &PushReplicaArgs{sdfsName, ts, stale})
+		if err != nil {
+			SLOG.Printf("[ReadRepair] %s from %s: %v", sdfsName, source, err)
+		} else {
+			SLOG.Printf("[ReadRepair] %s repaired on %d of %v from %s", sdfsName, repaired, stale, source)
+		}
+		rr.lock.Lock()
+		delete(rr.repairing, sdfsName)
+		rr.metrics.Repaired += repaired
+		rr.metrics.Failed += len(stale) - repaired
+		rr.lock.Unlock()
+	}()
+}
+
+// RepairMetrics returns the read repair counters, reset zeroes them
+func (node *Node) RepairMetrics(reset bool) RepairMetrics {
+	rr := node.readRepairer
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	metrics := rr.metrics
+	if reset {
+		rr.metrics = RepairMetrics{}
+	}
+	return metrics
+}
+
+// pushReplica sends the local copy of a file and its old versions to the
+// targets if it is still the version the reader got, it returns the number
+// of targets that stored it. Like pushCopy, the file can not be changed until
+// every send is done, even after a timeout
+func (node *Node) pushReplica(args *PushReplicaArgs) (int, error) {
+	fileInfo := node.FileList.GetFileInfo(args.SdfsName)
+	if fileInfo == nil {
+		return 0, ErrCopyChanged
+	}
+	fileInfo.FileLock.Lock()
+	if fileInfo.Timestamp != args.Ts {
+		fileInfo.FileLock.Unlock()
+		return 0, ErrCopyChanged
+	}
+	info := *fileInfo
+	storeArgs := StoreFileArgs{
+		MasterNodeId: info.MasterNodeID,
+		SdfsName:     info.Sdfsfilename,
+		Ts:           info.Timestamp,
+		Manifest:     info.Manifest,
+		Replication:  info.Replication,
+	}
+	c := make(chan error, len(args.Targets))
+	wg := sync.WaitGroup{}
+	for _, address := range args.Targets {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			err := storeSection(address, &storeArgs, fileSection{info.Localpath, 0, -1})
+			if err == nil {
+				pushVersions(address, info, storeArgs)
+			}
+			c <- err
+		}(address)
+	}
+	go func() {
+		wg.Wait()
+		fileInfo.FileLock.Unlock()
+	}()
+	repaired := 0
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < len(args.Targets); i++ {
+		select {
+		case err := <-c:
+			if err == nil {
+				repaired++
+			} else {
+				SLOG.Printf("[pushReplica] %s: %v", args.SdfsName, err)
+			}
+		case <-timeout:
+			return repaired, errors.New("timeout when repairing " + args.SdfsName)
+		}
+	}
+	return repaired, nil
+}
+
+/* Callee begin */
+func (fileService *FileService) PushReplica(args *PushReplicaArgs, repaired *int) error {
+	n, err := fileService.node.pushReplica(args)
+	*repaired = n
+	return err
+}
+
+func (fileService *FileService) GetRepairMetrics(reset bool, result *RepairMetrics) error {
+	*result = fileService.node.RepairMetrics(reset)
+	return nil
+}
+
+/* Callee end */
+
+/* Caller begin */
+func CallPushReplica(address string, args *PushReplicaArgs) (int, error) {
+	client, err := DialRPC(address)
+	if err != nil {
+		return 0, dialError{err}
+	}
+	defer client.Close()
+	var repaired int
+	err = client.Call(FileServiceName+address+".PushReplica", args, &repaired)
+	return repaired, err
+}
+
+/* Caller end */
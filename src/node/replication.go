@@ -0,0 +1,272 @@
+/*
+This file defines the replication factor and the quorums of a file.
+
+By default a file has DUPLICATE_CNT replicas, and reads and writes wait for
+READ_QUORUM and WRITE_QUORUM of them. A put (or "dcli setrep" afterwards) can
+choose another factor, stored in the FileInfo of every replica. The replicas
+of a file with n copies are the first n of ReplicasOf, so nodes that only know
+the default placement still find the master and ask it.
+*/
+
+package node
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	. "slogger"
+	"time"
+)
+
+const MAX_REPLICAS = 16
+
+var ErrBadReplication = errors.New("replication needs 1 <= quorums <= replicas <= 16 and read + write quorum > replicas")
+
+type Replication struct {
+	Replicas    int // 0 means DUPLICATE_CNT
+	ReadQuorum  int // 0 means replicas - write quorum + 1
+	WriteQuorum int // 0 means a majority of replicas
+}
+
+// FileMeta is what a replica knows about a file besides its content
+type FileMeta struct {
+	Timestamp   int
+	Replication Replication
+	Manifest    bool
+	Checksum    uint32
+	Conflicts   []int // concurrent writes kept as old versions or replaced
+	Size        int64 // of the local copy, the manifest for a file stored in blocks
+}
+
+type SetReplicationArgs struct {
+	SdfsName    string // a file or a directory
+	Replication Replication
+}
+
+// Normalize fills the unset fields with their defaults
+func (r Replication) Normalize() Replication {
+	if r.Replicas <= 0 {
+		r.Replicas = DUPLICATE_CNT
+	}
+	if r.WriteQuorum <= 0 {
+		r.WriteQuorum = r.Replicas/2 + 1
+	}
+	if r.ReadQuorum <= 0 {
+		r.ReadQuorum = r.Replicas - r.WriteQuorum + 1
+	}
+	return r
+}
+
+// reachedWriteQuorum tells if acks of the replicas make a write quorum, all
+// of them do when there are fewer replicas than the quorum. A write nobody
+// acked never does, even without replicas
+func (r Replication) reachedWriteQuorum(acks, replicas int) bool {
+	return acks >= r.Normalize().WriteQuorum || acks > 0 && acks >= replicas
+}
+
+// Validate checks the normalized replication, read and write quorums must
+// overlap so a read sees the latest write
+func (r Replication) Validate() error {
+	r = r.Normalize()
+	if r.Replicas > MAX_REPLICAS || r.ReadQuorum > r.Replicas || r.WriteQuorum > r.Replicas ||
+		r.ReadQuorum+r.WriteQuorum <= r.Replicas {
+		return ErrBadReplication
+	}
+	return nil
+}
+
+// UpdateFileMeta records the replication and kind of a stored file, a zero
+// replication keeps the current one
+func (fl *FileList) UpdateFileMeta(sdfsName string, replication Replication, manifest bool) bool {
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	fileInfo, ok := fl.FileMap[sdfsName]
+	if ok {
+		if replication != (Replication{}) {
+			fileInfo.Replication = replication
+		}
+		fileInfo.Manifest = manifest
+		fl.logPut(fileInfo)
+	}
+	return ok
+}
+
+// GetFileMeta returns the metadata of a file, asking the local file list
+// first, then its default replicas. ok is false if nobody has the file
+func (node *Node) GetFileMeta(sdfsName string) (FileMeta, bool) {
+	if fileInfo := node.FileList.GetFileInfo(sdfsName); fileInfo != nil {
+		return fileInfo.meta(), true
+	}
+	for _, address := range node.GetResponsibleAddresses(sdfsName) {
+		meta, err := CallGetFileMeta(address, sdfsName)
+		if err == nil {
+			return meta, true
+		}
+	}
+	return FileMeta{}, false
+}
+
+func (fileInfo *FileInfo) meta() FileMeta {
+	meta := FileMeta{fileInfo.Timestamp, fileInfo.Replication, fileInfo.Manifest, fileInfo.Checksum, fileInfo.Conflicts, 0}
+	if fi, err := os.Stat(fileInfo.Localpath); err == nil {
+		meta.Size = fi.Size()
+	}
+	return meta
+}
+
+// GetReplication returns the replication of a file, a file nobody has gets
+// the default
+func (node *Node) GetReplication(sdfsName string) Replication {
+	meta, _ := node.GetFileMeta(sdfsName)
+	return meta.Replication.Normalize()
+}
+
+// replicationForPut returns the replication of a put, when the caller leaves
+// it unset an existing file keeps its own
+func (node *Node) replicationForPut(sdfsName string, replication Replication) Replication {
+	if replication != (Replication{}) {
+		return replication.Normalize()
+	}
+	return node.GetReplication(sdfsName)
+}
+
+/* Callee begin */
+func (fileService *FileService) GetLocalFileMeta(sdfsName string, result *FileMeta) error {
+	fileInfo := fileService.node.FileList.GetFileInfo(sdfsName)
+	if fileInfo == nil {
+		return errors.New("file not exist: " + sdfsName)
+	}
+	*result = fileInfo.meta()
+	return nil
+}
+
+func (fileService *FileService) SetReplicationRequest(args *SetReplicationArgs, result *RPCResultType) error {
+	return fileService.node.SetReplicationRequest(args, result)
+}
+
+// SetReplicationRequest changes the replication of a file, or of every file in
+// a directory: replicas in the new set get the latest copy, the others drop it
+func (node *Node) SetReplicationRequest(args *SetReplicationArgs, result *RPCResultType) error {
+	*result = RPC_FAIL
+	if node.IsDegraded() {
+		return ErrNoQuorum
+	}
+	if err := args.Replication.Validate(); err != nil {
+		return err
+	}
+	files := node.listDirFiles(args.SdfsName)
+	if len(files) == 0 {
+		files = []string{args.SdfsName}
+	}
+	for _, sdfsName := range files {
+		if err := node.setFileReplication(sdfsName, args.Replication); err != nil {
+			return err
+		}
+	}
+	*result = RPC_SUCCESS
+	return nil
+}
+
+func (node *Node) setFileReplication(sdfsName string, replication Replication) error {
+	meta, _ := node.GetFileMeta(sdfsName)
+	oldAddresses := node.GetResponsibleAddressesWithReplicas(sdfsName, meta.Replication.Normalize().Replicas)
+	_, ts := node.GetAddressOfLatestTS(sdfsName)
+	if ts == -1 {
+		return errors.New("file not exist: " + sdfsName)
+	}
+	tmpFile, err := ioutil.TempFile("", "setrep")
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	if _, err := node.GetLatestToLocal(sdfsName, tmpFile.Name()); err != nil {
+		return err
+	}
+	replication = replication.Normalize()
+	targetAddresses := node.GetResponsibleAddressesWithReplicas(sdfsName, replication.Replicas)
+	args := &StoreFileArgs{
+		MasterNodeId: node.GetMasterID(sdfsName),
+		SdfsName:     sdfsName,
+		Ts:           ts,
+		Manifest:     meta.Manifest,
+		Replication:  replication,
+	}
+	if meta.Manifest {
+		manifest, err := readManifestFile(tmpFile.Name())
+		if err != nil {
+			return err
+		}
+		for _, block := range manifest.Blocks {
+			if err := node.setFileReplication(block.Name, replication); err != nil {
+				return err
+			}
+		}
+	}
+	c := make(chan int, len(targetAddresses))
+	isTarget := make(map[string]bool)
+	for _, addr := range targetAddresses {
+		isTarget[addr] = true
+		go PutLocalFile(addr, args, tmpFile.Name(), c)
+	}
+	// wait for every target, the copy is removed on return
+	acks := 0
+	for i := 0; i < len(targetAddresses); i++ {
+		select {
+		case ack := <-c:
+			if RPCResultType(ack) != RPC_FAIL {
+				acks++
+			}
+		case <-time.After(10 * time.Second):
+			SLOG.Printf("[SetReplication] waiting too long when storing file: %s", sdfsName)
+			return errors.New("timeout when storing " + sdfsName)
+		}
+	}
+	// the old replicas keep their copies unless the new ones have it
+	if !replication.reachedWriteQuorum(acks, len(targetAddresses)) {
+		SLOG.Printf("[SetReplication] %s stored on %d of %d replicas", sdfsName, acks, len(targetAddresses))
+		return ErrNoWriteQuorum
+	}
+	extra := 0
+	deleted := make(chan string, len(oldAddresses))
+	for _, addr := range oldAddresses {
+		if !isTarget[addr] {
+			extra++
+			go DeleteFile(addr, sdfsName, deleted)
+		}
+	}
+	removed := 0
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < extra; i++ {
+		select {
+		case addr := <-deleted:
+			if addr != "" {
+				removed++
+			}
+		case <-timeout:
+			i = extra
+		}
+	}
+	if removed < extra {
+		SLOG.Printf("[SetReplication] %s deleted on %d of %d old replicas", sdfsName, removed, extra)
+		return errors.New("fail to delete the extra copies of " + sdfsName)
+	}
+	SLOG.Printf("[SetReplication] %s has %d replicas", sdfsName, replication.Replicas)
+	return nil
+}
+
+/* Callee end */
+
+/* Caller begin */
+func CallGetFileMeta(address, sdfsName string) (FileMeta, error) {
+	var meta FileMeta
+	client, err := DialRPC(address)
+	if err != nil {
+		return meta, dialError{err}
+	}
+	defer client.Close()
+	err = client.Call(FileServiceName+address+".GetLocalFileMeta", sdfsName, &meta)
+	return meta, err
+}
+
+/* Caller end */
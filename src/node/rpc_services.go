@@ -11,13 +11,15 @@ Includes:
 package node
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/rpc"
 	"os"
 	"path/filepath"
 	. "slogger"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -41,15 +43,23 @@ type PutFileArgs struct {
 	ForceUpdate bool
 	Appending   bool
 	Tmp         bool
+	Replication Replication // zero keeps the replication of an existing file
 }
 
 type StoreFileArgs struct {
 	MasterNodeId int
 	SdfsName     string
 	Ts           int
+	PrevTs       int // version the put was based on, -1 for a new file, 0 skips the conflict check
 	Content      []byte
 	Appending    bool
+	Offset       int64 // where an append starts on the replica, ORDER_APPEND lets the receiver order it
 	Tmp          bool
+	Manifest     bool
+	OldVersion   bool // Ts is an old version to keep, not the current one
+	Stage        int  // id of the copy the content is staged for, 0 stores it
+	Replication  Replication
+	Checksum     uint32 // crc32c of Content, 0 skips the check
 }
 
 const (
@@ -57,6 +67,7 @@ const (
 	RPC_DUMMY      RPCResultType = 1 << 1
 	RPC_FAIL       RPCResultType = 1 << 2
 	RPC_PROMPT     RPCResultType = 1 << 3
+	RPC_CONFLICT   RPCResultType = 1 << 4 // stored, but raced with another write
 	FILES_ROOT_DIR               = "/apps/files"
 )
 
@@ -70,9 +81,10 @@ func (node *Node) RegisterFileService(address string) error {
 
 func (node *Node) StartRPCService() {
 	node.RegisterFileService(node.IP + ":" + node.RPC_Port)
+	node.RegisterMembershipService(node.IP + ":" + node.RPC_Port)
 	node.RegisterRPCMapleJuiceService()
-	// go node.StartTCPService()
-	listener, err := net.Listen("tcp", "0.0.0.0:"+node.RPC_Port)
+	go node.StartTCPService()
+	listener, err := ListenRPC("0.0.0.0:" + node.RPC_Port)
 	if err != nil {
 		SLOG.Fatal("ListenTCP error:", err)
 	}
@@ -93,6 +105,16 @@ func (fileService *FileService) PutFileRequest(args *PutFileArgs, result *RPCRes
 	return fileService.node.PutFileRequest(args, result)
 }
 func (node *Node) PutFileRequest(args *PutFileArgs, result *RPCResultType) error {
+	if node.IsDegraded() {
+		*result = RPC_FAIL
+		return ErrNoQuorum
+	}
+	if args.Replication != (Replication{}) {
+		if err := args.Replication.Validate(); err != nil {
+			*result = RPC_FAIL
+			return err
+		}
+	}
 	fstat, err := os.Stat(args.LocalName)
 	if err != nil {
 		SLOG.Print(err)
@@ -112,7 +134,7 @@ func (node *Node) PutFileRequest(args *PutFileArgs, result *RPCResultType) error
 			} else {
 				sdfsFileName = filepath.Join(args.SdfsName, file.Name()) // Now we need to store a dir in SDFS
 			}
-			err := node.IndividualPutFileRequest(sdfsFileName, localFilename, true, args.Appending, args.Tmp, result)
+			err := node.IndividualPutFileRequest(sdfsFileName, localFilename, true, args.Appending, args.Tmp, args.Replication, result)
 			if err != nil {
 				SLOG.Printf("err individual put")
 				return err
@@ -120,18 +142,31 @@ func (node *Node) PutFileRequest(args *PutFileArgs, result *RPCResultType) error
 		}
 		return nil
 	} else {
-		return node.IndividualPutFileRequest(args.SdfsName, args.LocalName, args.ForceUpdate, args.Appending, args.Tmp, result)
+		return node.IndividualPutFileRequest(args.SdfsName, args.LocalName, args.ForceUpdate, args.Appending, args.Tmp, args.Replication, result)
 	}
 }
 
-func (node *Node) IndividualPutFileRequest(sdfsName, localName string, forceUpdate, appending, tmp bool, result *RPCResultType) error {
-	if !forceUpdate {
-		_, ts := node.GetAddressOfLatestTS(sdfsName)
-		if (GetMillisecond() - ts) < MIN_UPDATE_INTERVAL {
+func (node *Node) IndividualPutFileRequest(sdfsName, localName string, forceUpdate, appending, tmp bool, replication Replication, result *RPCResultType) error {
+	if !tmp && isReservedName(sdfsName) {
+		*result = RPC_FAIL
+		return ErrBadName
+	}
+	prevTs := 0
+	if !tmp {
+		_, prevTs = node.GetAddressOfLatestTS(sdfsName)
+		node.Clock.Update(prevTs)
+		if !forceUpdate && (GetMillisecond()-HLCWall(prevTs)) < MIN_UPDATE_INTERVAL {
 			*result = RPC_PROMPT
 			return nil
 		}
 	}
+	if !tmp && prevTs == -1 {
+		defer func() {
+			if *result == RPC_SUCCESS || *result == RPC_CONFLICT {
+				node.addToNamespace(sdfsName)
+			}
+		}()
+	}
 	toHash := sdfsName
 	if tmp {
 		// if it's tmp file, we need to truncate the tail, which is a metadata
@@ -141,36 +176,83 @@ func (node *Node) IndividualPutFileRequest(sdfsName, localName string, forceUpda
 		}
 		toHash = splitted[0]
 	}
-	targetAddresses := node.GetResponsibleAddresses(toHash)
-	masterId := node.GetMasterID(toHash)
-
-	ts := GetMillisecond()
-	data, err := ioutil.ReadFile(localName)
+	fstat, err := os.Stat(localName)
 	if err != nil {
 		SLOG.Println(err)
 		*result = RPC_FAIL
 		return err
 	}
-	args := &StoreFileArgs{masterId, sdfsName, ts, data, appending, tmp}
-	c := make(chan int, DUPLICATE_CNT)
-	for _, addr := range targetAddresses {
-		// TCPAddr := strings.Split(addr, ":")[0] + ":" + TCP_FILE_PORT
-		PutFile(addr, args, c)
+	if tmp {
+		replication = replication.Normalize()
+	} else {
+		replication = node.replicationForPut(sdfsName, replication)
 	}
-	for i := 0; i < WRITE_QUORUM && i < len(targetAddresses); i++ {
-		select {
-		case <-c:
-			continue
-		case <-time.After(10 * time.Second):
-			SLOG.Printf("[WTF] waiting too long when putting file: %s", localName)
+	args := &StoreFileArgs{
+		SdfsName:    sdfsName,
+		Appending:   appending,
+		Tmp:         tmp,
+		Replication: replication,
+	}
+	if !appending {
+		args.PrevTs = prevTs
+	}
+	whole := fileSection{localName, 0, -1}
+	if tmp {
+		return node.replicateSection(toHash, args, whole, result)
+	}
+	oldBlocks, err := node.manifestBlocks(sdfsName)
+	if err != nil {
+		*result = RPC_FAIL
+		return err
+	}
+	if appending {
+		if oldBlocks != nil {
 			*result = RPC_FAIL
-			return err
+			return ErrAppendToBlocks
 		}
+		return node.appendSection(toHash, args, whole, result)
+	}
+	if node.BlockSize > 0 && fstat.Size() > node.BlockSize {
+		return node.putBlockedFile(args, localName, oldBlocks, result)
+	}
+	err = node.replicateSection(toHash, args, whole, result)
+	if err == nil && *result == RPC_SUCCESS {
+		node.deleteBlocks(oldBlocks)
 	}
-	*result = RPC_SUCCESS
 	return err
 }
 
+// replicateSection stores a section of a local file on the replicas of toHash
+// and waits for the write quorum
+func (node *Node) replicateSection(toHash string, args *StoreFileArgs, section fileSection, result *RPCResultType) error {
+	targetAddresses := node.GetResponsibleAddressesWithReplicas(toHash, args.Replication.Replicas)
+	args.MasterNodeId = node.GetMasterID(toHash)
+	args.Ts = node.Clock.Now(node.Id)
+	acks := 0
+	conflict := false
+	for _, addr := range targetAddresses {
+		switch storeAck(node.storeOrHint(addr, toHash, args, section)) {
+		case RPC_CONFLICT:
+			conflict = true
+			acks++
+		case RPC_SUCCESS:
+			acks++
+		}
+	}
+	// replicas kept as hints do not count
+	if !args.Replication.reachedWriteQuorum(acks, len(targetAddresses)) {
+		SLOG.Printf("[replicateSection] %s stored on %d of %d replicas", args.SdfsName, acks, len(targetAddresses))
+		*result = RPC_FAIL
+		return ErrNoWriteQuorum
+	}
+	*result = RPC_SUCCESS
+	if conflict {
+		SLOG.Printf("[replicateSection] put of %s at %d raced with another write", args.SdfsName, args.Ts)
+		*result = RPC_CONFLICT
+	}
+	return nil
+}
+
 // Executed in coordinator
 func (fileService *FileService) GetFileRequest(args []string, result *RPCResultType) error {
 	return fileService.node.GetFileRequest(args, result)
@@ -178,14 +260,15 @@ func (fileService *FileService) GetFileRequest(args []string, result *RPCResultT
 func (node *Node) GetFileRequest(args []string, result *RPCResultType) error {
 	sdfsName := args[0]
 	localPath := args[1]
-	file_addr, _ := node.GetAddressOfLatestTS(sdfsName)
-	var data []byte
-	err := GetFile(file_addr, sdfsName, &data)
-	if err != nil {
-		*result = RPC_FAIL
-		return err
+	version := 0
+	if len(args) > 2 {
+		var err error
+		if version, err = strconv.Atoi(args[2]); err != nil {
+			*result = RPC_FAIL
+			return err
+		}
 	}
-	err = ioutil.WriteFile(localPath, data, 0777)
+	err := node.FetchVersion(sdfsName, version, localPath)
 	if err != nil {
 		SLOG.Println(localPath, err)
 		*result = RPC_FAIL
@@ -195,18 +278,54 @@ func (node *Node) GetFileRequest(args []string, result *RPCResultType) error {
 	return nil
 }
 
-func (fileService *FileService) ListFileInDirRequest(sdfsDir string, res *[]string) error {
-	*res = fileService.node.ListFileInDirRequest(sdfsDir)
-	return nil
+func (fileService *FileService) ListFileInDirRequest(sel *Selector, res *[]string) error {
+	names, err := fileService.node.ListFileInDirRequest(*sel)
+	*res = names
+	return err
 }
 
-func (node *Node) ListFileInDirRequest(sdfsDir string) []string {
+// ListFileInDirRequest lists the files in a sdfs dir, or the files sel
+// selects. Blocks of large files are hidden
+func (node *Node) ListFileInDirRequest(sel Selector) ([]string, error) {
+	if sel.Selects() {
+		return node.SelectFiles(sel)
+	}
+	return node.listDirFiles(sel.Pattern), nil
+}
+
+// listDirFiles merges the entries of the namespace with the files every
+// member has in the dir, which are not all in the namespace
+func (node *Node) listDirFiles(sdfsDir string) []string {
+	fileSet := make(map[string]bool)
+	if entries, err := node.ListDir(sdfsDir, false); err == nil {
+		for _, path := range entries {
+			if !strings.HasSuffix(path, "/") {
+				fileSet[path] = true
+			}
+		}
+	}
+	for _, sdfsName := range node.listSDFSDir(scanDir(sdfsDir)) {
+		if !IsBlockName(sdfsName) {
+			fileSet[sdfsName] = true
+		}
+	}
+	res := []string{}
+	for sdfsName := range fileSet {
+		res = append(res, sdfsName)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (node *Node) listSDFSDir(sdfsDir string) []string {
 	fileSet := make(map[string]bool)
 	for _, memNode := range node.MbList.Member_map {
 		address := memNode.Ip + ":" + memNode.RPC_Port
 		filelists := ListFileInSDFSDir(address, sdfsDir)
 		for _, f := range filelists {
-			fileSet[f] = true
+			if !IsDirObject(f) {
+				fileSet[f] = true
+			}
 		}
 	}
 	res := []string{}
@@ -216,13 +335,20 @@ func (node *Node) ListFileInDirRequest(sdfsDir string) []string {
 	return res
 }
 
-func (node *Node) ListFilesWithPrefixRequest(prefix string) []string {
+// ListFilesWithPrefixRequest lists the files whose name starts with the name
+// of sel, or the files sel selects. Blocks of large files are hidden
+func (node *Node) ListFilesWithPrefixRequest(sel Selector) ([]string, error) {
+	if sel.Selects() {
+		return node.SelectFiles(sel)
+	}
 	fileSet := make(map[string]bool)
 	for _, memNode := range node.MbList.Member_map {
 		address := memNode.Ip + ":" + memNode.RPC_Port
-		fileLists := ListFilesWithPrefixInNode(address, prefix)
+		fileLists := ListFilesWithPrefixInNode(address, sel.Pattern)
 		for _, f := range fileLists {
-			fileSet[f] = true
+			if !isReservedName(f) {
+				fileSet[f] = true
+			}
 		}
 	}
 
@@ -230,15 +356,32 @@ func (node *Node) ListFilesWithPrefixRequest(prefix string) []string {
 	for sdfsName, _ := range fileSet {
 		res = append(res, sdfsName)
 	}
-	return res
+	sort.Strings(res)
+	return res, nil
 }
 
-func (fileService *FileService) DeleteSDFSDirRequest(sdfsdir string, result *RPCResultType) error {
+func (fileService *FileService) DeleteSDFSDirRequest(sel *Selector, result *RPCResultType) error {
 	*result = RPC_SUCCESS
-	return fileService.node.DeleteSDFSDirRequest(sdfsdir)
+	return fileService.node.DeleteSDFSDirRequest(*sel)
 }
 
-func (node *Node) DeleteSDFSDirRequest(sdfsdir string) error {
+// DeleteSDFSDirRequest deletes a dir with its subdirs, with the files that
+// are not in the namespace, or the files sel selects. A dir missing from the
+// namespace is deleted by every member
+func (node *Node) DeleteSDFSDirRequest(sel Selector) error {
+	if node.IsDegraded() {
+		return ErrNoQuorum
+	}
+	if sel.Selects() {
+		return node.deleteSelected(sel)
+	}
+	sdfsdir := sel.Pattern
+	if _, ts, err := node.readDir(CleanPath(sdfsdir)); err == nil && ts != -1 {
+		if err := node.deleteDirTree(CleanPath(sdfsdir)); err != nil {
+			return err
+		}
+		return node.deleteUnlisted(CleanPath(sdfsdir))
+	}
 	for _, memNode := range node.MbList.Member_map {
 		address := memNode.Ip + ":" + memNode.RPC_Port
 		err := DeleteSDFSDir(address, sdfsdir)
@@ -251,30 +394,63 @@ func (node *Node) DeleteSDFSDirRequest(sdfsdir string) error {
 }
 
 func (fileService *FileService) DeleteFileRequest(sdfsName string, result *RPCResultType) error {
-	targetAddresses := fileService.node.GetResponsibleAddresses(sdfsName)
-	c := make(chan string, DUPLICATE_CNT)
+	return fileService.node.DeleteFileRequest(sdfsName, result)
+}
+
+func (node *Node) DeleteFileRequest(sdfsName string, result *RPCResultType) error {
+	if node.IsDegraded() {
+		*result = RPC_FAIL
+		return ErrNoQuorum
+	}
+	blocks, err := node.manifestBlocks(sdfsName)
+	if err != nil {
+		*result = RPC_FAIL
+		return err
+	}
+	node.deleteFile(sdfsName, result)
+	if *result == RPC_SUCCESS {
+		node.deleteBlocks(blocks)
+		if !isReservedName(sdfsName) {
+			node.removeFromNamespace(sdfsName, false)
+		}
+	}
+	return nil
+}
+
+// deleteFile removes a file from all its replicas, after the hints of it
+func (node *Node) deleteFile(sdfsName string, result *RPCResultType) {
+	node.cancelHints(sdfsName)
+	replication := node.GetReplication(sdfsName)
+	targetAddresses := node.GetResponsibleAddressesWithReplicas(sdfsName, replication.Replicas)
+	c := make(chan string, len(targetAddresses))
 	for _, addr := range targetAddresses {
 		go DeleteFile(addr, sdfsName, c)
 	}
 	received := []string{}
-	for i := 0; i < DUPLICATE_CNT && i < len(targetAddresses); i++ {
+	for i := 0; i < len(targetAddresses); i++ {
 		select {
 		case addr := <-c:
-			received = append(received, addr)
+			if addr != "" {
+				received = append(received, addr)
+			}
 			continue
 		case <-time.After(5 * time.Second):
 			SLOG.Printf("[WTF] waiting too long when deleting file: %s, responding servers: %v", sdfsName, received)
 			*result = RPC_FAIL
-			return nil
+			return
 		}
 	}
+	if len(received) < len(targetAddresses) {
+		SLOG.Printf("[deleteFile] %s deleted on %v of %v", sdfsName, received, targetAddresses)
+		*result = RPC_FAIL
+		return
+	}
 	*result = RPC_SUCCESS
-	return nil
-
 }
 
 func (fileService *FileService) Ls(sdfsfilename string, hostnames *[]string) error {
-	addressList := fileService.node.GetResponsibleAddresses(sdfsfilename)
+	replication := fileService.node.GetReplication(sdfsfilename)
+	addressList := fileService.node.GetResponsibleAddressesWithReplicas(sdfsfilename, replication.Replicas)
 	hosts := []string{}
 	for _, addr := range addressList {
 		host := CheckFile(sdfsfilename, addr)
@@ -292,6 +468,44 @@ func (fileService *FileService) GetTimeStamp(sdfsFileName string, timestamp *int
 }
 
 func (fileService *FileService) StoreFileToLocal(args *StoreFileArgs, result *RPCResultType) error {
+	*result = RPC_FAIL
+	if args.Checksum != 0 && Checksum(args.Content) != args.Checksum {
+		return ErrChecksum
+	}
+	fileService.node.Clock.Update(args.Ts)
+	if args.Stage != 0 {
+		err := fileService.node.stageFromReader(args, bytes.NewReader(args.Content))
+		if err == nil {
+			*result = RPC_SUCCESS
+		}
+		return err
+	}
+	if args.Appending && args.Offset == ORDER_APPEND {
+		err := fileService.node.orderAppend(args, bytes.NewReader(args.Content))
+		if err == nil {
+			*result = RPC_SUCCESS
+		}
+		return err
+	}
+	if args.OldVersion {
+		err := fileService.node.FileList.StoreVersionFromReader(args.SdfsName, args.Ts, bytes.NewReader(args.Content))
+		if err == nil {
+			*result = RPC_SUCCESS
+		}
+		return err
+	}
+	other := fileService.node.concurrentWrite(args)
+	if other > args.Ts {
+		return fileService.node.storeLosingWrite(args, bytes.NewReader(args.Content))
+	}
+	if err := fileService.node.checkStaleWrite(args); err != nil {
+		return err
+	}
+	if args.Appending && !args.Tmp {
+		if err := fileService.node.checkAppendOffset(args); err != nil {
+			return err
+		}
+	}
 	var err error
 	if args.Tmp {
 		err = fileService.node.FileList.StoreTmpFile(args.SdfsName, fileService.node.Root_dir, args.Ts, args.MasterNodeId, args.Content)
@@ -300,6 +514,10 @@ func (fileService *FileService) StoreFileToLocal(args *StoreFileArgs, result *RP
 	} else {
 		err = fileService.node.FileList.StoreFile(args.SdfsName, fileService.node.Root_dir, args.Ts, args.MasterNodeId, args.Content)
 	}
+	if err == nil {
+		fileService.node.FileList.UpdateFileMeta(args.SdfsName, args.Replication, args.Manifest)
+		err = fileService.node.settleWrite(args, other)
+	}
 
 	if err != nil {
 		SLOG.Println(err)
@@ -356,7 +574,7 @@ func (fileService *FileService) DeleteSDFSDir(dir string, result *RPCResultType)
 /* Caller begin */
 
 func ListFileInSDFSDir(address, dir string) []string {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		SLOG.Printf("[ListFileInSDFSDir] Dial failed, address: %s", address)
 		return []string{}
@@ -371,7 +589,7 @@ func ListFileInSDFSDir(address, dir string) []string {
 }
 
 func ListFilesWithPrefixInNode(address, prefix string) []string {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		SLOG.Printf("[ListFilesWithPrefix] Dial failed, address: %s", address)
 		return []string{}
@@ -385,55 +603,42 @@ func ListFilesWithPrefixInNode(address, prefix string) []string {
 	return result
 }
 
+// PutFile stores args.Content on a replica and sends its ack to c, RPC_FAIL
+// if it could not store it
 func PutFile(address string, args *StoreFileArgs, c chan int) {
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
+	err := callStoreFile(address, args)
+	if _, unreachable := err.(dialError); unreachable {
 		SLOG.Printf("[PutFile] Dial failed, address: %s", address)
-		c <- 1
-		// when two node failed, some putfile may not be able to dial, so file is not send to them.
-		// but duplicate will fix this issue so we still send ack to channel and pretend it succeed
-		// so other put job will proceed.
-		return
+	} else if err != nil && err != ErrConflict {
+		SLOG.Println("send_err:", err)
+	}
+	c <- int(storeAck(err))
+}
+
+// storeAck is the ack of a replica that returned err for a store, a
+// conflict is stored too
+func storeAck(err error) RPCResultType {
+	if err == nil {
+		return RPC_SUCCESS
+	}
+	if err == ErrConflict {
+		return RPC_CONFLICT
+	}
+	return RPC_FAIL
+}
+
+func callStoreFile(address string, args *StoreFileArgs) error {
+	client, err := DialRPC(address)
+	if err != nil {
+		return dialError{err}
 	}
 	defer client.Close()
 	var reply RPCResultType
-	send_err := client.Call(FileServiceName+address+".StoreFileToLocal", args, &reply)
-	if send_err != nil {
-		SLOG.Println("send_err:", send_err)
-	}
-	// SLOG.Printf("[PutFile] destination: %s, filename: %s", address, args.SdfsName)
-	c <- 1
-}
-
-// func PutFile(address string, args *StoreFileArgs, c chan int) {
-// 	conn, err := net.Dial("tcp", address)
-// 	if err != nil {
-// 		SLOG.Printf("[PutFile] Dial failed, address: %s", address)
-// 		return
-// 	}
-// 	defer conn.Close()
-// 	conn.Write([]byte("PUT\n"))
-// 	conn.Write([]byte(fmt.Sprintf("%d\n", args.MasterNodeId)))
-// 	conn.Write([]byte(args.SdfsName + "\n"))
-// 	conn.Write([]byte(fmt.Sprintf("%d\n", args.Ts)))
-// 	conn.Write([]byte(fmt.Sprintf("%t\n", args.Appending)))
-// 	for i := 0; i < len(args.Content); i += TCPBufferSize {
-// 		end := i + TCPBufferSize
-// 		if i+TCPBufferSize > len(args.Content) {
-// 			end = len(args.Content)
-// 		}
-// 		sendBuffer := args.Content[i:end]
-// 		conn.Write(sendBuffer)
-// 		if end >= len(args.Content) {
-// 			break
-// 		}
-// 	}
-// 	// SLOG.Printf("[PutFile] destination: %s, filename: %s", address, args.SdfsName)
-// 	c <- 1
-// }
+	return remoteError(client.Call(FileServiceName+address+".StoreFileToLocal", args, &reply))
+}
 
 func CheckFile(sdfsfilename, address string) string {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		SLOG.Printf("[CheckFile] Dial failed, address: %s", address)
 		return ""
@@ -449,21 +654,33 @@ func CheckFile(sdfsfilename, address string) string {
 }
 
 func GetFile(address, sdfsfilename string, data *[]byte) error {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
-	send_err := client.Call(FileServiceName+address+".ServeLocalFile", sdfsfilename, data)
+	send_err := remoteError(client.Call(FileServiceName+address+".ServeLocalFile", sdfsfilename, data))
 	if send_err != nil {
 		SLOG.Println("send_err:", send_err)
 	}
 	return send_err
 }
 
+func GetVersion(address, sdfsfilename string, version int, data *[]byte) error {
+	client, err := DialRPC(address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return remoteError(client.Call(FileServiceName+address+".ServeLocalVersion", &VersionArgs{sdfsfilename, version}, data))
+}
+
+// DeleteFile deletes a file on a replica, it sends the address to c once the
+// copy is gone and an empty one if it is not
 func DeleteFile(address, sdfsName string, c chan string) error {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
+		c <- ""
 		return err
 	}
 	defer client.Close()
@@ -471,6 +688,7 @@ func DeleteFile(address, sdfsName string, c chan string) error {
 	err = client.Call(FileServiceName+address+".DeleteLocalFile", sdfsName, &result)
 	if err != nil || result == RPC_FAIL {
 		SLOG.Printf("Delete File Failure, address: %s, sdfsName: %s", address, sdfsName)
+		c <- ""
 		return err
 	}
 	c <- address
@@ -478,7 +696,7 @@ func DeleteFile(address, sdfsName string, c chan string) error {
 }
 
 func DeleteSDFSDir(address, dir string) error {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		return err
 	}
@@ -489,7 +707,7 @@ func DeleteSDFSDir(address, dir string) error {
 }
 
 func CallGetTimeStamp(address, sdfsFileName string, c chan Pair) {
-	client, err := rpc.Dial("tcp", address)
+	client, err := DialRPC(address)
 	if err != nil {
 		SLOG.Printf("[CallGetTimeStamp] fail to dial %s", address)
 		return
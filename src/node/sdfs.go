@@ -2,7 +2,6 @@ package node
 
 import (
 	"hash/fnv"
-	"io/ioutil"
 	"os"
 	. "slogger"
 	"time"
@@ -25,6 +24,7 @@ func (node *Node) SetFileDir(dir string) {
 		SLOG.Printf("Failed to create folder: %s", dir)
 		os.Exit(1)
 	}
+	node.loadHints()
 }
 
 func IsInCircleRange(id, start, end int) bool {
@@ -37,32 +37,17 @@ func IsInCircleRange(id, start, end int) bool {
 }
 
 func (node *Node) GetMasterID(sdfsfilename string) int {
-	fileHashID := getHashID(sdfsfilename)
-	var prevId int = -1
-	for curId, _ := range node.MbList.Member_map {
-		prevId = node.MbList.GetNode(curId).GetPrevNode().Id
-		if prevId == curId {
-			return curId
-		} else if IsInCircleRange(fileHashID, prevId+1, curId) {
-			return curId
-		}
+	masterID := node.masterIdForHash(getHashID(sdfsfilename))
+	if masterID == -1 {
+		SLOG.Fatal("[Fatal] Fail to get master id")
 	}
-	SLOG.Fatal("[Fatal] Fail to get master id")
-	return -1
+	return masterID
 }
 
+// GetFirstKReplicaNodeID returns the master and the nodes holding the other
+// replicas, see placement.go
 func (node *Node) GetFirstKReplicaNodeID(sdfsfilename string, K int) []int {
-	masterID := node.GetMasterID(sdfsfilename)
-	res := []int{masterID}
-	cur := node.MbList.Member_map[masterID]
-	for i := 0; i < K-1; i++ {
-		if cur.next.Id == masterID {
-			break
-		}
-		res = append(res, cur.next.Id)
-		cur = cur.next
-	}
-	return res
+	return node.MbList.ReplicasOf(node.GetMasterID(sdfsfilename), getHashID(sdfsfilename), K)
 }
 
 func (node *Node) GetAddressesWithIds(ids []int) []string {
@@ -74,7 +59,11 @@ func (node *Node) GetAddressesWithIds(ids []int) []string {
 }
 
 func (node *Node) GetResponsibleAddresses(sdfsfilename string) []string {
-	ids := node.GetFirstKReplicaNodeID(sdfsfilename, DUPLICATE_CNT)
+	return node.GetResponsibleAddressesWithReplicas(sdfsfilename, DUPLICATE_CNT)
+}
+
+func (node *Node) GetResponsibleAddressesWithReplicas(sdfsfilename string, replicas int) []string {
+	ids := node.GetFirstKReplicaNodeID(sdfsfilename, replicas)
 	return node.GetAddressesWithIds(ids)
 }
 
@@ -89,16 +78,27 @@ func (node *Node) GetResponsibleHostname(sdfsName string) []string {
 }
 
 func (node *Node) GetAddressOfLatestTS(sdfsfilename string) (string, int) {
-	addressList := node.GetResponsibleAddresses(sdfsfilename)
-	c := make(chan Pair, 4)
+	address, ts, _ := node.getLatestReplicas(sdfsfilename)
+	return address, ts
+}
+
+// getLatestReplicas asks the read quorum of a file for their timestamps, it
+// returns the replica with the latest one, its timestamp, and the replicas
+// that answered with an older one or without the file
+func (node *Node) getLatestReplicas(sdfsfilename string) (string, int, []string) {
+	replication := node.GetReplication(sdfsfilename)
+	addressList := node.GetResponsibleAddressesWithReplicas(sdfsfilename, replication.Replicas)
+	c := make(chan Pair, len(addressList))
 	for _, address := range addressList {
 		go CallGetTimeStamp(address, sdfsfilename, c)
 	}
 	max_timestamp := -1
 	max_address := ""
-	for i := 0; i < READ_QUORUM && i < len(addressList); i++ {
+	answers := []Pair{}
+	for i := 0; i < replication.ReadQuorum && i < len(addressList); i++ {
 		select {
 		case pair := <-c:
+			answers = append(answers, pair)
 			address := pair.Address
 			timestamp := pair.Ts
 			if timestamp == -1 {
@@ -113,32 +113,39 @@ func (node *Node) GetAddressOfLatestTS(sdfsfilename string) (string, int) {
 		}
 
 	}
-	return max_address, max_timestamp
+	stale := []string{}
+	for _, pair := range answers {
+		if pair.Ts < max_timestamp {
+			stale = append(stale, pair.Address)
+		}
+	}
+	return max_address, max_timestamp, stale
 }
 
 func (node *Node) DeleteRedundantFile() {
-	prev_k_nodes := node.MbList.GetPrevKNodes(node.Id, DUPLICATE_CNT)
-	if len(prev_k_nodes) == DUPLICATE_CNT {
-		prev_k := prev_k_nodes[DUPLICATE_CNT-1]
-		toDelete := node.FileList.DeleteFileInfosOutOfRange(prev_k.Id, node.Id)
-		for _, path := range toDelete {
-			err := os.Remove(path)
-			if err != nil {
-				SLOG.Printf("Fail to remove file %s", path)
-				SLOG.Panicln(err)
-			}
+	toDelete := node.FileList.DeleteFileInfosIf(func(fileInfo *FileInfo) bool {
+		return !node.isReplicaOf(fileInfo.HashID, fileInfo.Replication.Normalize().Replicas)
+	})
+	for _, path := range toDelete {
+		err := os.Remove(path)
+		if err != nil {
+			SLOG.Printf("Fail to remove file %s", path)
+			SLOG.Panicln(err)
 		}
 	}
 }
 
 func (node *Node) DuplicateReplica() {
 	ownedFileInfos := node.FileList.GetOwnedFileInfos(node.Id)
-	targetsRPCAddr := node.MbList.GetRPCAddressesForNextKNodes(node.Id, DUPLICATE_CNT-1)
 	for _, info := range ownedFileInfos {
 		if info.Tmp {
 			continue
 		}
-		node.SendFileIfNecessary(info, targetsRPCAddr)
+		replicaIds := node.MbList.ReplicasOf(node.Id, info.HashID, info.Replication.Normalize().Replicas)
+		if len(replicaIds) == 0 {
+			continue // this node left
+		}
+		node.SendFileIfNecessary(info, node.GetAddressesWithIds(replicaIds[1:]))
 	}
 }
 
@@ -149,18 +156,27 @@ func (node *Node) SendFileIfNecessary(info FileInfo, targetRPCAddr []string) {
 		go CallGetTimeStamp(addr, info.Sdfsfilename, c)
 	}
 
-	data, err := ioutil.ReadFile(info.Localpath)
-	if err != nil {
-		SLOG.Printf("[Node %d] Fail to read file: %s", node.Id, info.Localpath)
-		return
+	args := StoreFileArgs{
+		MasterNodeId: info.MasterNodeID,
+		SdfsName:     info.Sdfsfilename,
+		Ts:           info.Timestamp,
+		Manifest:     info.Manifest,
+		Replication:  info.Replication,
 	}
-	args := StoreFileArgs{info.MasterNodeID, info.Sdfsfilename, info.Timestamp, data, false, false}
 	dummy_chan := make(chan int, L)
 	for i := 0; i < L; i++ {
 		select {
 		case p := <-c:
 			if p.Ts < info.Timestamp {
-				go PutFile(p.Address, &args, dummy_chan)
+				go func(address string) {
+					c := make(chan int, 1)
+					PutLocalFile(address, &args, info.Localpath, c)
+					// the old versions only follow a stored current one
+					if RPCResultType(<-c) == RPC_SUCCESS {
+						pushVersions(address, info, args)
+					}
+					dummy_chan <- 1
+				}(p.Address)
 			}
 		case <-time.After(1 * time.Second):
 			SLOG.Printf("[Node %d] Timeout when trying to get timestamp", node.Id)
@@ -0,0 +1,139 @@
+/*
+This file defines the selection of sdfs files by a glob or a regex.
+
+A selector matches whole sdfs names. A glob has the syntax of path.Match, so
+* and ? do not match a /, like logs/2019-0?/vm*.log. A regex has the syntax
+of regexp and must match the whole name. The node asked for a selection sends
+the selector to every member, which matches it against its own file list, so
+only the matching names travel over the network. Directory objects, blocks
+and MapleJuice tmp files are never selected.
+
+Listing a directory, listing the juice input by prefix and deleting a
+directory take a selector too, where a plain name keeps its usual meaning. A
+name with *, ? or [ is taken as it is with Literal, or matched exactly by a
+glob that escapes them with a \.
+*/
+
+package node
+
+import (
+	"path"
+	"regexp"
+	. "slogger"
+	"sort"
+	"strings"
+)
+
+type Selector struct {
+	Pattern string
+	Regex   bool // a glob otherwise
+	Literal bool // Pattern is a plain name, even with *, ? or [
+}
+
+// IsGlob tells if a name given to dcli is a glob rather than a sdfs name
+func IsGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Selects tells if the selector stands for the files it matches, otherwise
+// Pattern is a plain name
+func (sel Selector) Selects() bool {
+	return sel.Regex || !sel.Literal && IsGlob(sel.Pattern)
+}
+
+// matcher compiles the selector, a bad pattern is an error
+func (sel Selector) matcher() (func(string) bool, error) {
+	if sel.Regex {
+		re, err := regexp.Compile("^(?:" + sel.Pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(sel.Pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(sdfsName string) bool {
+		ok, _ := path.Match(sel.Pattern, sdfsName)
+		return ok
+	}, nil
+}
+
+// SelectFiles returns the local files accepted by match
+func (fl *FileList) SelectFiles(match func(string) bool) []string {
+	res := []string{}
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	for sdfsName, fileInfo := range fl.FileMap {
+		if !fileInfo.Tmp && !IsDirObject(sdfsName) && !IsBlockName(sdfsName) && match(sdfsName) {
+			res = append(res, sdfsName)
+		}
+	}
+	return res
+}
+
+// SelectFiles lists the sdfs files matching a selector, sorted by name
+func (node *Node) SelectFiles(sel Selector) ([]string, error) {
+	if _, err := sel.matcher(); err != nil {
+		return nil, err
+	}
+	fileSet := make(map[string]bool)
+	for _, memNode := range node.MbList.Member_map {
+		address := memNode.Ip + ":" + memNode.RPC_Port
+		names, err := CallSelectLocalFiles(address, &sel)
+		if err != nil {
+			SLOG.Printf("[SelectFiles] %s: %v", address, err)
+			continue
+		}
+		for _, sdfsName := range names {
+			fileSet[sdfsName] = true
+		}
+	}
+	res := []string{}
+	for sdfsName := range fileSet {
+		res = append(res, sdfsName)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// deleteSelected deletes the files matching a selector
+func (node *Node) deleteSelected(sel Selector) error {
+	files, err := node.SelectFiles(sel)
+	if err != nil {
+		return err
+	}
+	return node.deleteFiles(files)
+}
+
+/* Callee begin */
+func (fileService *FileService) SelectFilesRequest(sel *Selector, res *[]string) error {
+	names, err := fileService.node.SelectFiles(*sel)
+	*res = names
+	return err
+}
+
+func (fileService *FileService) SelectLocalFiles(sel *Selector, res *[]string) error {
+	match, err := sel.matcher()
+	if err != nil {
+		return err
+	}
+	*res = fileService.node.FileList.SelectFiles(match)
+	return nil
+}
+
+/* Callee end */
+
+/* Caller begin */
+func CallSelectLocalFiles(address string, sel *Selector) ([]string, error) {
+	client, err := DialRPC(address)
+	if err != nil {
+		return nil, dialError{err}
+	}
+	defer client.Close()
+	var res []string
+	err = client.Call(FileServiceName+address+".SelectLocalFiles", sel, &res)
+	return res, err
+}
+
+/* Caller end */
@@ -0,0 +1,311 @@
+/*
+This file defines the SWIM style failure detector.
+
+Each protocol period a node probes one member with ACTION_PING. If no ACK
+comes back within PROBE_TIMEOUT, it asks PING_REQ_K other members to probe
+the target on its behalf with ACTION_PING_REQ. A target that stays silent
+for the whole period becomes suspect, and is only deleted if it fails to
+refute the suspicion (by bumping its incarnation) within SUSPECT_TIMEOUT.
+*/
+
+package node
+
+import (
+	"math/rand"
+	. "slogger"
+	"time"
+)
+
+const (
+	PROBE_INTERVAL  = 1 * time.Second
+	PROBE_TIMEOUT   = 300 * time.Millisecond
+	PING_REQ_K      = 3
+	SUSPECT_TIMEOUT = 3 * time.Second
+)
+
+func (node *Node) SWIMProbeRoutine() {
+	for {
+		if !node.active {
+			break
+		}
+		node.ProbeRound()
+	}
+}
+
+// ProbeRound runs one protocol period against the next member
+func (node *Node) ProbeRound() {
+	if target := node.nextProbeTarget(); target != -1 {
+		node.ProbeNode(target)
+	} else {
+		time.Sleep(node.Timing.ProbeInterval)
+	}
+}
+
+// nextProbeTarget picks members in a shuffled round robin order, so every
+// member is probed once in a bounded number of protocol periods
+func (node *Node) nextProbeTarget() int {
+	for len(node.probeOrder) > 0 {
+		id := node.probeOrder[0]
+		node.probeOrder = node.probeOrder[1:]
+		if node.MbList.GetNode(id) != nil {
+			return id
+		}
+	}
+	node.MbList.lock.Lock()
+	for id := range node.MbList.Member_map {
+		if id != node.Id {
+			node.probeOrder = append(node.probeOrder, id)
+		}
+	}
+	node.MbList.lock.Unlock()
+	if len(node.probeOrder) == 0 {
+		return -1
+	}
+	rand.Shuffle(len(node.probeOrder), func(i, j int) {
+		node.probeOrder[i], node.probeOrder[j] = node.probeOrder[j], node.probeOrder[i]
+	})
+	id := node.probeOrder[0]
+	node.probeOrder = node.probeOrder[1:]
+	return id
+}
+
+// ProbeNode runs one protocol period against node id, it returns false if
+// the node is suspected afterwards
+func (node *Node) ProbeNode(id int) bool {
+	member := node.MbList.GetNode(id)
+	if member == nil {
+		return true
+	}
+	start := time.Now()
+	seq, c := node.registerAck()
+	defer node.unregisterAck(seq)
+	pingPacket := &Packet{
+		Action: ACTION_PING,
+		Id:     node.Id,
+		IP:     node.IP,
+		Port:   node.Port,
+		Seq:    seq,
+	}
+	node.sendPacket(member.Ip+":"+member.Port, pingPacket)
+	select {
+	case <-c:
+		time.Sleep(node.Timing.ProbeInterval - time.Since(start))
+		return true
+	case <-time.After(node.Timing.ProbeTimeout):
+	}
+
+	SLOG.Printf("[Node %d] no ACK from %d, sending ACTION_PING_REQ", node.Id, id)
+	pingReqPacket := &Packet{
+		Action: ACTION_PING_REQ,
+		Id:     node.Id,
+		IP:     node.IP,
+		Port:   node.Port,
+		Seq:    seq,
+		Target: id,
+	}
+	for _, helper := range node.getRandomMembers(PING_REQ_K, id) {
+		node.sendPacket(helper.Ip+":"+helper.Port, pingReqPacket)
+	}
+	select {
+	case <-c:
+		time.Sleep(node.Timing.ProbeInterval - time.Since(start))
+		return true
+	case <-time.After(node.Timing.ProbeInterval - time.Since(start)):
+	}
+
+	SLOG.Printf("[Node %d] suspect node %d", node.Id, id)
+	incarnation := member.Incarnation
+	if node.suspectNode(id, incarnation) {
+		suspectPacket := &Packet{
+			Action:      ACTION_SUSPECT,
+			Id:          id,
+			IP:          node.IP,
+			Port:        node.Port,
+			Incarnation: incarnation,
+		}
+		node.Broadcast(suspectPacket)
+	}
+	return false
+}
+
+func (node *Node) getRandomMembers(k int, excludeId int) []MemberNode {
+	candidates := []MemberNode{}
+	node.MbList.lock.Lock()
+	for id, member := range node.MbList.Member_map {
+		if id != node.Id && id != excludeId {
+			candidates = append(candidates, *member)
+		}
+	}
+	node.MbList.lock.Unlock()
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+func (node *Node) registerAck() (int, chan bool) {
+	node.ackLock.Lock()
+	defer node.ackLock.Unlock()
+	node.probeSeq++
+	c := make(chan bool, 1)
+	node.ackWaiters[node.probeSeq] = c
+	return node.probeSeq, c
+}
+
+func (node *Node) unregisterAck(seq int) {
+	node.ackLock.Lock()
+	delete(node.ackWaiters, seq)
+	node.ackLock.Unlock()
+}
+
+func (node *Node) deliverAck(seq int) {
+	node.ackLock.Lock()
+	defer node.ackLock.Unlock()
+	if c, ok := node.ackWaiters[seq]; ok {
+		select {
+		case c <- true:
+		default: // already acked
+		}
+	}
+}
+
+func (node *Node) handleProbe(packet Packet) {
+	if !node.active || node.MbList == nil {
+		return
+	}
+	ackPacket := &Packet{
+		Action:      ACTION_ACK,
+		Id:          node.Id,
+		IP:          node.IP,
+		Port:        node.Port,
+		Seq:         packet.Seq,
+		Incarnation: node.GetIncarnation(),
+	}
+	node.sendPacket(packet.IP+":"+packet.Port, ackPacket)
+}
+
+func (node *Node) handlePingReq(packet Packet) {
+	if !node.active || node.MbList == nil {
+		return
+	}
+	target := node.MbList.GetNode(packet.Target)
+	if target == nil {
+		return
+	}
+	seq, c := node.registerAck()
+	defer node.unregisterAck(seq)
+	pingPacket := &Packet{
+		Action: ACTION_PING,
+		Id:     node.Id,
+		IP:     node.IP,
+		Port:   node.Port,
+		Seq:    seq,
+	}
+	node.sendPacket(target.Ip+":"+target.Port, pingPacket)
+	select {
+	case <-c:
+		ackPacket := &Packet{
+			Action: ACTION_ACK,
+			Id:     packet.Target,
+			IP:     node.IP,
+			Port:   node.Port,
+			Seq:    packet.Seq,
+		}
+		node.sendPacket(packet.IP+":"+packet.Port, ackPacket)
+	case <-time.After(node.Timing.ProbeTimeout):
+	}
+}
+
+// suspectNode returns true if the node was not suspected with this incarnation
+func (node *Node) suspectNode(id, incarnation int) bool {
+	if !node.MbList.MarkSuspect(id, incarnation) {
+		return false
+	}
+	node.mapLock.Lock()
+	if timer, ok := node.suspectTimers[id]; ok {
+		timer.Stop()
+	}
+	node.suspectTimers[id] = time.AfterFunc(node.Timing.SuspectTimeout, func() {
+		node.suspectTimeOut(id, incarnation)
+	})
+	node.mapLock.Unlock()
+	return true
+}
+
+func (node *Node) suspectTimeOut(id, incarnation int) {
+	node.mapLock.Lock()
+	delete(node.suspectTimers, id)
+	node.mapLock.Unlock()
+	member := node.MbList.GetNode(id)
+	if !node.active || member == nil || !member.Suspect || member.Incarnation != incarnation {
+		return
+	}
+	SLOG.Printf("[Node %d] suspect node %d did not refute, found failure", node.Id, id)
+	deleteNodePacket := &Packet{
+		Action:      ACTION_DELETE_NODE,
+		Id:          id,
+		IP:          node.IP,
+		Port:        node.Port,
+		Incarnation: incarnation,
+	}
+	node.Broadcast(deleteNodePacket)
+	node.LostNode(id, false)
+}
+
+// aliveNode returns true if the incarnation overrides a previous one
+func (node *Node) aliveNode(id, incarnation int) bool {
+	if !node.MbList.MarkAlive(id, incarnation) {
+		return false
+	}
+	node.mapLock.Lock()
+	if timer, ok := node.suspectTimers[id]; ok {
+		timer.Stop()
+		delete(node.suspectTimers, id)
+	}
+	node.mapLock.Unlock()
+	return true
+}
+
+// GetIncarnation returns the incarnation of this node
+func (node *Node) GetIncarnation() int {
+	node.memberLock.Lock()
+	defer node.memberLock.Unlock()
+	return node.incarnation
+}
+
+func (node *Node) setIncarnation(incarnation int) {
+	node.memberLock.Lock()
+	node.incarnation = incarnation
+	node.memberLock.Unlock()
+}
+
+// outliveIncarnation raises the incarnation of this node above a suspected
+// one, it returns the new incarnation
+func (node *Node) outliveIncarnation(suspected int) int {
+	node.memberLock.Lock()
+	defer node.memberLock.Unlock()
+	if suspected >= node.incarnation {
+		node.incarnation = suspected + 1
+	}
+	return node.incarnation
+}
+
+func (node *Node) refuteSuspicion(incarnation int) {
+	incarnation = node.outliveIncarnation(incarnation)
+	node.MbList.MarkAlive(node.Id, incarnation)
+	SLOG.Printf("[Node %d] refute suspicion with incarnation %d", node.Id, incarnation)
+	alivePacket := &Packet{
+		Action:      ACTION_ALIVE,
+		Id:          node.Id,
+		IP:          node.IP,
+		Port:        node.Port,
+		RPC_Port:    node.RPC_Port,
+		Hostname:    node.Hostname,
+		Incarnation: incarnation,
+		Labels:      node.Labels,
+	}
+	node.Broadcast(alivePacket)
+}
@@ -1,14 +1,62 @@
+/*
+This file defines the streaming file transfer on TCP_FILE_PORT.
+
+Whole file rpc calls hold the file in memory on both ends, so put, get,
+replication and MapleJuice input fetch stream the content between disk and
+socket with a TCPBufferSize buffer instead. Every node of a process shares one
+listener, like the rpc services, so a request names its target by rpc address.
+When the target has no stream service, callers fall back to the rpc calls.
+
+API, a request starts with its type and target rpc address, answered with
+OK\n, or ERR <message>\n if the target is unknown. Contents are followed by
+OK <crc32c in hex>\n, or ERR <message>\n if the sender found them corrupted,
+and the receiver drops contents that do not match:
+  ** Similar to StoreFileToLocal
+  PUT\n
+  Target\n
+  -> OK\n
+  MasterNodeId\n
+  SdfsName\n
+  Ts\n
+  PrevTs\n
+  Appending\n
+  Offset\n
+  Tmp\n
+  Manifest\n
+  OldVersion\n
+  Stage\n
+  Replicas ReadQuorum WriteQuorum\n
+  Size\n
+  contents
+  OK <checksum>\n
+  -> OK\n or ERR <message>\n, ERR concurrent write if it raced with another put
+  *****
+  ** Similar to ServeLocalFile
+  GET\n
+  Target\n
+  -> OK\n
+  SdfsName\n
+  Version\n
+  -> OK <size>\n contents OK <checksum>\n, or ERR <message>\n
+*/
+
 package node
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	. "slogger"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-const TCPBufferSize = 1024
+const TCPBufferSize = 64 * 1024
 const TCP_FILE_PORT = "8012"
 
 const (
@@ -16,102 +64,446 @@ const (
 	PUTRequest string = "PUT"
 )
 
+var errNoStreamTarget = errors.New("no stream service for target")
+
+var streamLock = &sync.Mutex{}
+var streamTargets = make(map[string]*Node) // key: rpc address
+var streamListening bool
+
+// StartTCPService registers the node on the stream listener of this process,
+// the first node opens it
 func (node *Node) StartTCPService() {
-	listener, err := net.Listen("tcp", "0.0.0.0:"+TCP_FILE_PORT)
+	streamLock.Lock()
+	streamTargets[node.IP+":"+node.RPC_Port] = node
+	if streamListening {
+		streamLock.Unlock()
+		return
+	}
+	listener, err := ListenRPC("0.0.0.0:" + TCP_FILE_PORT)
 	if err != nil {
-		SLOG.Fatal("ListenTCP error:", err)
+		streamLock.Unlock()
+		SLOG.Println("[StartTCPService] listen error, files go through rpc:", err)
+		return
 	}
+	streamListening = true
+	streamLock.Unlock()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			SLOG.Fatal("Accept error:", err)
 		}
-		go node.HandleTCPFileRequest(conn)
-	}
-}
-
-func (node *Node) HandleTCPFileRequest(conn net.Conn) {
-	/***** API:
-	 ** Similar to StoreFileToLocal
-	 * PUT\n
-	 * MasterNodeId\n
-	 * SdfsName\n
-	 * Ts\n
-	 * Appending\n
-	 * contents
-	 *****
-	 ** Similar to serveLocalFile
-	 * GET\n
-	 * SdfsName
-	 *****/
+		go handleTCPFileConn(conn)
+	}
+}
+
+func handleTCPFileConn(conn net.Conn) {
 	defer conn.Close()
-	content := string(ReadContent(conn))
-	lines := strings.Split(content, "\n")
-	requestType := lines[0]
+	reader := bufio.NewReaderSize(conn, TCPBufferSize)
+	header, err := readLines(reader, 2)
+	if err != nil {
+		SLOG.Print("[HandleTCPFileRequest] err reading header: ", err)
+		return
+	}
+	streamLock.Lock()
+	node, ok := streamTargets[header[1]]
+	streamLock.Unlock()
+	if !ok {
+		replyTCPFileRequest(conn, errNoStreamTarget)
+		return
+	}
+	replyTCPFileRequest(conn, nil)
+	node.HandleTCPFileRequest(header[0], reader, conn)
+}
+
+func (node *Node) HandleTCPFileRequest(requestType string, reader *bufio.Reader, conn net.Conn) {
 	if requestType == PUTRequest {
-		args, err := ParsePutArgs(lines)
+		args, size, err := ParsePutArgs(reader)
 		if err != nil {
-			SLOG.Print("[HandleTCPFILERequest] err ParsePutArgs: ", err)
+			SLOG.Print("[HandleTCPFileRequest] err ParsePutArgs: ", err)
+			replyTCPFileRequest(conn, err)
 			return
 		}
-		node.StoreFileToLocal(args)
+		err = node.StoreFileFromReader(args, &checkedReader{r: &exactReader{io.LimitReader(reader, size), size}, trailer: reader})
+		replyTCPFileRequest(conn, err)
+	} else if requestType == GETRequest {
+		lines, err := readLines(reader, 2)
 		if err != nil {
-			SLOG.Print("[HandleTCPFILERequest] err StoreFileToLocal: ", err)
 			return
 		}
-	} else if requestType == GETRequest {
-
+		version, err := strconv.Atoi(lines[1])
+		if err != nil {
+			replyTCPFileRequest(conn, err)
+			return
+		}
+		started := false
+		sum, err := node.FileList.ServeFileStream(lines[0], version, func(r io.Reader, size int64) error {
+			started = true
+			fmt.Fprintf(conn, "OK %d\n", size)
+			_, err := io.CopyBuffer(conn, r, make([]byte, TCPBufferSize))
+			return err
+		})
+		if err == nil {
+			fmt.Fprintf(conn, "OK %08x\n", sum)
+		} else if err == ErrChecksum {
+			replyTCPFileRequest(conn, err)
+			go node.ScrubFile(lines[0])
+		} else {
+			SLOG.Print("[HandleTCPFileRequest] err serving file: ", err)
+			if !started {
+				replyTCPFileRequest(conn, err)
+			}
+		}
+	} else {
+		replyTCPFileRequest(conn, errors.New("unknown request "+requestType))
 	}
 }
 
-func (node *Node) StoreFileToLocal(args *StoreFileArgs) error {
+// StoreFileFromReader is StoreFileToLocal with the content read from r
+func (node *Node) StoreFileFromReader(args *StoreFileArgs, r io.Reader) error {
+	node.Clock.Update(args.Ts)
+	if args.Stage != 0 {
+		return node.stageFromReader(args, r)
+	}
+	if args.Appending && args.Offset == ORDER_APPEND {
+		return node.orderAppend(args, r)
+	}
+	if args.OldVersion {
+		return node.FileList.StoreVersionFromReader(args.SdfsName, args.Ts, r)
+	}
+	other := node.concurrentWrite(args)
+	if other > args.Ts {
+		return node.storeLosingWrite(args, r)
+	}
+	if err := node.checkStaleWrite(args); err != nil {
+		return err
+	}
+	if args.Appending && !args.Tmp {
+		if err := node.checkAppendOffset(args); err != nil {
+			return err
+		}
+	}
 	var err error
-	if args.Appending {
-		err = node.FileList.AppendFile(args.SdfsName, node.Root_dir, args.Ts, args.MasterNodeId, args.Content)
+	if args.Tmp {
+		toHash := strings.Split(args.SdfsName, "___")[0]
+		err = node.FileList.StoreFileFromReader(getHashID(toHash), args.SdfsName, node.Root_dir, args.Ts, args.MasterNodeId, r, false, true)
 	} else {
-		err = node.FileList.StoreFile(args.SdfsName, node.Root_dir, args.Ts, args.MasterNodeId, args.Content)
+		err = node.FileList.StoreFileFromReader(getHashID(args.SdfsName), args.SdfsName, node.Root_dir, args.Ts, args.MasterNodeId, r, args.Appending, false)
 	}
-
 	if err != nil {
 		SLOG.Println(err)
+		return err
 	}
-	return err
+	node.FileList.UpdateFileMeta(args.SdfsName, args.Replication, args.Manifest)
+	return node.settleWrite(args, other)
 }
 
-func ParsePutArgs(lines []string) (*StoreFileArgs, error) {
-	masterNodeId, err := strconv.Atoi(lines[1])
+func ParsePutArgs(reader *bufio.Reader) (*StoreFileArgs, int64, error) {
+	lines, err := readLines(reader, 12)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	sdfsName := lines[2]
-	ts, err := strconv.Atoi(lines[3])
+	masterNodeId, err := strconv.Atoi(lines[0])
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	ts, err := strconv.Atoi(lines[2])
+	if err != nil {
+		return nil, 0, err
+	}
+	prevTs, err := strconv.Atoi(lines[3])
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := strconv.ParseInt(lines[5], 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	stage, err := strconv.Atoi(lines[9])
+	if err != nil {
+		return nil, 0, err
+	}
+	var replication Replication
+	_, err = fmt.Sscanf(lines[10], "%d %d %d", &replication.Replicas, &replication.ReadQuorum, &replication.WriteQuorum)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := strconv.ParseInt(lines[11], 10, 64)
+	if err != nil {
+		return nil, 0, err
 	}
-	appending := lines[4] == "true"
-	content := []byte(strings.Join(lines[5:], "\n"))
 	return &StoreFileArgs{
 		MasterNodeId: masterNodeId,
-		SdfsName:     sdfsName,
+		SdfsName:     lines[1],
 		Ts:           ts,
-		Appending:    appending,
-		Content:      content,
-	}, nil
+		PrevTs:       prevTs,
+		Appending:    lines[4] == "true",
+		Offset:       offset,
+		Tmp:          lines[6] == "true",
+		Manifest:     lines[7] == "true",
+		OldVersion:   lines[8] == "true",
+		Stage:        stage,
+		Replication:  replication,
+	}, size, nil
 }
 
-func ReadContent(conn net.Conn) []byte {
-	res := []byte{}
-	for {
-		buffer := make([]byte, TCPBufferSize)
-		n, err := conn.Read(buffer)
+func readLines(reader *bufio.Reader, n int) ([]string, error) {
+	lines := make([]string, n)
+	for i := range lines {
+		line, err := reader.ReadString('\n')
 		if err != nil {
-			if err != io.EOF {
-				SLOG.Println("read error:", err)
-			}
-			break
+			return nil, err
+		}
+		lines[i] = strings.TrimSuffix(line, "\n")
+	}
+	return lines, nil
+}
+
+func replyTCPFileRequest(conn net.Conn, err error) {
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+	} else {
+		fmt.Fprint(conn, "OK\n")
+	}
+}
+
+func readTCPFileReply(reader *bufio.Reader) (string, error) {
+	lines, err := readLines(reader, 1)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(lines[0], "ERR ") {
+		return "", remoteError(errors.New(strings.TrimPrefix(lines[0], "ERR ")))
+	}
+	return strings.TrimSpace(strings.TrimPrefix(lines[0], "OK")), nil
+}
+
+// remoteErrors are checked by callers, they come back from another node as
+// their message only
+var remoteErrors = []error{errNoStreamTarget, ErrChecksum, ErrConflict, ErrAppendOffset}
+
+// remoteError returns the error of remoteErrors that err came back as, or err
+func remoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, known := range remoteErrors {
+		if err.Error() == known.Error() {
+			return known
+		}
+	}
+	return err
+}
+
+// exactReader fails if the stream ends before size bytes
+type exactReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (er *exactReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	er.left -= int64(n)
+	if err == io.EOF && er.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// checkedReader reads the checksum line after the content and fails instead
+// of returning io.EOF if it does not match
+type checkedReader struct {
+	r       io.Reader
+	trailer *bufio.Reader
+	crc     crcWriter
+	err     error // set once the checksum line is read
+}
+
+func (cr *checkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	n, err := cr.r.Read(p)
+	cr.crc.Write(p[:n])
+	if err == io.EOF {
+		reply, replyErr := readTCPFileReply(cr.trailer)
+		var sum uint32
+		if replyErr != nil {
+			err = replyErr
+		} else if _, scanErr := fmt.Sscanf(reply, "%x", &sum); scanErr != nil || sum != cr.crc.Sum {
+			err = ErrChecksum
+		}
+		cr.err = err
+	}
+	return n, err
+}
+
+func streamAddress(rpcAddress string) string {
+	return strings.Split(rpcAddress, ":")[0] + ":" + TCP_FILE_PORT
+}
+
+// fileSection is a part of a local file, Size -1 means up to the end
+type fileSection struct {
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+// open returns a reader of the section and its size
+func (section fileSection) open() (*os.File, io.Reader, int64, error) {
+	f, err := os.Open(section.Path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	size := section.Size
+	if size < 0 {
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, 0, err
 		}
-		res = append(res, buffer[:n]...)
+		size = stat.Size() - section.Offset
+	}
+	return f, io.NewSectionReader(f, section.Offset, size), size, nil
+}
+
+// StreamPutFile sends a local file to the node at rpc address, args.Content
+// is ignored
+func StreamPutFile(address string, args *StoreFileArgs, localPath string) error {
+	return streamPutSection(address, args, fileSection{localPath, 0, -1})
+}
+
+func streamPutSection(address string, args *StoreFileArgs, section fileSection) error {
+	f, content, size, err := section.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	conn, reader, err := openStream(address, PUTRequest)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	writer := bufio.NewWriterSize(conn, TCPBufferSize)
+	r := args.Replication
+	fmt.Fprintf(writer, "%d\n%s\n%d\n%d\n%t\n%d\n%t\n%t\n%t\n%d\n%d %d %d\n%d\n",
+		args.MasterNodeId, args.SdfsName, args.Ts, args.PrevTs, args.Appending, args.Offset, args.Tmp, args.Manifest, args.OldVersion,
+		args.Stage, r.Replicas, r.ReadQuorum, r.WriteQuorum, size)
+	crc := &crcWriter{}
+	_, err = io.CopyBuffer(io.MultiWriter(writer, crc), content, make([]byte, TCPBufferSize))
+	if err == nil {
+		fmt.Fprintf(writer, "OK %08x\n", crc.Sum)
+		err = writer.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = readTCPFileReply(reader)
+	return err
+}
+
+// openStream sends the request type and target, errNoStreamTarget means the
+// caller should use rpc
+func openStream(address, requestType string) (net.Conn, *bufio.Reader, error) {
+	conn, err := DialStream(streamAddress(address))
+	if err != nil {
+		return nil, nil, errNoStreamTarget
+	}
+	fmt.Fprintf(conn, "%s\n%s\n", requestType, address)
+	reader := bufio.NewReaderSize(conn, TCPBufferSize)
+	if _, err = readTCPFileReply(reader); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+// StreamGetFile saves the file served by the node at rpc address to localPath
+func StreamGetFile(address, sdfsfilename, localPath string) error {
+	return streamGetVersion(address, sdfsfilename, 0, localPath)
+}
+
+func streamGetVersion(address, sdfsfilename string, version int, localPath string) error {
+	conn, reader, err := openStream(address, GETRequest)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s\n%d\n", sdfsfilename, version)
+	reply, err := readTCPFileReply(reader)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(reply, 10, 64)
+	if err != nil {
+		return err
+	}
+	_, err = writeFromReader(localPath, &checkedReader{r: &exactReader{io.LimitReader(reader, size), size}, trailer: reader})
+	return err
+}
+
+// PutLocalFile is PutFile with the content read from localPath, streamed when
+// the target has a stream service
+func PutLocalFile(address string, args *StoreFileArgs, localPath string, c chan int) {
+	putFileSection(address, args, fileSection{localPath, 0, -1}, c)
+}
+
+func putFileSection(address string, args *StoreFileArgs, section fileSection, c chan int) {
+	err := storeSection(address, args, section)
+	if _, unreachable := err.(dialError); unreachable {
+		SLOG.Printf("[PutLocalFile] Dial failed, address: %s", address)
+	} else if err != nil && err != ErrConflict {
+		SLOG.Printf("[PutLocalFile] address: %s, filename: %s, err: %v", address, args.SdfsName, err)
+	}
+	c <- int(storeAck(err))
+}
+
+// storeSection stores a section of a local file on a replica, streamed when
+// the target has a stream service
+func storeSection(address string, args *StoreFileArgs, section fileSection) error {
+	err := streamPutSection(address, args, section)
+	if err != errNoStreamTarget {
+		return err
+	}
+	data, err := section.readAll()
+	if err != nil {
+		return err
+	}
+	rpcArgs := *args
+	rpcArgs.Content = data
+	rpcArgs.Checksum = Checksum(data)
+	return callStoreFile(address, &rpcArgs)
+}
+
+func (section fileSection) readAll() ([]byte, error) {
+	f, content, _, err := section.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(content)
+}
+
+// GetFileToLocal saves a sdfs file to localPath, streamed when the target has
+// a stream service
+func GetFileToLocal(address, sdfsfilename, localPath string) error {
+	return GetVersionToLocal(address, sdfsfilename, 0, localPath)
+}
+
+// GetVersionToLocal is GetFileToLocal for a version of the file, 0 is the
+// latest
+func GetVersionToLocal(address, sdfsfilename string, version int, localPath string) error {
+	err := streamGetVersion(address, sdfsfilename, version, localPath)
+	if err != errNoStreamTarget {
+		return err
+	}
+	var data []byte
+	if version == 0 {
+		err = GetFile(address, sdfsfilename, &data)
+	} else {
+		err = GetVersion(address, sdfsfilename, version, &data)
+	}
+	if err != nil {
+		return err
 	}
-	SLOG.Println("[ReadContent] got content")
-	return res
+	return ioutil.WriteFile(localPath, data, 0777)
 }
@@ -0,0 +1,176 @@
+/*
+This file defines how membership packets move between nodes.
+
+UDPTransport is used in production. MemoryTransport delivers packets between
+nodes in the same process, with configurable loss, delay, duplication and
+partitions, so failure scenarios with many nodes can be tested quickly.
+*/
+
+package node
+
+import (
+	"math/rand"
+	"net"
+	. "slogger"
+	"sync"
+	"time"
+)
+
+const MEMORY_QUEUE_SIZE = 1024
+
+type Transport interface {
+	// Send delivers data to the node listening on address to, delivery is
+	// not guaranteed
+	Send(from, to string, data []byte) error
+	// Listen passes every packet sent to address to handler, it blocks until
+	// the transport stops listening
+	Listen(address string, handler func(data []byte)) error
+}
+
+type UDPTransport struct {
+	LossRate float64 // simulate loss packet
+}
+
+func CreateUDPTransport() *UDPTransport {
+	return &UDPTransport{LossRate: LOSS_RATE}
+}
+
+func (t *UDPTransport) Send(from, to string, data []byte) error {
+	if t.LossRate > 0 && rand.Float64() < t.LossRate {
+		return nil
+	}
+	conn, err := net.Dial("udp", to)
+	if err != nil {
+		SLOG.Printf("Dial Failed: address: %s", to)
+		SLOG.Print(err)
+		return err
+	}
+	defer conn.Close()
+	conn.Write(data)
+	return nil
+}
+
+func (t *UDPTransport) Listen(address string, handler func(data []byte)) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		buf := make([]byte, UDP_BUFFER_SIZE)
+		length, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			SLOG.Println("Error in MonitorInputPacket:", err)
+			continue
+		}
+		handler(buf[:length])
+	}
+}
+
+type MemoryTransport struct {
+	LossRate      float64
+	DuplicateRate float64
+	MinDelay      time.Duration
+	MaxDelay      time.Duration
+	lock          *sync.Mutex
+	rand          *rand.Rand
+	endpoints     map[string]chan []byte
+	partitions    map[string]int // Key: address, value: partition, 0 if not set
+	crashed       map[string]bool
+}
+
+// CreateMemoryTransport returns a reliable in-memory network, seed makes the
+// injected faults reproducible
+func CreateMemoryTransport(seed int64) *MemoryTransport {
+	return &MemoryTransport{
+		lock:       &sync.Mutex{},
+		rand:       rand.New(rand.NewSource(seed)),
+		endpoints:  make(map[string]chan []byte),
+		partitions: make(map[string]int),
+		crashed:    make(map[string]bool),
+	}
+}
+
+func (t *MemoryTransport) Send(from, to string, data []byte) error {
+	t.lock.Lock()
+	if _, ok := t.endpoints[to]; !ok || t.crashed[from] || t.partitions[from] != t.partitions[to] {
+		t.lock.Unlock()
+		return nil
+	}
+	if t.rand.Float64() < t.LossRate {
+		t.lock.Unlock()
+		return nil
+	}
+	copies := 1
+	if t.rand.Float64() < t.DuplicateRate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = t.MinDelay
+		if t.MaxDelay > t.MinDelay {
+			delays[i] += time.Duration(t.rand.Int63n(int64(t.MaxDelay - t.MinDelay)))
+		}
+	}
+	t.lock.Unlock()
+
+	for _, delay := range delays {
+		if delay == 0 {
+			t.deliver(to, data)
+		} else {
+			time.AfterFunc(delay, func() { t.deliver(to, data) })
+		}
+	}
+	return nil
+}
+
+func (t *MemoryTransport) deliver(to string, data []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if c, ok := t.endpoints[to]; ok {
+		select {
+		case c <- data:
+		default: // queue is full, drop it like a socket buffer does
+		}
+	}
+}
+
+func (t *MemoryTransport) Listen(address string, handler func(data []byte)) error {
+	c := make(chan []byte, MEMORY_QUEUE_SIZE)
+	t.lock.Lock()
+	t.endpoints[address] = c
+	delete(t.crashed, address)
+	t.lock.Unlock()
+	for data := range c {
+		handler(data)
+	}
+	return nil
+}
+
+// Crash stops the node at address from sending and receiving packets
+func (t *MemoryTransport) Crash(address string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if c, ok := t.endpoints[address]; ok {
+		close(c)
+		delete(t.endpoints, address)
+	}
+	t.crashed[address] = true
+}
+
+// Partition splits addresses into groups, a packet is only delivered inside
+// a group. Addresses not listed form one more group.
+func (t *MemoryTransport) Partition(groups ...[]string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, address := range group {
+			t.partitions[address] = i + 1
+		}
+	}
+}
+
+func (t *MemoryTransport) Heal() {
+	t.Partition()
+}
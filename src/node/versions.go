@@ -0,0 +1,321 @@
+/*
+This file defines the old versions of a file.
+
+When a put replaces a file, each replica keeps the previous content next to
+it as <path>.v<timestamp> and records it in FileInfo.Versions, newest first.
+A replica keeps at most Retention.MaxVersions versions including the current
+one, and drops versions older than Retention.MaxAge, on every put and every
+ScrubInterval. Versions are pushed along with the file when it is copied to a
+new replica. Files stored in blocks only keep their latest version.
+*/
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	. "slogger"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_MAX_VERSIONS = 5
+const VERSION_SEP = ".v"
+
+var ErrNoVersion = errors.New("version not found")
+
+type FileVersion struct {
+	Timestamp int
+	Localpath string
+	Checksum  uint32
+}
+
+type Retention struct {
+	MaxVersions int           // versions kept including the current one, 1 keeps no history
+	MaxAge      time.Duration // 0 keeps versions forever
+}
+
+type VersionArgs struct {
+	SdfsName string
+	Version  int // timestamp of the version, 0 for the latest
+}
+
+type GetVersionsArgs struct {
+	SdfsName    string
+	NumVersions int
+	LocalName   string
+}
+
+func DefaultRetention() Retention {
+	return Retention{MaxVersions: DEFAULT_MAX_VERSIONS}
+}
+
+func versionPath(abs_path string, timestamp int) string {
+	return abs_path + VERSION_SEP + strconv.Itoa(timestamp)
+}
+
+// archiveCopy links the current content of abs_path to its version path, the
+// link survives the rename of the new content
+func archiveCopy(abs_path string, timestamp int) string {
+	path := versionPath(abs_path, timestamp)
+	os.Remove(path)
+	if err := os.Link(abs_path, path); err != nil {
+		SLOG.Printf("[Versions] fail to keep %s: %v", path, err)
+		return ""
+	}
+	return path
+}
+
+// keepVersion records an old version of a file and applies the retention, it
+// returns the local paths to remove. The caller holds ListLock
+func (fl *FileList) keepVersion(fileInfo *FileInfo, version FileVersion) []string {
+	versions := []FileVersion{}
+	for _, v := range fileInfo.Versions {
+		if v.Timestamp != version.Timestamp {
+			versions = append(versions, v)
+		}
+	}
+	versions = append(versions, version)
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Timestamp > versions[j].Timestamp })
+	fileInfo.Versions = versions
+	return fl.applyRetention(fileInfo, GetMillisecond())
+}
+
+// applyRetention drops the versions the retention does not keep, it returns
+// their local paths. The caller holds ListLock
+func (fl *FileList) applyRetention(fileInfo *FileInfo, now int) []string {
+	removed := []string{}
+	kept := []FileVersion{}
+	for i, v := range fileInfo.Versions {
+		tooOld := fl.Retention.MaxAge > 0 && now-HLCWall(v.Timestamp) > int(fl.Retention.MaxAge/time.Millisecond)
+		if i+1 >= fl.Retention.MaxVersions || tooOld {
+			removed = append(removed, v.Localpath)
+		} else {
+			kept = append(kept, v)
+		}
+	}
+	fileInfo.Versions = kept
+	return removed
+}
+
+// CollectVersions applies the retention to every file, it returns the number
+// of versions removed
+func (fl *FileList) CollectVersions() int {
+	removed := []string{}
+	fl.ListLock.Lock()
+	now := GetMillisecond()
+	for _, fileInfo := range fl.FileMap {
+		if paths := fl.applyRetention(fileInfo, now); len(paths) > 0 {
+			removed = append(removed, paths...)
+			fl.logPut(fileInfo)
+		}
+	}
+	fl.ListLock.Unlock()
+	for _, path := range removed {
+		os.Remove(path)
+	}
+	return len(removed)
+}
+
+// ListVersions returns the timestamps of the local versions of a file, the
+// current one first
+func (fl *FileList) ListVersions(sdfsName string) []int {
+	fl.ListLock.Lock()
+	defer fl.ListLock.Unlock()
+	fileInfo, ok := fl.FileMap[sdfsName]
+	if !ok {
+		return nil
+	}
+	res := []int{fileInfo.Timestamp}
+	for _, v := range fileInfo.Versions {
+		res = append(res, v.Timestamp)
+	}
+	return res
+}
+
+// localVersion returns the local path and checksum of a version, 0 is the
+// current one. The caller holds the FileLock
+func (fileInfo *FileInfo) localVersion(version int) (string, uint32, error) {
+	if version == 0 || version == fileInfo.Timestamp {
+		return fileInfo.Localpath, fileInfo.Checksum, nil
+	}
+	for _, v := range fileInfo.Versions {
+		if v.Timestamp == version {
+			return v.Localpath, v.Checksum, nil
+		}
+	}
+	return "", 0, ErrNoVersion
+}
+
+// StoreVersionFromReader adds an old version copied from another replica,
+// the current version must be stored already
+func (fl *FileList) StoreVersionFromReader(sdfsName string, timestamp int, r io.Reader) error {
+	fileInfo := fl.GetFileInfo(sdfsName)
+	if fileInfo == nil {
+		return errors.New("file not exist: " + sdfsName)
+	}
+	fileInfo.FileLock.Lock()
+	defer fileInfo.FileLock.Unlock()
+	if _, _, err := fileInfo.localVersion(timestamp); err == nil {
+		return nil
+	}
+	path := versionPath(fileInfo.Localpath, timestamp)
+	sum, err := writeFromReader(path, r)
+	if err != nil {
+		return err
+	}
+	fl.ListLock.Lock()
+	removed := fl.keepVersion(fileInfo, FileVersion{timestamp, path, sum})
+	fl.logPut(fileInfo)
+	fl.ListLock.Unlock()
+	for _, path := range removed {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// pushVersions copies the old versions of a file to a replica that has just
+// received the current one
+func pushVersions(address string, info FileInfo, args StoreFileArgs) {
+	for i := len(info.Versions) - 1; i >= 0; i-- {
+		v := info.Versions[i]
+		args.Ts = v.Timestamp
+		args.OldVersion = true
+		c := make(chan int, 1)
+		PutLocalFile(address, &args, v.Localpath, c)
+	}
+}
+
+/* Callee begin */
+func (fileService *FileService) ListLocalVersions(sdfsName string, result *[]int) error {
+	versions := fileService.node.FileList.ListVersions(sdfsName)
+	if versions == nil {
+		return errors.New("file not exist: " + sdfsName)
+	}
+	*result = versions
+	return nil
+}
+
+func (fileService *FileService) ServeLocalVersion(args *VersionArgs, result *[]byte) error {
+	data, err := fileService.node.FileList.ServeVersion(args.SdfsName, args.Version)
+	*result = data
+	return err
+}
+
+func (fileService *FileService) GetVersionsRequest(args *GetVersionsArgs, result *RPCResultType) error {
+	err := fileService.node.GetVersionsToLocal(args.SdfsName, args.NumVersions, args.LocalName)
+	if err != nil {
+		*result = RPC_FAIL
+		return err
+	}
+	*result = RPC_SUCCESS
+	return nil
+}
+
+// ListVersions returns the timestamps of the versions of a file held by its
+// replicas, newest first
+func (node *Node) ListVersions(sdfsName string) []int {
+	replication := node.GetReplication(sdfsName)
+	seen := make(map[int]bool)
+	res := []int{}
+	for _, address := range node.GetResponsibleAddressesWithReplicas(sdfsName, replication.Replicas) {
+		versions, err := CallListVersions(address, sdfsName)
+		if err != nil {
+			continue
+		}
+		for _, ts := range versions {
+			if !seen[ts] {
+				seen[ts] = true
+				res = append(res, ts)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(res)))
+	return res
+}
+
+// FetchVersion saves a version of a file to localPath, 0 is the latest
+func (node *Node) FetchVersion(sdfsName string, version int, localPath string) error {
+	if version == 0 {
+		return node.FetchFile(sdfsName, localPath)
+	}
+	replication := node.GetReplication(sdfsName)
+	err := ErrNoVersion
+	for _, address := range node.GetResponsibleAddressesWithReplicas(sdfsName, replication.Replicas) {
+		if err = GetVersionToLocal(address, sdfsName, version, localPath); err != nil {
+			continue
+		}
+		// the current version of a file in blocks is its manifest, the version
+		// is kept as fetched when its meta can not be read
+		meta, metaErr := CallGetFileMeta(address, sdfsName)
+		if metaErr == nil && meta.Manifest && meta.Timestamp == version {
+			return node.joinBlocks(localPath)
+		}
+		return nil
+	}
+	return err
+}
+
+// GetVersionsToLocal saves the latest numVersions versions of a file to one
+// local file, each one after a line naming its timestamp
+func (node *Node) GetVersionsToLocal(sdfsName string, numVersions int, localPath string) error {
+	versions := node.ListVersions(sdfsName)
+	if len(versions) == 0 {
+		return errors.New("file not exist: " + sdfsName)
+	}
+	if numVersions < len(versions) {
+		versions = versions[:numVersions]
+	}
+	out, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	for _, version := range versions {
+		tmpFile, err := ioutil.TempFile("", "version")
+		if err != nil {
+			return err
+		}
+		tmpFile.Close()
+		err = node.FetchVersion(sdfsName, version, tmpFile.Name())
+		if err == nil {
+			err = appendVersion(out, version, tmpFile.Name())
+		}
+		os.Remove(tmpFile.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendVersion(out io.Writer, version int, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fmt.Fprintf(out, "===== version %d =====\n", version)
+	_, err = io.Copy(out, in)
+	return err
+}
+
+/* Callee end */
+
+/* Caller begin */
+func CallListVersions(address, sdfsName string) ([]int, error) {
+	var versions []int
+	client, err := DialRPC(address)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	err = client.Call(FileServiceName+address+".ListLocalVersions", sdfsName, &versions)
+	return versions, err
+}
+
+/* Caller end */
@@ -1,20 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
 	"net"
 	"node"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"runtime"
 	. "slogger"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
 const (
-	PORT string = "8180"
+	PORT      string = "8180"
+	SEEDS_ENV        = "MAPLEJUICE_SEEDS"
 )
 
+// default seeds, used if none is given by -seeds, MAPLEJUICE_SEEDS or -config
 var SERVER_LIST = []string{
 	"fa19-cs425-g17-01.cs.illinois.edu:" + PORT,
 	"fa19-cs425-g17-02.cs.illinois.edu:" + PORT,
@@ -28,21 +34,71 @@ var SERVER_LIST = []string{
 	"fa19-cs425-g17-10.cs.illinois.edu:" + PORT,
 }
 
-func clearDir(dir string) error {
-	files, err := filepath.Glob(filepath.Join(dir, "*"))
+var detector = flag.String("detector", "heartbeat", "Failure detector, \"heartbeat\" or \"swim\"")
+var seeds = flag.String("seeds", "", "Comma separated introducer addresses, overrides "+SEEDS_ENV)
+var config = flag.String("config", "", "File of introducer addresses, one per line")
+var multicast = flag.String("multicast", "", "Multicast group for discovery, e.g. "+node.DEFAULT_MULTICAST_GROUP)
+var scanRetries = flag.Int("scan-retries", node.SCAN_RETRIES, "Rounds of introducer pings")
+var scanTimeout = flag.Duration("scan-timeout", node.SCAN_TIMEOUT, "Wait for an introducer in each round")
+var secretFile = flag.String("secret", "", "File of the secret shared by the cluster, signs membership packets")
+var caFile = flag.String("ca", "", "CA certificate of the cluster, enables mutual TLS for rpc")
+var certFile = flag.String("cert", "", "Certificate of this node signed by the cluster CA")
+var keyFile = flag.String("key", "", "Private key of the node certificate")
+var labels = flag.String("labels", "", "Comma separated key=value labels, e.g. zone=a,disk=500G,role=storage-only")
+var vnodes = flag.Int("vnodes", node.DEFAULT_VNODES, "Points owned by this node on the hash ring")
+var maxVersions = flag.Int("versions", node.DEFAULT_MAX_VERSIONS, "Versions kept of each file, including the current one")
+var versionTTL = flag.Duration("version-ttl", 0, "Drop old versions after this long, 0 keeps them")
+var blockSize = flag.Int64("block-size", node.DEFAULT_BLOCK_SIZE, "Files larger than this many bytes are stored in blocks, 0 to disable")
+
+func splitSeeds(s string) []string {
+	res := []string{}
+	for _, seed := range strings.Split(s, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			res = append(res, seed)
+		}
+	}
+	return res
+}
+
+func readSeedFile(path string) []string {
+	file, err := os.Open(path)
 	if err != nil {
 		SLOG.Fatal(err)
 	}
-	for _, file := range files {
-		err = os.RemoveAll(file)
-		if err != nil {
-			SLOG.Fatal(err)
+	defer file.Close()
+	res := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			res = append(res, line)
 		}
 	}
-	return nil
+	return res
+}
+
+// loadSeeds returns the configured seeds, followed by the members known
+// before the last restart
+func loadSeeds() []string {
+	var res []string
+	if *seeds != "" {
+		res = splitSeeds(*seeds)
+	} else if env := os.Getenv(SEEDS_ENV); env != "" {
+		res = splitSeeds(env)
+	} else if *config != "" {
+		res = readSeedFile(*config)
+	} else {
+		res = SERVER_LIST
+	}
+	res = append(res, node.ReadLastKnownAddresses()...)
+	if *multicast != "" {
+		res = append(res, *multicast)
+	}
+	return res
 }
 
 func main() {
+	flag.Parse()
 	sigCh := make(chan os.Signal, 1)
 	done := make(chan bool, 2)
 	hostname, _ := os.Hostname()
@@ -52,18 +108,57 @@ func main() {
 	}
 	addr := fmt.Sprintf("%s", addr_raw[0])
 	SLOG.Printf("Hostname: %s", addr)
-	selfNode := node.CreateNode(addr, PORT, node.RPC_DEFAULT_PORT)
-	clearDir(selfNode.Root_dir)
+	detectorType := node.DETECTOR_HEARTBEAT
+	if *detector == "swim" {
+		detectorType = node.DETECTOR_SWIM
+	}
+	selfNode := node.CreateNodeWithDetector(addr, PORT, node.RPC_DEFAULT_PORT, detectorType)
+	if _, err := selfNode.RestoreFileList(); err != nil {
+		SLOG.Fatal(err)
+	}
 	selfNode.UpdateHostname(hostname)
+	selfNode.Labels, err = node.ParseLabels(*labels)
+	if err != nil {
+		SLOG.Fatal(err)
+	}
+	if _, ok := selfNode.Labels[node.LABEL_CPU]; !ok {
+		selfNode.Labels[node.LABEL_CPU] = strconv.Itoa(runtime.NumCPU())
+	}
+	if _, ok := selfNode.Labels[node.LABEL_VNODES]; !ok {
+		selfNode.Labels[node.LABEL_VNODES] = strconv.Itoa(*vnodes)
+	}
+	selfNode.BlockSize = *blockSize
+	selfNode.FileList.Retention = node.Retention{MaxVersions: *maxVersions, MaxAge: *versionTTL}
+	selfNode.ScanRetries = *scanRetries
+	selfNode.ScanTimeout = *scanTimeout
+	if *secretFile != "" {
+		selfNode.Secret, err = node.ReadSecret(*secretFile)
+		if err != nil {
+			SLOG.Fatal(err)
+		}
+	}
+	if *caFile != "" {
+		err = node.LoadTLS(*caFile, *certFile, *keyFile)
+		if err != nil {
+			SLOG.Fatal(err)
+		}
+	}
+	seedList := loadSeeds()
 	go selfNode.MonitorInputPacket()
 	go selfNode.StartRPCService()
-	add, success := selfNode.ScanIntroducer(SERVER_LIST)
+	if *multicast != "" {
+		go selfNode.MonitorMulticast(*multicast)
+	}
+	add, success := selfNode.ScanIntroducer(seedList)
 	if success {
 		selfNode.Join(add)
 	} else {
 		selfNode.InitMemberList()
 	}
-	go selfNode.SendHeartbeatRoutine()
+	go selfNode.StartFailureDetector()
+	go selfNode.AntiEntropyRoutine()
+	go selfNode.ScrubRoutine()
+	go selfNode.HintRoutine()
 
 	signal.Notify(sigCh, syscall.SIGINT)
 	go func() {
@@ -1,10 +1,13 @@
 package test
 
 import (
+	"errors"
+	"io/ioutil"
 	"math/rand"
 	"node"
 	"os"
 	"testing"
+	"time"
 )
 
 const FILES_ROOT_DIR = node.FILES_ROOT_DIR
@@ -226,3 +229,102 @@ func TestMergeTmpFiles(t *testing.T) {
 	err := os.RemoveAll("/tmp/test_tmp")
 	assert(err == nil, "fail to remove")
 }
+
+func TestFileListLog(t *testing.T) {
+	os.RemoveAll("/tmp/test_log")
+	defer os.RemoveAll("/tmp/test_log")
+	logPath := "/tmp/test_log/" + node.FILE_LIST_FILE
+	fl := node.CreateFileList(1)
+	fl.StoreFile("a", "/tmp/test_log", 1, 2, []byte("hello"))
+	assert(fl.OpenLog(logPath) == nil, "fail to open log")
+	fl.StoreFile("b", "/tmp/test_log", 3, 2, []byte("world"))
+	fl.StoreFile("c", "/tmp/test_log", 4, 2, []byte("bye"))
+	fl.UpdateFileMeta("b", node.Replication{Replicas: 2}, false)
+	fl.DeleteFileAndInfo("c")
+	fl.AppendFile("a", "/tmp/test_log", 5, 2, []byte(" world"))
+	fl.StoreTmpFile("a___1", "/tmp/test_log", 6, 2, []byte("maple output"))
+
+	// a torn record at the end is ignored
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0666)
+	assert(err == nil, "fail to open log file")
+	f.WriteString(`{"Delete":tr`)
+	f.Close()
+
+	restored := node.CreateFileList(1)
+	assert(restored.OpenLog(logPath) == nil, "fail to replay log")
+	assert(len(restored.FileMap) == 2, "wrong number of files, tmp files should not be logged")
+	a := restored.GetFileInfo("a")
+	assert(a != nil && a.Timestamp == 5 && a.MasterNodeID == 2, "wrong info of a")
+	data, err := restored.ServeFile("a")
+	assert(err == nil && string(data) == "hello world", "wrong content of a")
+	b := restored.GetFileInfo("b")
+	assert(b != nil && b.Timestamp == 3 && b.Replication.Replicas == 2, "wrong info of b")
+	assert(restored.GetFileInfo("c") == nil, "c should be deleted")
+}
+
+func TestKeepVersions(t *testing.T) {
+	os.RemoveAll("/tmp/test_versions")
+	defer os.RemoveAll("/tmp/test_versions")
+	fl := node.CreateFileList(1)
+	fl.Retention = node.Retention{MaxVersions: 3}
+	fl.StoreFile("f", "/tmp/test_versions", 1, 2, []byte("one"))
+	fl.StoreFile("f", "/tmp/test_versions", 2, 2, []byte("two"))
+	fl.StoreFile("f", "/tmp/test_versions", 3, 2, []byte("three"))
+	fl.StoreFile("f", "/tmp/test_versions", 4, 2, []byte("four"))
+	versions := fl.ListVersions("f")
+	assert(len(versions) == 3 && versions[0] == 4 && versions[2] == 2, "wrong versions")
+	data, err := fl.ServeVersion("f", 2)
+	assert(err == nil && string(data) == "two", "wrong old version")
+	data, _ = fl.ServeFile("f")
+	assert(string(data) == "four", "wrong current version")
+	_, err = fl.ServeVersion("f", 1)
+	assert(err == node.ErrNoVersion, "version 1 should be dropped")
+	_, err = os.Stat("/tmp/test_versions/f" + node.VERSION_SEP + "1")
+	assert(os.IsNotExist(err), "dropped version should be removed")
+
+	fl.Retention.MaxAge = time.Millisecond
+	assert(fl.CollectVersions() == 2, "old versions should be collected")
+	fl.DeleteFileAndInfo("f")
+	files, _ := ioutil.ReadDir("/tmp/test_versions")
+	assert(len(files) == 0, "delete should remove the versions")
+}
+
+// brokenReader returns its content, then fails
+type brokenReader struct {
+	content []byte
+	read    func()
+}
+
+func (br *brokenReader) Read(p []byte) (int, error) {
+	if br.read != nil {
+		br.read()
+	}
+	if len(br.content) == 0 {
+		return 0, errors.New("broken")
+	}
+	n := copy(p, br.content)
+	br.content = br.content[n:]
+	return n, nil
+}
+
+func TestStoreFromBrokenReader(t *testing.T) {
+	os.RemoveAll("/tmp/test_broken")
+	defer os.RemoveAll("/tmp/test_broken")
+	fl := node.CreateFileList(1)
+	listed := false
+	r := &brokenReader{[]byte("partial"), func() { listed = listed || fl.GetFileInfo("new") != nil }}
+	assert(fl.StoreFileFromReader(getHashID("new"), "new", "/tmp/test_broken", 1, 2, r, false, false) != nil, "broken store should fail")
+	assert(!listed, "new file listed before it is stored")
+	assert(fl.GetFileInfo("new") == nil, "broken new file should not be listed")
+
+	fl.StoreFile("f", "/tmp/test_broken", 1, 2, []byte("hello"))
+	sum := fl.GetFileInfo("f").Checksum
+	r = &brokenReader{[]byte(" world"), nil}
+	assert(fl.StoreFileFromReader(getHashID("f"), "f", "/tmp/test_broken", 2, 2, r, true, false) != nil, "broken append should fail")
+	info := fl.GetFileInfo("f")
+	assert(info.Timestamp == 1 && info.Checksum == sum, "broken append should not update the file")
+	data, err := fl.ServeFile("f")
+	assert(err == nil && string(data) == "hello", "broken append should keep the content: "+string(data))
+	files, _ := ioutil.ReadDir("/tmp/test_broken")
+	assert(len(files) == 1, "broken transfers left files behind")
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"node"
+	"testing"
+	"time"
+)
+
+func TestGossiperRetransmitBound(t *testing.T) {
+	g := node.CreateGossiper()
+	for i := 0; i < 10; i++ {
+		g.Enqueue(node.MemberUpdate{Action: node.ACTION_NEW_NODE, Id: i}, 3)
+	}
+	g.Enqueue(node.MemberUpdate{Action: node.ACTION_DELETE_NODE, Id: 3}, 3)
+	assert(g.Pending() == 10, "only the latest update of a node should be kept")
+	updates := g.TakePiggyback()
+	assert(len(updates) == node.MAX_PIGGYBACK, "wrong piggyback size")
+	sent := len(updates)
+	for g.Pending() > 0 {
+		sent += len(g.TakePiggyback())
+	}
+	// 3 * ceil(log2(3+1)) transmissions for each of the 10 updates
+	assert(sent == 60, "wrong transmission count")
+	assert(g.TakePiggyback() == nil, "queue should be empty")
+}
+
+func TestTombstone(t *testing.T) {
+	g := node.CreateGossiper()
+	assert(g.GetTombstone(5) == -1, "no tombstone yet")
+	g.AddTombstone(5, 2)
+	g.AddTombstone(5, 1)
+	assert(g.GetTombstone(5) == 2, "older incarnation should not override")
+	g.RemoveTombstone(5)
+	assert(g.GetTombstone(5) == -1, "tombstone should be removed")
+}
+
+func TestAntiEntropy(t *testing.T) {
+	node1 := node.CreateNode("0.0.0.0", "9170", "")
+	node2 := node.CreateNode("0.0.0.0", "9171", "")
+	node1.InitMemberList()
+	go node1.MonitorInputPacket()
+	go node2.MonitorInputPacket()
+	time.Sleep(50 * time.Millisecond)
+	node2.Join(node1.IP + ":" + node1.Port)
+	time.Sleep(50 * time.Millisecond)
+	assert(node1.MbList.Size == 2, "wrong size1")
+
+	// node1 missed the news about a member
+	fakeId := 1
+	node2.MbList.InsertNode(fakeId, "0.0.0.0", "9179", "", 1, "")
+	node1.SyncMembership(node2.IP + ":" + node2.Port)
+	time.Sleep(100 * time.Millisecond)
+	assert(node1.MbList.GetNode(fakeId) != nil, "node1 should learn the member")
+
+	// node2 missed the news about a deletion
+	node1.LostNode(fakeId, false)
+	node2.MbList.InsertNode(fakeId, "0.0.0.0", "9179", "", 1, "")
+	node1.SyncMembership(node2.IP + ":" + node2.Port)
+	time.Sleep(100 * time.Millisecond)
+	assert(node2.MbList.GetNode(fakeId) == nil, "node2 should delete the member")
+	assert(node1.MbList.GetNode(fakeId) == nil, "deleted member should not come back")
+	assert(node1.MbList.Size == 2 && node2.MbList.Size == 2, "wrong size2")
+}
+
+func TestRejoinAndReconcile(t *testing.T) {
+	node1 := node.CreateNode("0.0.0.0", "9180", "9280")
+	node2 := node.CreateNode("0.0.0.0", "9181", "9281")
+	node1.InitMemberList()
+	go node1.MonitorInputPacket()
+	go node2.MonitorInputPacket()
+	go node1.StartRPCService()
+	time.Sleep(50 * time.Millisecond)
+	assert(node2.Join(node1.IP+":"+node1.Port), "join failed")
+	time.Sleep(50 * time.Millisecond)
+
+	// node2 restarts before its old entry is deleted
+	assert(node2.Join(node1.IP+":"+node1.Port), "rejoin failed")
+	time.Sleep(50 * time.Millisecond)
+	assert(node1.MbList.Size == 2, "rejoined node should replace the old entry")
+	assert(node2.GetIncarnation() == 1, "rejoined node should get a new incarnation")
+	assert(node1.MbList.GetNode(node2.Id).Incarnation == 1, "wrong incarnation")
+
+	// node1 missed the news about a member, node2 missed a deletion
+	fakeId := 1
+	node2.MbList.InsertNode(fakeId, "0.0.0.0", "9189", "", 1, "")
+	view := node1.MbList.GetView()
+	remoteView, err := node2.ReconcileMembership(node1.IP + ":" + node1.RPC_Port)
+	assert(err == nil, "reconcile failed")
+	assert(remoteView > view, "remote view should increase")
+	assert(node1.MbList.GetNode(fakeId) != nil, "node1 should learn the member")
+	node1.LostNode(fakeId, false)
+	node2.ReconcileMembership(node1.IP + ":" + node1.RPC_Port)
+	assert(node2.MbList.GetNode(fakeId) == nil, "node2 should delete the member")
+	assert(node1.MbList.Size == 2 && node2.MbList.Size == 2, "wrong size")
+}
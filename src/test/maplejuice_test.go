@@ -22,6 +22,7 @@ func TestAssignFiles(t *testing.T) {
 	for i := 1; i < NODES; i++ {
 		nodes[i].Join(nodes[0].IP + ":" + nodes[0].Port)
 	}
+	time.Sleep(50 * time.Millisecond) // wait for gossip to spread
 	for i, nod := range nodes {
 		if nod.MbList.Size != NODES {
 			t.Fatalf("wrong size for nod: %d size: %d", i, nod.MbList.Size)
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"node"
 	"os"
+	"sort"
 	"testing"
 	"time"
 )
@@ -73,6 +74,21 @@ func TestFindFreeId(t *testing.T) {
 	}
 }
 
+func TestFindNextFreeId(t *testing.T) {
+	capacity := 10
+	mbList := node.CreateMemberList(0, capacity)
+	assert(mbList.FindNextFreeId(8) == 8, "wrong id1")
+	mbList.InsertNode(8, "0.0.0.0", "90", "", 1, "")
+	mbList.InsertNode(9, "0.0.0.0", "91", "", 1, "")
+	assert(mbList.FindNextFreeId(8) == 0, "should wrap around")
+	assert(mbList.GetIdByAddress("0.0.0.0", "91") == 9, "wrong id by address")
+	assert(mbList.GetIdByAddress("0.0.0.0", "92") == -1, "non-exist address")
+	for i := 0; i < capacity; i++ {
+		mbList.InsertNode(i, "0.0.0.0", "90", "", 1, "")
+	}
+	assert(mbList.FindNextFreeId(3) == -1, "list is full")
+}
+
 func TestGetNextKNodes(t *testing.T) {
 	mbList := node.CreateMemberList(0, 10)
 	mbList.InsertNode(0, "0.0.0.0", "90", "", 1, "")
@@ -240,6 +256,18 @@ func TestDumpToTmpFile(t *testing.T) {
 	// }
 }
 
+func TestReadLastKnownAddresses(t *testing.T) {
+	mbList := node.CreateMemberList(0, 10)
+	mbList.InsertNode(0, "0.0.0.1", "91", "", 1, "")
+	mbList.InsertNode(2, "0.0.0.2", "92", "", 1, "")
+	mbList.InsertNode(3, "0.0.0.3", "93", "", 1, "")
+	mbList.DumpToTmpFile()
+	addresses := node.ReadLastKnownAddresses()
+	sort.Strings(addresses)
+	assert(len(addresses) == 2, "self should be excluded")
+	assert(addresses[0] == "0.0.0.2:92" && addresses[1] == "0.0.0.3:93", "wrong addresses")
+}
+
 func TestGetAddressesForNextKNodes(t *testing.T) {
 	mbList := node.CreateMemberList(0, 10)
 	mbList.InsertNode(0, "192.169.163.111", "91", "", 1, "")
@@ -267,3 +295,49 @@ func TestGetSmallestNode(t *testing.T) {
 	sn = mbList.GetSmallestNode()
 	assert(sn.Id == 3, "wrong node4")
 }
+
+func TestMarkSuspectAndAlive(t *testing.T) {
+	mbList := node.CreateMemberList(0, 10)
+	mbList.InsertNode(0, "0.0.0.0", "90", "", 1, "")
+	mbList.InsertNode(3, "0.0.0.3", "93", "", 1, "")
+	assert(mbList.MarkSuspect(3, 0), "should turn suspect")
+	assert(!mbList.MarkSuspect(3, 0), "already suspect")
+	assert(mbList.GetNode(3).Suspect, "wrong status1")
+	assert(!mbList.MarkAlive(3, 0), "same incarnation should not refute")
+	assert(mbList.MarkAlive(3, 1), "higher incarnation should refute")
+	assert(!mbList.GetNode(3).Suspect, "wrong status2")
+	assert(!mbList.MarkSuspect(3, 0), "stale suspicion")
+	assert(!mbList.MarkSuspect(5, 0), "non-exist node")
+}
+
+func TestMemberListView(t *testing.T) {
+	mbList := node.CreateMemberList(0, 10)
+	mbList.InsertNode(0, "0.0.0.0", "90", "", 1, "")
+	mbList.InsertNode(3, "0.0.0.3", "93", "", 1, "")
+	assert(mbList.GetView() == 2, "wrong view1")
+	mbList.UpdateNodeHeartbeat(3, 2)
+	assert(mbList.GetView() == 2, "heartbeat should not change view")
+	mbList.MarkSuspect(3, 0)
+	mbList.MarkAlive(3, 0)
+	assert(mbList.GetView() == 3, "wrong view2")
+	mbList.DeleteNode(3)
+	mbList.DeleteNode(3)
+	assert(mbList.GetView() == 4, "wrong view3")
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := node.ParseLabels(" zone=a, role=storage-only,disk=500G,")
+	assert(err == nil, "valid labels")
+	assert(len(labels) == 3 && labels["zone"] == "a" && labels["role"] == node.ROLE_STORAGE_ONLY, "wrong labels")
+	assert(node.FormatLabels(labels) == "disk=500G,role=storage-only,zone=a", "wrong format")
+	_, err = node.ParseLabels("zone")
+	assert(err != nil, "missing value")
+	_, err = node.ParseLabels("=a")
+	assert(err != nil, "missing key")
+
+	mbList := node.CreateMemberList(0, 10)
+	mbList.InsertNodeWithLabels(3, "0.0.0.3", "93", "", 1, "", labels)
+	labels["zone"] = "b"
+	assert(mbList.GetNode(3).Labels["zone"] == "a", "labels should be copied")
+	assert(mbList.GetNode(3).CanStore() && !mbList.GetNode(3).CanCompute(), "wrong role")
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"node"
 	. "slogger"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -64,6 +66,7 @@ func TestBroadCast(t *testing.T) {
 	}
 
 	node3.Join(node1.IP + ":" + node1.Port)
+	time.Sleep(50 * time.Millisecond) // wait for gossip to spread
 
 	if node2.MbList.Size != 3 {
 		t.Fatal("wrong4")
@@ -97,6 +100,7 @@ func TestLeaveAndRejoin(t *testing.T) {
 	}
 
 	node3.Join(node1.IP + ":" + node1.Port)
+	time.Sleep(50 * time.Millisecond) // wait for gossip to spread
 
 	if node2.MbList.Size != 3 {
 		t.Fatal("wrong4")
@@ -119,6 +123,7 @@ func TestLeaveAndRejoin(t *testing.T) {
 	}
 
 	node2.Join(node1.IP + ":" + node1.Port)
+	time.Sleep(50 * time.Millisecond)
 	if node1.MbList.Size != 3 {
 		t.Fatal("wrong9")
 	}
@@ -457,3 +462,418 @@ func TestIsInCircleRange(t *testing.T) {
 	assert(node.IsInCircleRange(63, 60, 10), "4")
 	assert(!node.IsInCircleRange(59, 60, 10), "5")
 }
+
+func TestSWIMProbe(t *testing.T) {
+	node1 := node.CreateNodeWithDetector("0.0.0.0", "9160", "", node.DETECTOR_SWIM)
+	node2 := node.CreateNodeWithDetector("0.0.0.0", "9161", "", node.DETECTOR_SWIM)
+	node3 := node.CreateNodeWithDetector("0.0.0.0", "9162", "", node.DETECTOR_SWIM)
+	node1.Timing.SuspectTimeout = 200 * time.Millisecond
+	node1.InitMemberList()
+	go node1.MonitorInputPacket()
+	go node2.MonitorInputPacket()
+	go node3.MonitorInputPacket()
+	time.Sleep(50 * time.Millisecond)
+	assert(node2.Join(node1.IP+":"+node1.Port), "join failed")
+	assert(node3.Join(node1.IP+":"+node1.Port), "join failed")
+	assert(waitUntil(time.Second, func() bool { return node1.MbList.GetSize() == 3 && node2.MbList.GetSize() == 3 }), "nodes should join")
+	assert(node1.ProbeNode(node2.Id), "node2 should ack")
+
+	// a member nobody listens for, ping-req through node2 and node3 fails too
+	fakeId := 1
+	node1.MbList.InsertNode(fakeId, "0.0.0.0", "9169", "", 1, "")
+	assert(!node1.ProbeNode(fakeId), "fake node should not ack")
+	assert(node1.MbList.GetNode(fakeId).Suspect, "fake node should be suspect")
+	assert(node1.MbList.GetSize() == 4, "suspect node should not be deleted yet")
+	assert(waitUntil(time.Second, func() bool { return node1.MbList.GetSize() == 3 }), "fake node should be deleted")
+	assert(node1.MbList.GetNode(fakeId) == nil, "wrong node deleted")
+	assert(waitUntil(time.Second, func() bool { return node2.MbList.GetSize() == 3 }), "wrong size")
+}
+
+func TestHashIDCollision(t *testing.T) {
+	// both addresses hash to 895
+	node1 := node.CreateNode("0.0.0.0", "9401", "")
+	node2 := node.CreateNode("0.0.0.0", "9508", "")
+	assert(node1.Id == node2.Id, "addresses should collide")
+	node1.InitMemberList()
+	go node1.MonitorInputPacket()
+	go node2.MonitorInputPacket()
+	time.Sleep(50 * time.Millisecond)
+	assert(node2.Join(node1.IP+":"+node1.Port), "join failed")
+	assert(node2.Id == 896, "node2 should adopt the next free id")
+	assert(node2.FileList.ID == node2.Id, "file list should use the assigned id")
+	assert(node2.MbList.SelfId == node2.Id, "member list should use the assigned id")
+	assert(node1.MbList.GetNode(896).Port == "9508", "wrong member")
+	assert(node1.MbList.Size == 2 && node2.MbList.Size == 2, "wrong size1")
+
+	// rejoining keeps the assigned id
+	assert(node2.Join(node1.IP+":"+node1.Port), "rejoin failed")
+	assert(node2.Id == 896, "wrong id after rejoin")
+	time.Sleep(50 * time.Millisecond)
+	assert(node1.MbList.Size == 2 && node2.MbList.Size == 2, "wrong size2")
+}
+
+func TestJoinRejected(t *testing.T) {
+	// both addresses hash to 557
+	node1 := node.CreateNode("0.0.0.0", "9609", "")
+	node2 := node.CreateNode("0.0.0.0", "9700", "")
+	node1.InitMemberList()
+	// members nobody listens for, no free id is left for node2
+	for id := 0; id < node.MAX_CAPACITY; id++ {
+		if id != node1.Id {
+			node1.MbList.InsertNode(id, "0.0.0.0", fmt.Sprintf("%d", 30000+id), "", 1, "")
+		}
+	}
+	go node1.MonitorInputPacket()
+	go node2.MonitorInputPacket()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	assert(!node2.Join(node1.IP+":"+node1.Port), "join should be rejected")
+	assert(time.Since(start) < time.Second, "rejection should not wait for the timeout")
+	assert(node1.MbList.GetIdByAddress(node2.IP, node2.Port) == -1, "node2 should not be added")
+}
+
+func TestJoinLargeCluster(t *testing.T) {
+	node1 := node.CreateNode("0.0.0.0", "9420", "")
+	node2 := node.CreateNode("0.0.0.0", "9421", "")
+	node1.InitMemberList()
+	// members nobody listens for, the view doesn't fit in one datagram
+	last := -1
+	for i, id := 0, 0; i < 198; id++ {
+		if id == node1.Id || id == node2.Id {
+			continue
+		}
+		node1.MbList.InsertNode(id, "0.0.0.0", fmt.Sprintf("%d", 30000+id), "", 1, fmt.Sprintf("host-%d.cs.illinois.edu", id))
+		last = id
+		i++
+	}
+	go node1.MonitorInputPacket()
+	go node2.MonitorInputPacket()
+	time.Sleep(50 * time.Millisecond)
+	assert(node2.Join(node1.IP+":"+node1.Port), "join failed")
+	assert(node2.MbList.Size == 200, "wrong size")
+	assert(node2.MbList.GetNode(last).Hostname == fmt.Sprintf("host-%d.cs.illinois.edu", last), "wrong member")
+	assert(node1.MbList.GetNode(node2.Id) != nil, "node1 should add node2")
+}
+
+func TestJoinRetry(t *testing.T) {
+	network := node.CreateMemoryTransport(3)
+	node1 := node.CreateNode("0.0.0.0", "9425", "")
+	node2 := node.CreateNode("0.0.0.0", "9426", "")
+	node1.Transport = network
+	node2.Transport = network
+	node1.InitMemberList()
+	go node2.MonitorInputPacket()
+	time.Sleep(10 * time.Millisecond)
+	// the first ACTION_JOIN is lost, node1 only listens for the second one
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		node1.MonitorInputPacket()
+	}()
+	assert(node2.Join(node1.IP+":"+node1.Port), "join should be retried")
+	assert(node1.MbList.GetSize() == 2 && node2.MbList.GetSize() == 2, "wrong size")
+}
+
+func TestMulticastDiscovery(t *testing.T) {
+	group := "239.255.42.99:9432"
+	node1 := node.CreateNode("0.0.0.0", "9430", "")
+	node2 := node.CreateNode("0.0.0.0", "9431", "")
+	node1.InitMemberList()
+	go node1.MonitorInputPacket()
+	go node1.MonitorMulticast(group)
+	go node2.MonitorInputPacket()
+	time.Sleep(50 * time.Millisecond)
+	node2.ScanRetries = 1
+	introducer, success := node2.ScanIntroducer([]string{group})
+	assert(success, "no introducer found")
+	assert(strings.HasSuffix(introducer, ":9430"), "wrong introducer")
+}
+
+func waitUntil(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestFiftyNodesWithMemoryTransport(t *testing.T) {
+	network := node.CreateMemoryTransport(1)
+	network.MinDelay = 1 * time.Millisecond
+	network.MaxDelay = 3 * time.Millisecond
+	network.DuplicateRate = 0.05
+	timing := node.Timing{
+		HeartbeatInterval:   10 * time.Millisecond,
+		TimeoutThreshold:    40 * time.Millisecond,
+		ProbeInterval:       100 * time.Millisecond,
+		ProbeTimeout:        40 * time.Millisecond,
+		SuspectTimeout:      300 * time.Millisecond,
+		AntiEntropyInterval: 100 * time.Millisecond,
+	}
+	nodes := make([]*node.Node, 50)
+	for i := range nodes {
+		nodes[i] = node.CreateNodeWithDetector("0.0.0.0", fmt.Sprintf("%d", 20000+i), "", node.DETECTOR_SWIM)
+		nodes[i].Transport = network
+		nodes[i].Timing = timing
+		go nodes[i].MonitorInputPacket()
+	}
+	time.Sleep(10 * time.Millisecond)
+	nodes[0].InitMemberList()
+	for i := 1; i < len(nodes); i++ {
+		assert(nodes[i].Join(nodes[0].IP+":"+nodes[0].Port), "join failed")
+	}
+	converged := func(alive []*node.Node) bool {
+		for _, n := range alive {
+			if n.MbList.GetSize() != len(alive) {
+				return false
+			}
+		}
+		return true
+	}
+	// every round, each live node probes one member and syncs with another
+	runRounds := func(alive []*node.Node, maxRounds int) bool {
+		for round := 0; round < maxRounds; round++ {
+			if converged(alive) {
+				return true
+			}
+			var wg sync.WaitGroup
+			for _, n := range alive {
+				wg.Add(1)
+				go func(n *node.Node) {
+					n.ProbeRound()
+					n.AntiEntropyRound()
+					wg.Done()
+				}(n)
+			}
+			wg.Wait()
+		}
+		return converged(alive)
+	}
+	assert(runRounds(nodes, 5), "views should converge after joins")
+
+	// crash 5 nodes at once
+	for _, n := range nodes[45:] {
+		network.Crash(n.IP + ":" + n.Port)
+	}
+	alive := nodes[:45]
+	assert(runRounds(alive, 40), "crashed nodes should be deleted")
+	for _, n := range alive {
+		for _, crashed := range nodes[45:] {
+			assert(n.MbList.GetNode(crashed.Id) == nil, "crashed node still in view")
+		}
+	}
+	for _, n := range alive {
+		n.Leave()
+	}
+}
+
+func TestPartitionAndHeal(t *testing.T) {
+	network := node.CreateMemoryTransport(2)
+	timing := node.Timing{
+		HeartbeatInterval:   10 * time.Millisecond,
+		TimeoutThreshold:    40 * time.Millisecond,
+		ProbeInterval:       50 * time.Millisecond,
+		ProbeTimeout:        20 * time.Millisecond,
+		SuspectTimeout:      150 * time.Millisecond,
+		AntiEntropyInterval: 100 * time.Millisecond,
+		QuorumStablePeriod:  time.Minute,
+	}
+	nodes := make([]*node.Node, 5)
+	addresses := make([]string, len(nodes))
+	for i := range nodes {
+		nodes[i] = node.CreateNodeWithDetector("0.0.0.0", fmt.Sprintf("%d", 20100+i), "", node.DETECTOR_SWIM)
+		nodes[i].Transport = network
+		nodes[i].Timing = timing
+		nodes[i].ScanTimeout = 50 * time.Millisecond
+		addresses[i] = nodes[i].IP + ":" + nodes[i].Port
+		go nodes[i].MonitorInputPacket()
+	}
+	time.Sleep(10 * time.Millisecond)
+	nodes[0].InitMemberList()
+	for i := 1; i < len(nodes); i++ {
+		assert(nodes[i].Join(addresses[0]), "join failed")
+	}
+	for _, n := range nodes {
+		go n.StartFailureDetector()
+		go n.AntiEntropyRoutine()
+	}
+	sizeIs := func(group []*node.Node, size int) func() bool {
+		return func() bool {
+			for _, n := range group {
+				if n.MbList.Size != size {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	assert(waitUntil(time.Second, sizeIs(nodes, 5)), "views should converge after joins")
+
+	network.Partition(addresses[:3], addresses[3:])
+	majority, minority := nodes[:3], nodes[3:]
+	assert(waitUntil(5*time.Second, sizeIs(majority, 3)), "majority should delete the minority")
+	assert(waitUntil(5*time.Second, sizeIs(minority, 2)), "minority should delete the majority")
+	for _, n := range majority {
+		assert(n.HasQuorum(), "majority should keep the quorum")
+	}
+	for _, n := range minority {
+		assert(n.IsDegraded(), "minority should be degraded")
+		var result node.RPCResultType
+		err := n.PutFileRequest(&node.PutFileArgs{LocalName: "/tmp/nonexist", SdfsName: "nonexist"}, &result)
+		assert(err == node.ErrNoQuorum, "degraded node should refuse writes")
+	}
+
+	network.Heal()
+	assert(waitUntil(10*time.Second, sizeIs(nodes, 5)), "views should merge after heal")
+	for _, n := range nodes {
+		assert(n.HasQuorum(), "no node should be degraded after heal")
+	}
+	for _, n := range nodes {
+		n.Leave()
+	}
+}
+
+func TestLabelsPropagation(t *testing.T) {
+	network := node.CreateMemoryTransport(4)
+	roles := []string{"", node.ROLE_STORAGE_ONLY, ""}
+	nodes := make([]*node.Node, 3)
+	for i := range nodes {
+		nodes[i] = node.CreateNode("0.0.0.0", fmt.Sprintf("%d", 20300+i), "")
+		nodes[i].Transport = network
+		nodes[i].Labels = map[string]string{node.LABEL_ZONE: fmt.Sprintf("zone-%d", i)}
+		if roles[i] != "" {
+			nodes[i].Labels[node.LABEL_ROLE] = roles[i]
+		}
+		go nodes[i].MonitorInputPacket()
+	}
+	time.Sleep(10 * time.Millisecond)
+	nodes[0].InitMemberList()
+	assert(nodes[1].Join("0.0.0.0:20300"), "join failed")
+	assert(nodes[2].Join("0.0.0.0:20300"), "join failed")
+	time.Sleep(50 * time.Millisecond) // wait for gossip to spread
+	for _, n := range nodes {
+		for i, member := range nodes {
+			m := n.MbList.GetNode(member.Id)
+			assert(m != nil && m.Labels[node.LABEL_ZONE] == fmt.Sprintf("zone-%d", i), "labels should propagate")
+			assert(m.Labels[node.LABEL_ROLE] == roles[i], "wrong role label")
+		}
+	}
+	workers := nodes[0].PartitionFiles([]string{"a", "b", "c", "d"}, 2, "hash")
+	assert(len(workers) == 2, "wrong worker count")
+	_, ok := workers[nodes[1].Id]
+	assert(!ok, "storage-only node should get no work")
+}
+
+func TestPartitionFewerWorkers(t *testing.T) {
+	n := node.CreateNode("0.0.0.0", "20310", "")
+	n.InitMemberList()
+	storageOnly := map[string]string{node.LABEL_ROLE: node.ROLE_STORAGE_ONLY}
+	for _, id := range []int{(n.Id + 100) % node.MAX_CAPACITY, (n.Id + 200) % node.MAX_CAPACITY} {
+		n.MbList.InsertNodeWithLabels(id, "0.0.0.0", "20311", "", 0, "", storageOnly)
+	}
+	files := []string{"a", "b", "c", "d", "e"}
+	for _, method := range []string{"hash", "range"} {
+		workers := n.PartitionFiles(files, 3, method)
+		assert(len(workers) == 1 && len(workers[n.Id]) == len(files), "the only compute node should get every file")
+	}
+}
+
+func TestZoneAwarePlacement(t *testing.T) {
+	zones := []string{"a", "a", "a", "a", "b", "b", "c", "c"}
+	n := node.CreateNode("0.0.0.0", "20400", "")
+	n.UpdateId(0)
+	n.Labels = map[string]string{node.LABEL_ZONE: zones[0], node.LABEL_RACK: "r0"}
+	n.InitMemberList()
+	for i := 1; i < len(zones); i++ {
+		labels := map[string]string{node.LABEL_ZONE: zones[i], node.LABEL_RACK: fmt.Sprintf("r%d", i/2)}
+		n.MbList.InsertNodeWithLabels(i*100, fmt.Sprintf("10.0.0.%d", i), "20400", "", 0, "", labels)
+	}
+	for i := 0; i < 20; i++ {
+		ids := n.GetFirstKReplicaNodeID(fmt.Sprintf("file%d", i), node.DUPLICATE_CNT)
+		assert(len(ids) == node.DUPLICATE_CNT, "wrong replica count")
+		seen := map[string]bool{}
+		for _, id := range ids {
+			seen[n.MbList.GetNode(id).Labels[node.LABEL_ZONE]] = true
+		}
+		assert(len(seen) == 3, "replicas should span all zones")
+	}
+
+	// a compute-only node is never a replica
+	n.MbList.GetNode(400).Labels[node.LABEL_ROLE] = node.ROLE_COMPUTE_ONLY
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d", i)
+		assert(n.GetMasterID(name) != 400, "compute-only node should not be master")
+		for _, id := range n.GetFirstKReplicaNodeID(name, node.DUPLICATE_CNT) {
+			assert(id != 400, "compute-only node should store no replica")
+		}
+	}
+
+	// without zones, replicas follow the ring
+	plain := node.CreateNode("0.0.0.0", "20401", "")
+	plain.UpdateId(0)
+	plain.InitMemberList()
+	for i := 1; i < len(zones); i++ {
+		plain.MbList.InsertNode(i*100, "0.0.0.0", "20401", "", 0, "")
+	}
+	ids := plain.GetFirstKReplicaNodeID("file0", node.DUPLICATE_CNT)
+	for i := 1; i < len(ids); i++ {
+		assert(ids[i] == (ids[i-1]+100)%800, "replicas should follow the ring")
+	}
+}
+
+func TestVirtualNodes(t *testing.T) {
+	ids := []int{0, 100, 200, 300, 400}
+	skew := func(vnodes int) (*node.MemberList, int) {
+		mbList := node.CreateMemberList(0, 1024)
+		labels := map[string]string{node.LABEL_VNODES: fmt.Sprintf("%d", vnodes)}
+		for _, id := range ids {
+			mbList.InsertNodeWithLabels(id, "0.0.0.0", fmt.Sprintf("%d", 20500+id), "", 0, "", labels)
+		}
+		ownership, total, most := mbList.Ownership(), 0, 0
+		for _, slots := range ownership {
+			total += slots
+			if slots > most {
+				most = slots
+			}
+		}
+		assert(total == 1024, "every slot should have an owner")
+		return mbList, most
+	}
+	_, most := skew(1)
+	assert(most == 624, "one vnode should keep the ring order")
+	mbList, most := skew(32)
+	assert(most < 400, "vnodes should spread ownership")
+
+	for i := 0; i < 50; i++ {
+		hashId := getHashID(fmt.Sprintf("file%d", i))
+		replicas := mbList.ReplicasOf(mbList.MasterOf(hashId), hashId, 4)
+		seen := map[int]bool{}
+		for _, id := range replicas {
+			seen[id] = true
+		}
+		assert(len(replicas) == 4 && len(seen) == 4, "replicas should be distinct members")
+	}
+
+	// the range of a leaving member goes to several successors
+	before := map[int]int{}
+	for hashId := 0; hashId < 1024; hashId++ {
+		before[hashId] = mbList.MasterOf(hashId)
+	}
+	mbList.DeleteNode(200)
+	heirs := map[int]bool{}
+	for hashId := 0; hashId < 1024; hashId++ {
+		if before[hashId] == 200 {
+			heirs[mbList.MasterOf(hashId)] = true
+		} else {
+			assert(before[hashId] == mbList.MasterOf(hashId), "other ranges should not move")
+		}
+	}
+	assert(len(heirs) > 1, "range of a leaving member should be split")
+	assert(mbList.ReplicasOf(200, 0, 4) == nil, "a member that left has no replicas")
+
+	empty := node.CreateMemberList(0, 1024)
+	assert(empty.MasterOf(0) == -1, "an empty ring has no master")
+	assert(empty.ReplicasOf(empty.MasterOf(0), 0, 4) == nil, "an empty ring has no replicas")
+}
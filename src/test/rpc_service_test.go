@@ -1,13 +1,20 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/rpc"
 	"node"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,6 +36,75 @@ func deleteDummyFile(filename string) {
 	check(err)
 }
 
+// newCluster creates n nodes listening for packets on basePort+i, with rpc on
+// basePort+10+i and files under dir+i. configure runs before a node listens
+func newCluster(n, basePort int, dir string, configure ...func(*node.Node)) []*node.Node {
+	nodes := make([]*node.Node, n)
+	for i := range nodes {
+		fileDir := fmt.Sprintf("%s%d", dir, i)
+		os.RemoveAll(fileDir)
+		nodes[i] = node.CreateNode("0.0.0.0", strconv.Itoa(basePort+i), strconv.Itoa(basePort+10+i))
+		nodes[i].SetFileDir(fileDir)
+		for _, f := range configure {
+			f(nodes[i])
+		}
+		go nodes[i].MonitorInputPacket()
+	}
+	return nodes
+}
+
+// serveRPC starts the rpc service of the nodes and waits until it accepts
+func serveRPC(t *testing.T, nodes []*node.Node) {
+	t.Helper()
+	for _, n := range nodes {
+		go n.StartRPCService()
+	}
+	for _, n := range nodes {
+		address := "127.0.0.1:" + n.RPC_Port
+		if !waitUntil(time.Second, func() bool {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				conn.Close()
+			}
+			return err == nil
+		}) {
+			t.Fatalf("rpc service on %s did not start", address)
+		}
+	}
+}
+
+// joinCluster makes the first node the introducer, joins the rest and waits
+// until every node sees all of them
+func joinCluster(t *testing.T, nodes []*node.Node) {
+	t.Helper()
+	nodes[0].InitMemberList()
+	introducer := "0.0.0.0:" + nodes[0].Port
+	for _, n := range nodes[1:] {
+		if !n.Join(introducer) {
+			t.Fatalf("node on port %s failed to join", n.Port)
+		}
+	}
+	if !waitUntil(time.Second, func() bool {
+		for _, n := range nodes {
+			if n.MbList.GetSize() != len(nodes) {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatalf("membership of %d nodes did not converge", len(nodes))
+	}
+}
+
+// startCluster runs n nodes that have all joined, see newCluster
+func startCluster(t *testing.T, n, basePort int, dir string, configure ...func(*node.Node)) []*node.Node {
+	t.Helper()
+	nodes := newCluster(n, basePort, dir, configure...)
+	serveRPC(t, nodes)
+	joinCluster(t, nodes)
+	return nodes
+}
+
 func TestRegisterFileService(t *testing.T) {
 	node0 := node.CreateNode("0.0.0.0", "9200", "9300")
 	node0.InitMemberList()
@@ -39,7 +115,7 @@ func TestRegisterFileService(t *testing.T) {
 	defer deleteDummyFile(filename)
 	var reply node.RPCResultType
 	client, _ := rpc.Dial("tcp", "0.0.0.0:9300")
-	err := client.Call(node.FileServiceName+"0.0.0.0:9300"+".PutFileRequest", node.PutFileArgs{filename, "dest", false, false, false}, &reply)
+	err := client.Call(node.FileServiceName+"0.0.0.0:9300"+".PutFileRequest", node.PutFileArgs{LocalName: filename, SdfsName: "dest"}, &reply)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -78,7 +154,7 @@ func TestPutAndGetFileRPC(t *testing.T) {
 	time.Sleep(50 * time.Millisecond)
 	sdfsfilename := "testFilename"
 	content := []byte("this is my file content")
-	args := node.StoreFileArgs{master.Id, sdfsfilename, 1, content, false, false}
+	args := node.StoreFileArgs{MasterNodeId: master.Id, SdfsName: sdfsfilename, Ts: 1, Content: content}
 	node.PutFile("0.0.0.0:9321", &args, make(chan int, 4))
 	var data []byte
 	node.GetFile("0.0.0.0:9321", sdfsfilename, &data)
@@ -107,7 +183,7 @@ func TestGetFileFromClient(t *testing.T) {
 	coorFsAddress := "0.0.0.0:19510"
 	sdfsfilename := "testFilename"
 	content := []byte("this is my file content")
-	args := node.StoreFileArgs{coordinator.Id, sdfsfilename, 1, content, false, false}
+	args := node.StoreFileArgs{MasterNodeId: coordinator.Id, SdfsName: sdfsfilename, Ts: 1, Content: content}
 	node.PutFile(coorFsAddress, &args, make(chan int, 4))
 	client := getDcliClient(coorFsAddress)
 	var res node.RPCResultType
@@ -134,14 +210,14 @@ func TestPutFileFromClient(t *testing.T) {
 	dest := "destfile"
 	client := getDcliClient(coorFsAddress)
 	var reply node.RPCResultType
-	client.Call(node.FileServiceName+coorFsAddress+".PutFileRequest", node.PutFileArgs{src, dest, true, false, false}, &reply)
+	client.Call(node.FileServiceName+coorFsAddress+".PutFileRequest", node.PutFileArgs{LocalName: src, SdfsName: dest, ForceUpdate: true}, &reply)
 	data, _ := ioutil.ReadFile(coordinator.Root_dir + "/" + dest)
 	assert(string(data) == content, "wrong")
 	info1 := coordinator.FileList.GetFileInfo(dest)
 
 	// Put tmp file
 	dest = dest + "___123"
-	client.Call(node.FileServiceName+coorFsAddress+".PutFileRequest", node.PutFileArgs{src, dest, true, false, true}, &reply)
+	client.Call(node.FileServiceName+coorFsAddress+".PutFileRequest", node.PutFileArgs{LocalName: src, SdfsName: dest, ForceUpdate: true, Tmp: true}, &reply)
 	data, _ = ioutil.ReadFile(coordinator.Root_dir + "/tmp/" + dest)
 	assert(string(data) == content, "wrong")
 	info2 := coordinator.FileList.GetFileInfo(dest)
@@ -179,7 +255,733 @@ func TestRPCListFilesWithPrefix(t *testing.T) {
 	node2.FileList.StoreFile("prefixxx_testFilename2", "/tmp/test_delete_dirrpc", 1, 2, []byte("hello world"))
 	node2.FileList.StoreFile("prefixxx_testFilename1", "/tmp/test_delete_dirrpc", 1, 2, []byte("hello world"))
 	node3.FileList.StoreFile("prefixxx_testFilename3", "/tmp/test_delete_dirrpc", 1, 2, []byte("hello world"))
-	files := node1.ListFilesWithPrefixRequest("prefixxx")
+	files, _ := node1.ListFilesWithPrefixRequest(node.Selector{Pattern: "prefixxx"})
 	assert(len(files) == 3, "wrong length")
 	os.RemoveAll("/tmp/test_delete_dirrpc")
 }
+
+func TestReplicationFactor(t *testing.T) {
+	r := node.Replication{}.Normalize()
+	assert(r.Replicas == node.DUPLICATE_CNT && r.ReadQuorum == node.READ_QUORUM && r.WriteQuorum == node.WRITE_QUORUM, "wrong default")
+	assert(node.Replication{Replicas: 4, ReadQuorum: 1, WriteQuorum: 2}.Validate() != nil, "quorums should overlap")
+	assert(node.Replication{Replicas: 6, WriteQuorum: 5}.Validate() == nil, "valid replication refused")
+
+	nodes := startCluster(t, 5, 20600, "/tmp/rep")
+	holders := func(sdfsName string, replicas int) int {
+		cnt := 0
+		for _, n := range nodes {
+			if info := n.FileList.GetFileInfo(sdfsName); info != nil {
+				assert(info.Replication.Replicas == replicas, "wrong replication in file info")
+				cnt++
+			}
+		}
+		return cnt
+	}
+
+	src := "/tmp/dummyrepfile"
+	writeDummyFile(src, "replicated content")
+	defer deleteDummyFile(src)
+	var result node.RPCResultType
+	args := &node.PutFileArgs{LocalName: src, SdfsName: "repfile", ForceUpdate: true, Replication: node.Replication{Replicas: 2}}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	time.Sleep(100 * time.Millisecond)
+	assert(holders("repfile", 2) == 2, "file should have 2 replicas")
+	assert(nodes[3].GetReplication("repfile").Replicas == 2, "replication should be found remotely")
+
+	setArgs := &node.SetReplicationArgs{SdfsName: "repfile", Replication: node.Replication{Replicas: 5}}
+	assert(nodes[1].SetReplicationRequest(setArgs, &result) == nil, "setrep failed")
+	time.Sleep(100 * time.Millisecond)
+	assert(holders("repfile", 5) == 5, "file should have 5 replicas")
+
+	setArgs.Replication.Replicas = 1
+	assert(nodes[1].SetReplicationRequest(setArgs, &result) == nil, "setrep failed")
+	time.Sleep(100 * time.Millisecond)
+	assert(holders("repfile", 1) == 1, "file should have 1 replica")
+	var data []byte
+	address, _ := nodes[2].GetAddressOfLatestTS("repfile")
+	assert(node.GetFile(address, "repfile", &data) == nil && string(data) == "replicated content", "wrong data")
+}
+
+func TestStreamingTransfer(t *testing.T) {
+	receiver := node.CreateNode("0.0.0.0", "20700", "20710")
+	receiver.SetFileDir("/tmp/stream0")
+	receiver.InitMemberList()
+	go receiver.StartRPCService()
+	time.Sleep(50 * time.Millisecond)
+	address := "0.0.0.0:20710"
+
+	src := "/tmp/dummystreamfile"
+	content := make([]byte, 3*node.TCPBufferSize+17)
+	rand.Read(content)
+	check(ioutil.WriteFile(src, content, 0777))
+	defer deleteDummyFile(src)
+	args := &node.StoreFileArgs{MasterNodeId: receiver.Id, SdfsName: "stream/big", Ts: 5, Replication: node.Replication{Replicas: 3}}
+	assert(node.StreamPutFile(address, args, src) == nil, "stream put failed")
+	info := receiver.FileList.GetFileInfo("stream/big")
+	assert(info != nil && info.Timestamp == 5 && info.Replication.Replicas == 3, "wrong file info")
+
+	dest := "/tmp/dummystreamcopy"
+	defer os.Remove(dest)
+	assert(node.StreamGetFile(address, "stream/big", dest) == nil, "stream get failed")
+	data, _ := ioutil.ReadFile(dest)
+	assert(string(data) == string(content), "wrong streamed content")
+	assert(node.StreamGetFile(address, "stream/none", dest) != nil, "missing file should fail")
+	assert(node.StreamGetFile("0.0.0.0:1", "stream/big", dest) != nil, "unknown target should fail")
+
+	// a broken put keeps the old content
+	conn, err := net.Dial("tcp", "0.0.0.0:"+node.TCP_FILE_PORT)
+	check(err)
+	fmt.Fprintf(conn, "PUT\n%s\n%d\nstream/big\n9\n0\nfalse\n0\nfalse\nfalse\nfalse\n0\n0 0 0\n100\nshort", address, receiver.Id)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	info = receiver.FileList.GetFileInfo("stream/big")
+	assert(info.Timestamp == 5, "broken put should not update the file")
+	data, _ = ioutil.ReadFile(info.Localpath)
+	assert(string(data) == string(content), "broken put should keep the content")
+
+	// so does an append that does not match its checksum
+	sum := info.Checksum
+	conn, err = net.Dial("tcp", "0.0.0.0:"+node.TCP_FILE_PORT)
+	check(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "PUT\n%s\n%d\nstream/big\n9\n0\ntrue\n%d\nfalse\nfalse\nfalse\n0\n0 0 0\n5\nextraOK 00000000\n", address, receiver.Id, len(content))
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	reply, _ := reader.ReadString('\n')
+	assert(reply == "ERR "+node.ErrChecksum.Error()+"\n", "corrupted append should fail: "+reply)
+	info = receiver.FileList.GetFileInfo("stream/big")
+	assert(info.Timestamp == 5 && info.Checksum == sum, "corrupted append should not update the file")
+	data, _ = ioutil.ReadFile(info.Localpath)
+	assert(string(data) == string(content), "corrupted append should keep the content")
+}
+
+func TestBlockStorage(t *testing.T) {
+	nodes := startCluster(t, 4, 20800, "/tmp/block", func(n *node.Node) { n.BlockSize = 64 })
+
+	src := "/tmp/dummyblockfile"
+	content := ""
+	for i := 0; i < 40; i++ {
+		content += fmt.Sprintf("line %d %s\n", i, strings.Repeat("x", i))
+	}
+	writeDummyFile(src, content)
+	defer deleteDummyFile(src)
+	var result node.RPCResultType
+	args := &node.PutFileArgs{LocalName: src, SdfsName: "blk/big", ForceUpdate: true}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	time.Sleep(100 * time.Millisecond)
+
+	files, _ := nodes[1].ListFileInDirRequest(node.Selector{Pattern: "blk"})
+	assert(len(files) == 1 && files[0] == "blk/big", "blocks should be hidden")
+	inputs := nodes[1].ListMapleInputs("blk")
+	assert(len(inputs) > 1, "maple should get the blocks")
+	dest := "/tmp/dummyblockcopy"
+	defer os.Remove(dest)
+	for _, name := range inputs {
+		assert(node.IsBlockName(name), "maple input is not a block: "+name)
+		assert(nodes[2].FetchFile(name, dest) == nil, "fetch block failed")
+		data, _ := ioutil.ReadFile(dest)
+		assert(len(data) >= 64 && len(data) <= 128 || name == node.BlockName("blk/big", len(inputs)-1), "wrong block size")
+		assert(strings.HasSuffix(string(data), "\n"), "block is not line aligned")
+	}
+	assert(nodes[3].FetchFile("blk/big", dest) == nil, "get failed")
+	data, _ := ioutil.ReadFile(dest)
+	assert(string(data) == content, "wrong reassembled content")
+	files, _ = nodes[1].ListFilesWithPrefixRequest(node.Selector{Pattern: "blk/"})
+	assert(len(files) == 1 && files[0] == "blk/big", fmt.Sprintf("blocks should be hidden from juice: %v", files))
+	versions := nodes[3].ListVersions("blk/big")
+	assert(len(versions) == 1 && nodes[3].FetchVersion("blk/big", versions[0], dest) == nil, "get current version failed")
+	data, _ = ioutil.ReadFile(dest)
+	assert(string(data) == content, "current version should be reassembled")
+
+	// a small file replaces the blocks
+	writeDummyFile(src, "small\n")
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	time.Sleep(100 * time.Millisecond)
+	inputs = nodes[1].ListMapleInputs("blk")
+	assert(len(inputs) == 1 && inputs[0] == "blk/big", "old blocks should be deleted")
+	assert(nodes[3].FetchFile("blk/big", dest) == nil, "get failed")
+	data, _ = ioutil.ReadFile(dest)
+	assert(string(data) == "small\n", "wrong content after replace")
+
+	writeDummyFile(src, content)
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	time.Sleep(100 * time.Millisecond)
+	client, err := node.DialRPC("0.0.0.0:20811")
+	check(err)
+	defer client.Close()
+	check(client.Call(node.FileServiceName+"0.0.0.0:20811.DeleteFileRequest", "blk/big", &result))
+	time.Sleep(100 * time.Millisecond)
+	assert(len(nodes[2].ListMapleInputs("blk")) == 0, "delete should remove the blocks")
+}
+
+func TestChecksumScrub(t *testing.T) {
+	nodes := startCluster(t, 4, 20900, "/tmp/scrub")
+
+	src := "/tmp/dummyscrubfile"
+	content := strings.Repeat("scrub me\n", 100)
+	writeDummyFile(src, content)
+	defer deleteDummyFile(src)
+	var result node.RPCResultType
+	args := &node.PutFileArgs{LocalName: src, SdfsName: "scrubfile", ForceUpdate: true}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	time.Sleep(100 * time.Millisecond)
+
+	var master *node.Node
+	others := []*node.Node{}
+	for _, n := range nodes {
+		if n.Id == n.GetMasterID("scrubfile") {
+			master = n
+		} else {
+			others = append(others, n)
+		}
+	}
+	// flip a byte on one replica, truncate another
+	info := others[0].FileList.GetFileInfo("scrubfile")
+	writeDummyFile(info.Localpath, "scrub mE\n"+content[9:])
+	check(os.Truncate(others[1].FileList.GetFileInfo("scrubfile").Localpath, 10))
+	_, err := others[0].FileList.VerifyFile("scrubfile")
+	assert(err == node.ErrChecksum, "corruption not detected")
+	_, err = others[1].FileList.ServeFile("scrubfile")
+	assert(err == node.ErrChecksum, "truncated copy should not be served")
+
+	assert(master.ScrubFiles() == 2, "scrub should repair 2 replicas")
+	for _, n := range nodes {
+		_, err := n.FileList.VerifyFile("scrubfile")
+		assert(err == nil, "replica still corrupted")
+	}
+	dest := "/tmp/dummyscrubcopy"
+	defer os.Remove(dest)
+	assert(others[2].FetchFile("scrubfile", dest) == nil, "get failed")
+	data, _ := ioutil.ReadFile(dest)
+	assert(string(data) == content, "wrong content after scrub")
+
+	// a put whose content does not match its checksum is dropped
+	ts := info.Timestamp
+	address := "0.0.0.0:" + others[0].RPC_Port
+	conn, err := net.Dial("tcp", "0.0.0.0:"+node.TCP_FILE_PORT)
+	check(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "PUT\n%s\n%d\nscrubfile\n%d\n0\nfalse\n0\nfalse\nfalse\nfalse\n0\n0 0 0\n5\nbrokeOK 00000000\n", address, master.Id, ts+1)
+	reply := make([]byte, 64)
+	n, _ := conn.Read(reply)
+	n2, _ := conn.Read(reply[n:])
+	assert(strings.Contains(string(reply[:n+n2]), node.ErrChecksum.Error()), "bad checksum accepted: "+string(reply[:n+n2]))
+	assert(others[0].FileList.GetFileInfo("scrubfile").Timestamp == ts, "bad put should not update the file")
+}
+
+func copyDir(src, dest string) {
+	check(filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		check(err)
+		target := filepath.Join(dest, strings.TrimPrefix(path, src))
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		data, err := ioutil.ReadFile(path)
+		check(err)
+		return ioutil.WriteFile(target, data, 0777)
+	}))
+}
+
+func TestRestartResync(t *testing.T) {
+	nodes := startCluster(t, 3, 21000, "/tmp/restart", func(n *node.Node) {
+		_, err := n.RestoreFileList()
+		check(err)
+	})
+
+	src := "/tmp/dummyrestartfile"
+	defer deleteDummyFile(src)
+	var result node.RPCResultType
+	put := func(sdfsName, content string) {
+		writeDummyFile(src, content)
+		args := &node.PutFileArgs{LocalName: src, SdfsName: sdfsName, ForceUpdate: true}
+		assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+		time.Sleep(50 * time.Millisecond)
+	}
+	put("keep", "kept")
+	put("change", "old")
+	put("gone", "deleted later")
+
+	// the state of node 2 when it goes down
+	os.RemoveAll("/tmp/restart2_old")
+	copyDir("/tmp/restart2", "/tmp/restart2_old")
+	defer os.RemoveAll("/tmp/restart2_old")
+	put("change", "new")
+	client, err := node.DialRPC("0.0.0.0:21010")
+	check(err)
+	defer client.Close()
+	check(client.Call(node.FileServiceName+"0.0.0.0:21010.DeleteFileRequest", "gone", &result))
+	keepTs := nodes[2].FileList.GetTimeStamp("keep")
+
+	// node 2 restarts with its old disk and a stray file
+	check(os.RemoveAll("/tmp/restart2"))
+	check(os.Rename("/tmp/restart2_old", "/tmp/restart2"))
+	writeDummyFile("/tmp/restart2/stray", "nobody knows me")
+	for _, dir := range node.RESERVED_DIRS {
+		check(os.MkdirAll(filepath.Join("/tmp/restart2", dir), 0777))
+		writeDummyFile(filepath.Join("/tmp/restart2", dir, "kept"), "not a sdfs file")
+	}
+	// and a hint for node 0 it could not deliver before
+	hint := node.Hint{Seq: 1, Target: "0.0.0.0:21010", ToHash: "late", Created: node.GetMillisecond(),
+		Args: node.StoreFileArgs{MasterNodeId: nodes[2].GetMasterID("late"), SdfsName: "late", Ts: keepTs + 1}}
+	data, err := json.Marshal(hint)
+	check(err)
+	hintPath := filepath.Join("/tmp/restart2", node.HINT_DIR, "1")
+	writeDummyFile(hintPath, "hinted late")
+	check(ioutil.WriteFile(hintPath+".json", data, 0666))
+	nodes[2].FileList = node.CreateFileList(nodes[2].Id)
+	restored, err := nodes[2].RestoreFileList()
+	// the 3 files and the object of the root directory
+	assert(err == nil && restored == 4, fmt.Sprintf("should restore 4 files, got %d", restored))
+	_, err = os.Stat("/tmp/restart2/stray")
+	assert(os.IsNotExist(err), "stray file should be removed")
+	for _, dir := range node.RESERVED_DIRS {
+		_, err = os.Stat(filepath.Join("/tmp/restart2", dir, "kept"))
+		assert(err == nil, dir+" should be kept")
+	}
+	assert(nodes[2].PendingHints() == 1, fmt.Sprintf("should load 1 hint, got %d", nodes[2].PendingHints()))
+	assert(nodes[2].ReplayHints() == 1, "hint not replayed")
+	data, err = nodes[0].FileList.ServeFile("late")
+	assert(err == nil && string(data) == "hinted late", "wrong replayed hint")
+
+	nodes[2].ResyncRestoredFiles()
+	assert(nodes[2].FileList.GetTimeStamp("keep") == keepTs, "unchanged file should be kept")
+	data, err = nodes[2].FileList.ServeFile("change")
+	assert(err == nil && string(data) == "new", "changed file should be fetched")
+	assert(nodes[2].FileList.GetFileInfo("gone") == nil, "deleted file should be dropped")
+}
+
+func TestFileVersions(t *testing.T) {
+	nodes := newCluster(4, 21100, "/tmp/versions", func(n *node.Node) { n.FileList.Retention = node.Retention{MaxVersions: 3} })
+	serveRPC(t, nodes)
+	// the last node joins once the versions exist
+	joinCluster(t, nodes[:3])
+
+	src := "/tmp/dummyversionfile"
+	defer deleteDummyFile(src)
+	var result node.RPCResultType
+	for _, content := range []string{"v1\n", "v2\n", "v3\n", "v4\n"} {
+		writeDummyFile(src, content)
+		args := &node.PutFileArgs{LocalName: src, SdfsName: "versioned", ForceUpdate: true}
+		assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+		time.Sleep(20 * time.Millisecond)
+	}
+	versions := nodes[1].ListVersions("versioned")
+	assert(len(versions) == 3, fmt.Sprintf("should keep 3 versions, got %v", versions))
+
+	dest := "/tmp/dummyversioncopy"
+	defer os.Remove(dest)
+	assert(nodes[2].GetFileRequest([]string{"versioned", dest, strconv.Itoa(versions[2])}, &result) == nil, "get version failed")
+	data, _ := ioutil.ReadFile(dest)
+	assert(string(data) == "v2\n", "wrong old version: "+string(data))
+	assert(nodes[2].GetVersionsToLocal("versioned", 2, dest) == nil, "get-versions failed")
+	data, _ = ioutil.ReadFile(dest)
+	expected := fmt.Sprintf("===== version %d =====\nv4\n===== version %d =====\nv3\n", versions[0], versions[1])
+	assert(string(data) == expected, "wrong versions: "+string(data))
+
+	// a new replica gets the old versions too
+	assert(nodes[3].Join("0.0.0.0:21100"), "join failed")
+	time.Sleep(300 * time.Millisecond)
+	local := nodes[3].FileList.ListVersions("versioned")
+	assert(len(local) == 3 && local[2] == versions[2], fmt.Sprintf("versions not replicated: %v", local))
+	data, err := nodes[3].FileList.ServeVersion("versioned", versions[1])
+	assert(err == nil && string(data) == "v3\n", "wrong replicated version")
+}
+
+func TestWriteOrdering(t *testing.T) {
+	nodes := startCluster(t, 4, 21200, "/tmp/ordering")
+
+	src := "/tmp/dummyorderingfile"
+	defer deleteDummyFile(src)
+	dest := "/tmp/dummyorderingcopy"
+	defer os.Remove(dest)
+	var result node.RPCResultType
+	put := func(coordinator *node.Node, content string) node.RPCResultType {
+		writeDummyFile(src, content)
+		args := &node.PutFileArgs{LocalName: src, SdfsName: "ordered", ForceUpdate: true}
+		check(coordinator.PutFileRequest(args, &result))
+		return result
+	}
+
+	// the clock of node 0 is an hour ahead, a later put through node 1 still wins
+	nodes[0].Clock.Update((node.GetMillisecond() + 3600*1000) << node.HLC_SHIFT)
+	assert(put(nodes[0], "first\n") == node.RPC_SUCCESS, "first put failed")
+	_, first := nodes[2].GetAddressOfLatestTS("ordered")
+	assert(put(nodes[1], "second\n") == node.RPC_SUCCESS, "second put failed")
+	_, second := nodes[2].GetAddressOfLatestTS("ordered")
+	assert(second > first, "the later put should have a larger timestamp")
+	assert(nodes[2].GetFileRequest([]string{"ordered", dest}, &result) == nil, "get failed")
+	data, _ := ioutil.ReadFile(dest)
+	assert(string(data) == "second\n", "the later put should win: "+string(data))
+
+	// a put based on the first version raced with the second one
+	writeDummyFile(src, "concurrent\n")
+	args := &node.StoreFileArgs{
+		MasterNodeId: nodes[3].GetMasterID("ordered"),
+		SdfsName:     "ordered",
+		Ts:           first + 1,
+		PrevTs:       first,
+	}
+	replicas := nodes[3].GetResponsibleAddresses("ordered")
+	c := make(chan int, len(replicas))
+	for _, address := range replicas {
+		node.PutLocalFile(address, args, src, c)
+	}
+	for range replicas {
+		assert(node.RPCResultType(<-c) == node.RPC_CONFLICT, "the replicas should report the conflict")
+	}
+	meta, ok := nodes[3].GetFileMeta("ordered")
+	assert(ok && meta.Timestamp == second && len(meta.Conflicts) == 1 && meta.Conflicts[0] == first+1, fmt.Sprintf("conflict not recorded: %+v", meta))
+	assert(nodes[2].GetFileRequest([]string{"ordered", dest, strconv.Itoa(first + 1)}, &result) == nil, "the concurrent write should be kept")
+	data, _ = ioutil.ReadFile(dest)
+	assert(string(data) == "concurrent\n", "wrong concurrent write: "+string(data))
+
+	// a put based on the current version resolves the conflict
+	assert(put(nodes[3], "resolved\n") == node.RPC_SUCCESS, "resolving put failed")
+	meta, _ = nodes[3].GetFileMeta("ordered")
+	assert(len(meta.Conflicts) == 0, "conflict should be cleared")
+}
+
+func TestOrderedAppend(t *testing.T) {
+	nodes := startCluster(t, 4, 21300, "/tmp/append")
+
+	// every node appends its own lines at the same time
+	done := make(chan error, len(nodes))
+	for i, n := range nodes {
+		go func(i int, n *node.Node) {
+			src := fmt.Sprintf("/tmp/dummyappendfile%d", i)
+			defer deleteDummyFile(src)
+			for j := 0; j < 5; j++ {
+				writeDummyFile(src, fmt.Sprintf("node %d line %d\n", i, j))
+				var result node.RPCResultType
+				args := &node.PutFileArgs{LocalName: src, SdfsName: "appended", ForceUpdate: true, Appending: true}
+				if err := n.PutFileRequest(args, &result); err != nil || result != node.RPC_SUCCESS {
+					done <- fmt.Errorf("append failed: %v", err)
+					return
+				}
+			}
+			done <- nil
+		}(i, n)
+	}
+	for range nodes {
+		check(<-done)
+	}
+
+	var first []byte
+	for _, n := range nodes {
+		data, err := n.FileList.ServeFile("appended")
+		check(err)
+		if first == nil {
+			first = data
+		}
+		assert(bytes.Equal(data, first), "replicas differ:\n"+string(first)+"\n"+string(data))
+	}
+	assert(strings.Count(string(first), "\n") == 20, "lost appends:\n"+string(first))
+	ts := nodes[0].FileList.GetTimeStamp("appended")
+	for _, n := range nodes[1:] {
+		assert(n.FileList.GetTimeStamp("appended") == ts, "replicas have different timestamps")
+	}
+
+	// a replica refuses an append that does not start at the end of its copy
+	src := "/tmp/dummyappendfile"
+	writeDummyFile(src, "misplaced\n")
+	defer deleteDummyFile(src)
+	args := &node.StoreFileArgs{SdfsName: "appended", Ts: ts + 1, Appending: true, Offset: 3}
+	err := node.StreamPutFile("0.0.0.0:21311", args, src)
+	assert(err != nil && err == node.ErrAppendOffset, fmt.Sprintf("misplaced append stored: %v", err))
+	data, _ := nodes[1].FileList.ServeFile("appended")
+	assert(bytes.Equal(data, first), "misplaced append changed the copy")
+}
+
+func TestNamespace(t *testing.T) {
+	nodes := startCluster(t, 4, 21400, "/tmp/namespace")
+
+	src := "/tmp/dummynamespacefile"
+	defer deleteDummyFile(src)
+	var result node.RPCResultType
+	for i, name := range []string{"docs/a.txt", "docs/sub/b.txt", "docs/sub/deep/c.txt"} {
+		writeDummyFile(src, strings.Repeat("x", i+1))
+		args := &node.PutFileArgs{LocalName: src, SdfsName: name, ForceUpdate: true}
+		assert(nodes[i].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	}
+	check(nodes[3].Mkdir("docs/empty"))
+	assert(nodes[3].Mkdir("docs/a.txt") == node.ErrExists, "mkdir over an existing file")
+	assert(nodes[2].Mkdir("docs/empty") == node.ErrExists, "mkdir over an existing dir")
+
+	entries, err := nodes[1].ListDir("docs", true)
+	check(err)
+	expected := []string{"docs/a.txt", "docs/empty/", "docs/sub/", "docs/sub/b.txt", "docs/sub/deep/", "docs/sub/deep/c.txt"}
+	assert(fmt.Sprint(entries) == fmt.Sprint(expected), fmt.Sprintf("wrong recursive listing: %v", entries))
+	root, err := nodes[2].ListDir("", false)
+	check(err)
+	assert(len(root) == 1 && root[0] == "docs/", fmt.Sprintf("wrong root: %v", root))
+	files, _ := nodes[2].ListFileInDirRequest(node.Selector{Pattern: "docs/sub"})
+	assert(len(files) == 1 && files[0] == "docs/sub/b.txt", fmt.Sprintf("wrong files: %v", files))
+
+	stat, err := nodes[0].Stat("docs/sub/b.txt")
+	check(err)
+	assert(!stat.IsDir && stat.Size == 2 && stat.Holders == 4 && stat.Replicas == 4, fmt.Sprintf("wrong stat: %+v", stat))
+	stat, err = nodes[0].Stat("docs/sub")
+	check(err)
+	assert(stat.IsDir && stat.Entries == 2, fmt.Sprintf("wrong dir stat: %+v", stat))
+
+	// move a directory with its content
+	check(nodes[1].Rename("docs/sub", "archive/old"))
+	_, err = nodes[2].Stat("docs/sub/b.txt")
+	assert(err == node.ErrNotFound, "moved file still exists")
+	entries, err = nodes[2].ListDir("", true)
+	check(err)
+	expected = []string{"archive/", "archive/old/", "archive/old/b.txt", "archive/old/deep/", "archive/old/deep/c.txt",
+		"docs/", "docs/a.txt", "docs/empty/"}
+	assert(fmt.Sprint(entries) == fmt.Sprint(expected), fmt.Sprintf("wrong listing after mv: %v", entries))
+	dest := "/tmp/dummynamespacecopy"
+	defer os.Remove(dest)
+	assert(nodes[3].GetFileRequest([]string{"archive/old/deep/c.txt", dest}, &result) == nil, "get moved file failed")
+	data, _ := ioutil.ReadFile(dest)
+	assert(string(data) == "xxx", "wrong moved content")
+	assert(nodes[1].Rename("docs/a.txt", "archive") == node.ErrExists, "mv over an existing dir")
+
+	// files written without the namespace, like MapleJuice output
+	for i, n := range nodes {
+		check(n.FileList.StoreFile("archive/old/part", fmt.Sprintf("/tmp/namespace%d", i), 1, 0, []byte("out")))
+	}
+	files, _ = nodes[2].ListFileInDirRequest(node.Selector{Pattern: "archive/old"})
+	assert(fmt.Sprint(files) == fmt.Sprint([]string{"archive/old/b.txt", "archive/old/part"}), fmt.Sprintf("wrong files: %v", files))
+	check(nodes[3].Rename("archive/old", "archive/new"))
+	files, _ = nodes[2].ListFileInDirRequest(node.Selector{Pattern: "archive/new"})
+	assert(fmt.Sprint(files) == fmt.Sprint([]string{"archive/new/b.txt", "archive/new/part"}), fmt.Sprintf("wrong moved files: %v", files))
+	files, _ = nodes[1].ListFilesWithPrefixRequest(node.Selector{Pattern: "archive/old/"})
+	assert(len(files) == 0, fmt.Sprintf("unlisted files left after mv: %v", files))
+
+	// delete a file and a directory tree
+	check(nodes[0].DeleteFileRequest("docs/a.txt", &result))
+	check(nodes[0].DeleteSDFSDirRequest(node.Selector{Pattern: "archive"}))
+	files, _ = nodes[1].ListFilesWithPrefixRequest(node.Selector{Pattern: "archive/"})
+	assert(len(files) == 0, fmt.Sprintf("files left after delete: %v", files))
+	entries, err = nodes[3].ListDir("", true)
+	check(err)
+	assert(fmt.Sprint(entries) == fmt.Sprint([]string{"docs/", "docs/empty/"}), fmt.Sprintf("wrong listing after delete: %v", entries))
+}
+
+func TestServerCopy(t *testing.T) {
+	nodes := startCluster(t, 4, 21500, "/tmp/copy", func(n *node.Node) { n.BlockSize = 8 })
+
+	src := "/tmp/dummycopyfile"
+	defer deleteDummyFile(src)
+	var result node.RPCResultType
+	for _, content := range []string{"one", "two"} {
+		writeDummyFile(src, content)
+		args := &node.PutFileArgs{LocalName: src, SdfsName: "data/f.txt", ForceUpdate: true, Replication: node.Replication{Replicas: 3}}
+		assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	}
+	before, err := nodes[1].Stat("data/f.txt")
+	check(err)
+
+	check(nodes[1].Copy("data/f.txt", "backup/f.txt"))
+	stat, err := nodes[2].Stat("backup/f.txt")
+	check(err)
+	assert(stat.Timestamp == before.Timestamp && stat.Replicas == 3 && stat.Holders == 3, fmt.Sprintf("wrong copy: %+v", stat))
+	versions := nodes[3].ListVersions("backup/f.txt")
+	assert(fmt.Sprint(versions) == fmt.Sprint(nodes[3].ListVersions("data/f.txt")) && len(versions) == 2,
+		fmt.Sprintf("versions not copied: %v", versions))
+	assert(nodes[1].Copy("data/f.txt", "backup/f.txt") == node.ErrExists, "copy over an existing file")
+
+	// a file stored in blocks gets its own blocks
+	writeDummyFile(src, "line 1\nline 2\nline 3\n")
+	args := &node.PutFileArgs{LocalName: src, SdfsName: "data/big.txt", ForceUpdate: true}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	check(nodes[2].Rename("data/big.txt", "backup/big.txt"))
+	dest := "/tmp/dummycopyget"
+	defer os.Remove(dest)
+	assert(nodes[3].GetFileRequest([]string{"backup/big.txt", dest}, &result) == nil, "get copied file failed")
+	data, _ := ioutil.ReadFile(dest)
+	assert(string(data) == "line 1\nline 2\nline 3\n", fmt.Sprintf("wrong copied content: %q", data))
+	manifest, err := nodes[3].ReadManifest("backup/big.txt")
+	check(err)
+	assert(len(manifest.Blocks) > 1, "file not stored in blocks")
+	for i, block := range manifest.Blocks {
+		assert(block.Name == node.BlockName("backup/big.txt", i), fmt.Sprintf("block not copied: %s", block.Name))
+	}
+	_, err = nodes[3].Stat("data/big.txt")
+	assert(err == node.ErrNotFound, "moved file still exists")
+
+	entries, err := nodes[0].ListDir("", true)
+	check(err)
+	expected := []string{"backup/", "backup/big.txt", "backup/f.txt", "data/", "data/f.txt"}
+	assert(fmt.Sprint(entries) == fmt.Sprint(expected), fmt.Sprintf("wrong listing: %v", entries))
+	for i := range nodes {
+		staged, _ := ioutil.ReadDir(fmt.Sprintf("/tmp/copy%d/%s", i, node.STAGE_DIR))
+		assert(len(staged) == 0, "staged copy left behind")
+	}
+
+	// a copy whose coordinator died is dropped once it expires
+	abandoned := (node.GetMillisecond() - 60*60*1000) << node.HLC_SHIFT
+	for _, stage := range []int{abandoned, nodes[0].Clock.Now(nodes[0].Id)} {
+		stageArgs := &node.StoreFileArgs{SdfsName: "backup/lost.txt", Ts: stage, Stage: stage}
+		check(node.StreamPutFile("0.0.0.0:21511", stageArgs, src))
+	}
+	assert(nodes[1].DropExpiredStages(node.STAGE_TTL) == 1, "abandoned copy should be dropped")
+	staged, _ := ioutil.ReadDir("/tmp/copy1/" + node.STAGE_DIR)
+	assert(len(staged) == 1, "running copy should be kept")
+}
+
+func TestSelectFiles(t *testing.T) {
+	nodes := startCluster(t, 4, 21600, "/tmp/select", func(n *node.Node) { n.BlockSize = 8 })
+
+	src := "/tmp/dummyselectfile"
+	defer deleteDummyFile(src)
+	writeDummyFile(src, "line 1\nline 2\n")
+	var result node.RPCResultType
+	names := []string{"logs/2019-01/vm01.log", "logs/2019-01/sub/vm03.log", "logs/2019-02/vm02.log",
+		"logs/2019-02/vm10.log", "logs/2020-01/vm01.log"}
+	for i, name := range names {
+		args := &node.PutFileArgs{LocalName: src, SdfsName: name, ForceUpdate: true}
+		assert(nodes[i%4].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	}
+
+	selected, err := nodes[1].SelectFiles(node.Selector{Pattern: "logs/2019-*/vm0?.log"})
+	check(err)
+	expected := []string{"logs/2019-01/vm01.log", "logs/2019-02/vm02.log"}
+	assert(fmt.Sprint(selected) == fmt.Sprint(expected), fmt.Sprintf("wrong glob selection: %v", selected))
+	selected, err = nodes[2].SelectFiles(node.Selector{Pattern: `logs/20(19|20)-01/.*\.log`, Regex: true})
+	check(err)
+	expected = []string{"logs/2019-01/sub/vm03.log", "logs/2019-01/vm01.log", "logs/2020-01/vm01.log"}
+	assert(fmt.Sprint(selected) == fmt.Sprint(expected), fmt.Sprintf("wrong regex selection: %v", selected))
+
+	// directory objects and blocks are not files
+	selected, err = nodes[3].SelectFiles(node.Selector{Pattern: "logs/*"})
+	check(err)
+	assert(len(selected) == 0, fmt.Sprintf("selected hidden files: %v", selected))
+	selected, err = nodes[3].SelectFiles(node.Selector{Pattern: ".*vm10.*", Regex: true})
+	check(err)
+	assert(fmt.Sprint(selected) == "[logs/2019-02/vm10.log]", fmt.Sprintf("selected blocks: %v", selected))
+
+	_, err = nodes[0].SelectFiles(node.Selector{Pattern: "logs/(", Regex: true})
+	assert(err != nil, "bad regex accepted")
+	_, err = nodes[0].SelectFiles(node.Selector{Pattern: "logs/["})
+	assert(err != nil, "bad glob accepted")
+
+	// listing and deleting take a selector too
+	selected, err = nodes[1].ListFileInDirRequest(node.Selector{Pattern: "logs/2019-0[12]/vm0*"})
+	check(err)
+	expected = []string{"logs/2019-01/vm01.log", "logs/2019-02/vm02.log"}
+	assert(fmt.Sprint(selected) == fmt.Sprint(expected), fmt.Sprintf("wrong listing of a glob: %v", selected))
+	selected, err = nodes[2].ListFilesWithPrefixRequest(node.Selector{Pattern: `logs/2020-.*`, Regex: true})
+	check(err)
+	assert(fmt.Sprint(selected) == "[logs/2020-01/vm01.log]", fmt.Sprintf("wrong juice input of a regex: %v", selected))
+
+	// a name with glob characters is addressed exactly
+	odd := "logs/odd/vm[1].log"
+	args := &node.PutFileArgs{LocalName: src, SdfsName: odd, ForceUpdate: true}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	selected, err = nodes[3].ListFilesWithPrefixRequest(node.Selector{Pattern: "logs/odd/vm[", Literal: true})
+	check(err)
+	assert(fmt.Sprint(selected) == "[logs/odd/vm[1].log]", fmt.Sprintf("wrong literal prefix: %v", selected))
+	selected, err = nodes[3].SelectFiles(node.Selector{Pattern: `logs/odd/vm\[1\].log`})
+	check(err)
+	assert(fmt.Sprint(selected) == "[logs/odd/vm[1].log]", fmt.Sprintf("wrong escaped glob: %v", selected))
+
+	check(nodes[0].DeleteSDFSDirRequest(node.Selector{Pattern: "logs/2019-02/*"}))
+	selected, err = nodes[1].SelectFiles(node.Selector{Pattern: ".*", Regex: true})
+	check(err)
+	expected = []string{"logs/2019-01/sub/vm03.log", "logs/2019-01/vm01.log", "logs/2020-01/vm01.log", odd}
+	assert(fmt.Sprint(selected) == fmt.Sprint(expected), fmt.Sprintf("wrong files after deleting a glob: %v", selected))
+}
+
+func TestReadRepair(t *testing.T) {
+	nodes := startCluster(t, 4, 21700, "/tmp/repair")
+
+	src := "/tmp/dummyrepairfile"
+	defer deleteDummyFile(src)
+	writeDummyFile(src, "fresh")
+	var result node.RPCResultType
+	// reads wait for every replica, so all of them are checked
+	replication := node.Replication{Replicas: 4, ReadQuorum: 4, WriteQuorum: 1}
+	args := &node.PutFileArgs{LocalName: src, SdfsName: "repair.txt", ForceUpdate: true, Replication: replication}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	time.Sleep(100 * time.Millisecond)
+	ts := nodes[0].FileList.GetTimeStamp("repair.txt")
+
+	// one replica lost the file, another one has an older version
+	nodes[1].FileList.DeleteFileAndInfo("repair.txt")
+	check(nodes[2].FileList.StoreFile("repair.txt", nodes[2].Root_dir, ts-1, 0, []byte("stale")))
+	repaired := func(n *node.Node, expected int) bool {
+		for i := 0; i < 40 && n.RepairMetrics(false).Repaired < expected; i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return n.RepairMetrics(false).Repaired == expected
+	}
+
+	dest := "/tmp/dummyrepairget"
+	defer os.Remove(dest)
+	assert(nodes[3].GetFileRequest([]string{"repair.txt", dest}, &result) == nil, "get failed")
+	assert(repaired(nodes[3], 2), fmt.Sprintf("replicas not repaired: %+v", nodes[3].RepairMetrics(false)))
+	for _, n := range nodes[1:3] {
+		data, err := n.FileList.ServeFile("repair.txt")
+		assert(err == nil && string(data) == "fresh" && n.FileList.GetTimeStamp("repair.txt") == ts, "wrong repaired copy")
+	}
+	assert(nodes[3].GetFileRequest([]string{"repair.txt", dest}, &result) == nil, "get failed")
+	metrics := nodes[3].RepairMetrics(true)
+	assert(metrics.Reads == 1 && metrics.Failed == 0, fmt.Sprintf("fresh replicas repaired: %+v", metrics))
+	assert(nodes[3].RepairMetrics(false) == node.RepairMetrics{}, "metrics not reset")
+
+	// the MapleJuice input fetch repairs too
+	nodes[2].FileList.DeleteFileAndInfo("repair.txt")
+	os.MkdirAll("/tmp/repairinput", 0777)
+	defer os.RemoveAll("/tmp/repairinput")
+	check(nodes[0].GetFilesFromSDFS([]string{"repair.txt"}, "/tmp/repairinput"))
+	assert(repaired(nodes[0], 1), fmt.Sprintf("input fetch did not repair: %+v", nodes[0].RepairMetrics(false)))
+}
+
+func TestHintedHandoff(t *testing.T) {
+	nodes := newCluster(4, 21800, "/tmp/hint")
+	// the last node can not be reached over rpc yet
+	serveRPC(t, nodes[:3])
+	joinCluster(t, nodes)
+	pending := func() int {
+		cnt := 0
+		for _, n := range nodes[:3] {
+			cnt += n.PendingHints()
+		}
+		return cnt
+	}
+
+	src := "/tmp/dummyhintfile"
+	defer deleteDummyFile(src)
+	writeDummyFile(src, "hinted")
+	var result node.RPCResultType
+	args := &node.PutFileArgs{LocalName: src, SdfsName: "hinted.txt", ForceUpdate: true}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	assert(pending() > 0, "no hint kept")
+	assert(nodes[3].FileList.GetFileInfo("hinted.txt") == nil, "unreachable replica stored the file")
+
+	// the missing replica is not acked
+	strict := node.Replication{Replicas: 4, ReadQuorum: 1, WriteQuorum: 4}
+	args = &node.PutFileArgs{LocalName: src, SdfsName: "strict.txt", ForceUpdate: true, Replication: strict}
+	err := nodes[0].PutFileRequest(args, &result)
+	assert(err != nil && result == node.RPC_FAIL, "put acked by an unreachable replica")
+
+	// a file deleted meanwhile is not replayed
+	args = &node.PutFileArgs{LocalName: src, SdfsName: "deleted.txt", ForceUpdate: true}
+	assert(nodes[0].PutFileRequest(args, &result) == nil && result == node.RPC_SUCCESS, "put failed")
+	hints := pending()
+	check(nodes[1].DeleteFileRequest("deleted.txt", &result))
+	assert(pending() < hints, "hints of a deleted file kept")
+
+	go nodes[3].StartRPCService()
+	time.Sleep(50 * time.Millisecond)
+	for _, n := range nodes[:3] {
+		n.ReplayHints()
+	}
+	assert(pending() == 0, fmt.Sprintf("%d hints left", pending()))
+	data, err := nodes[3].FileList.ServeFile("hinted.txt")
+	assert(err == nil && string(data) == "hinted", "hint not replayed")
+	assert(nodes[3].FileList.GetTimeStamp("hinted.txt") == nodes[0].FileList.GetTimeStamp("hinted.txt"), "wrong replayed version")
+	for _, n := range nodes {
+		assert(n.FileList.GetFileInfo("deleted.txt") == nil, "deleted file came back")
+	}
+	for i := range nodes[:3] {
+		files, _ := ioutil.ReadDir(fmt.Sprintf("/tmp/hint%d/%s", i, node.HINT_DIR))
+		assert(len(files) == 0, "replayed hints left on disk")
+	}
+}
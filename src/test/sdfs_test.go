@@ -129,6 +129,6 @@ func TestListDir(t *testing.T) {
 	node2.FileList.StoreFile("book/sdfs3", "/tmp/node2", 0, node2.Id, []byte("hello file3"))
 	// CALL node0 list all files in dir
 	var filepaths []string
-	filepaths = node0.ListFileInDirRequest("book")
+	filepaths, _ = node0.ListFileInDirRequest(node.Selector{Pattern: "book"})
 	assert(len(filepaths) == 3, "wrong")
 }
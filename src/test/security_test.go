@@ -0,0 +1,178 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/rpc"
+	"node"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignedMembershipPackets(t *testing.T) {
+	network := node.CreateMemoryTransport(3)
+	nodes := make([]*node.Node, 3)
+	for i := range nodes {
+		nodes[i] = node.CreateNode("0.0.0.0", fmt.Sprintf("%d", 20200+i), "")
+		nodes[i].Transport = network
+		nodes[i].Secret = []byte("cluster secret")
+		go nodes[i].MonitorInputPacket()
+	}
+	nodes[2].Secret = []byte("wrong secret")
+	time.Sleep(10 * time.Millisecond)
+	nodes[0].InitMemberList()
+	assert(nodes[1].Join("0.0.0.0:20200"), "join with the cluster secret failed")
+	assert(!nodes[2].Join("0.0.0.0:20200"), "join with a wrong secret should fail")
+
+	// an unsigned delete must be dropped
+	forged, _ := json.Marshal(node.Packet{Action: node.ACTION_DELETE_NODE, Id: nodes[0].Id})
+	network.Send("0.0.0.0:20202", "0.0.0.0:20201", forged)
+	time.Sleep(50 * time.Millisecond)
+	assert(nodes[1].MbList.GetNode(nodes[0].Id) != nil, "forged packet should be dropped")
+	assert(nodes[1].MbList.Size == 2, "wrong member list size")
+}
+
+// recordingTransport keeps the packets sent between two addresses
+type recordingTransport struct {
+	*node.MemoryTransport
+	lock *sync.Mutex
+	sent map[string][][]byte // Key: from->to
+}
+
+func (t *recordingTransport) Send(from, to string, data []byte) error {
+	t.lock.Lock()
+	t.sent[from+"->"+to] = append(t.sent[from+"->"+to], data)
+	t.lock.Unlock()
+	return t.MemoryTransport.Send(from, to, data)
+}
+
+// take returns and forgets the packets sent from from to to
+func (t *recordingTransport) take(from, to string) [][]byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sent := t.sent[from+"->"+to]
+	delete(t.sent, from+"->"+to)
+	return sent
+}
+
+// seal signs a packet like a node does, sent at the given time
+func seal(secret []byte, sent time.Time, packet node.Packet) []byte {
+	data, _ := json.Marshal(packet)
+	signed := make([]byte, 16)
+	binary.BigEndian.PutUint64(signed, uint64(sent.UnixNano()/int64(time.Millisecond)))
+	rand.Read(signed[8:])
+	signed = append(signed, data...)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	return append(mac.Sum(nil), signed...)
+}
+
+func TestReplayedPacketsDropped(t *testing.T) {
+	network := &recordingTransport{node.CreateMemoryTransport(4), &sync.Mutex{}, make(map[string][][]byte)}
+	secret := []byte("cluster secret")
+	nodes := make([]*node.Node, 2)
+	for i := range nodes {
+		nodes[i] = node.CreateNode("0.0.0.0", fmt.Sprintf("%d", 20210+i), "")
+		nodes[i].Transport = network
+		nodes[i].Secret = secret
+		nodes[i].Timing.ProbeInterval = 10 * time.Millisecond
+		go nodes[i].MonitorInputPacket()
+	}
+	time.Sleep(10 * time.Millisecond)
+	nodes[0].InitMemberList()
+	assert(nodes[1].Join("0.0.0.0:20210"), "join failed")
+	time.Sleep(50 * time.Millisecond)
+	address0, address1 := "0.0.0.0:20210", "0.0.0.0:20211"
+	network.take(address0, address1)
+	network.take(address1, address0)
+
+	assert(nodes[0].ProbeNode(nodes[1].Id), "node1 should ack")
+	pings := network.take(address0, address1)
+	assert(len(pings) == 1 && len(network.take(address1, address0)) == 1, "one ping and one ack expected")
+	acks := func(data []byte) int {
+		network.MemoryTransport.Send(address0, address1, data)
+		time.Sleep(50 * time.Millisecond)
+		return len(network.take(address1, address0))
+	}
+	assert(acks(pings[0]) == 0, "replayed ping should be dropped")
+
+	ping := node.Packet{Action: node.ACTION_PING, Id: nodes[0].Id, IP: "0.0.0.0", Port: "20210", Seq: 12345}
+	assert(acks(seal(secret, time.Now(), ping)) == 1, "fresh ping should be acked")
+	assert(acks(seal(secret, time.Now().Add(-time.Minute), ping)) == 0, "stale ping should be dropped")
+}
+
+func createCert(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("0.0.0.0"), net.ParseIP("127.0.0.1")},
+	}
+	template.IsCA = isCA
+	template.BasicConstraintsValid = true
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	check(err)
+	cert, err := x509.ParseCertificate(der)
+	check(err)
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, caTLS := createCert(nil, nil, true)
+	_, leaf := createCert(ca, caTLS.PrivateKey.(*ecdsa.PrivateKey), false)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	node.SetTLS(pool, leaf)
+	defer node.DisableTLS()
+
+	node0 := node.CreateNode("0.0.0.0", "9600", "9610")
+	node0.InitMemberList()
+	go node0.StartRPCService()
+	time.Sleep(50 * time.Millisecond)
+	address := "0.0.0.0:9610"
+	var files []string
+
+	client, err := node.DialRPC(address)
+	assert(err == nil, "dial with the cluster certificate failed")
+	err = client.Call(node.FileServiceName+address+".ListFileInLocalDir", "/", &files)
+	assert(err == nil, "call with the cluster certificate failed")
+	client.Close()
+
+	plain, err := rpc.Dial("tcp", address)
+	if err == nil {
+		err = plain.Call(node.FileServiceName+address+".ListFileInLocalDir", "/", &files)
+		plain.Close()
+	}
+	assert(err != nil, "plain rpc should be refused")
+
+	// a certificate from another CA is refused
+	other, otherTLS := createCert(nil, nil, true)
+	_, otherLeaf := createCert(other, otherTLS.PrivateKey.(*ecdsa.PrivateKey), false)
+	conn, err := tls.Dial("tcp", address, &tls.Config{Certificates: []tls.Certificate{otherLeaf}, RootCAs: pool})
+	if err == nil {
+		stranger := rpc.NewClient(conn)
+		err = stranger.Call(node.FileServiceName+address+".ListFileInLocalDir", "/", &files)
+		stranger.Close()
+	}
+	assert(err != nil, "certificate of another CA should be refused")
+}
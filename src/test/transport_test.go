@@ -0,0 +1,43 @@
+package test
+
+import (
+	"node"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	network := node.CreateMemoryTransport(1)
+	received := make(chan string, 10)
+	go network.Listen("a", func(data []byte) { received <- "a:" + string(data) })
+	go network.Listen("b", func(data []byte) { received <- "b:" + string(data) })
+	time.Sleep(10 * time.Millisecond)
+
+	network.Send("a", "b", []byte("hello"))
+	assert(<-received == "b:hello", "wrong packet")
+
+	network.Partition([]string{"a"}, []string{"b"})
+	network.Send("a", "b", []byte("lost"))
+	network.Heal()
+	network.Send("b", "a", []byte("healed"))
+	assert(<-received == "a:healed", "partition should drop packets")
+
+	network.DuplicateRate = 1
+	network.MinDelay = 20 * time.Millisecond
+	network.MaxDelay = 30 * time.Millisecond
+	start := time.Now()
+	network.Send("a", "b", []byte("twice"))
+	assert(<-received == "b:twice" && <-received == "b:twice", "packet should be duplicated")
+	assert(time.Since(start) >= 20*time.Millisecond, "packet should be delayed")
+
+	network.DuplicateRate = 0
+	network.MinDelay, network.MaxDelay = 0, 0
+	network.LossRate = 1
+	network.Send("a", "b", []byte("lost"))
+	network.LossRate = 0
+	network.Crash("b")
+	network.Send("b", "a", []byte("lost"))
+	network.Send("a", "b", []byte("lost"))
+	time.Sleep(10 * time.Millisecond)
+	assert(len(received) == 0, "packets should be dropped")
+}